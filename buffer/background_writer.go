@@ -0,0 +1,168 @@
+package buffer
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jobala/petro/util"
+)
+
+const (
+	DEFAULT_WRITER_INTERVAL = 100 * time.Millisecond
+	DEFAULT_WRITER_PAGES    = 8
+	DEFAULT_DIRTY_RATIO     = 0.25
+)
+
+// WriterOptions configures the background writer, zero fields take their
+// defaults
+type WriterOptions struct {
+	// Interval is how often the writer runs
+	Interval time.Duration
+
+	// MaxPages is the most pages written each run, it limits the rate the
+	// writer takes from foreground requests
+	MaxPages int
+
+	// DirtyRatio is the share of the pool's frames that has to be dirty
+	// before the writer runs
+	DirtyRatio float64
+}
+
+// StartBackgroundWriter writes the coldest dirty frames to disk every
+// interval, so that eviction finds clean frames and fetches don't wait for a
+// write. Frames in use are skipped. Starting a running writer restarts it.
+func (b *BufferpoolManager) StartBackgroundWriter(opts WriterOptions) {
+	b.StopBackgroundWriter()
+
+	if opts.Interval <= 0 {
+		opts.Interval = DEFAULT_WRITER_INTERVAL
+	}
+	if opts.MaxPages <= 0 {
+		opts.MaxPages = DEFAULT_WRITER_PAGES
+	}
+	if opts.DirtyRatio <= 0 {
+		opts.DirtyRatio = DEFAULT_DIRTY_RATIO
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	b.writerMu.Lock()
+	b.writerStop, b.writerDone = stop, done
+	b.writerMu.Unlock()
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(opts.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				// pages that fail to be written stay dirty for the next run
+				_, _ = b.writeBack(opts.MaxPages, opts.DirtyRatio)
+			}
+		}
+	}()
+}
+
+// StopBackgroundWriter stops the writer and waits for it to exit
+func (b *BufferpoolManager) StopBackgroundWriter() {
+	b.writerMu.Lock()
+	stop, done := b.writerStop, b.writerDone
+	b.writerStop, b.writerDone = nil, nil
+	b.writerMu.Unlock()
+
+	if stop == nil {
+		return
+	}
+
+	close(stop)
+	<-done
+}
+
+// writeBack runs the writer over every partition, each partition writes its
+// share of maxPages. It returns how many pages were written.
+func (b *BufferpoolManager) writeBack(maxPages int, ratio float64) (int, error) {
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+
+	perPartition := max(maxPages/len(b.partitions), 1)
+
+	written, errs := 0, []error{}
+	for _, p := range b.partitions {
+		n, err := p.writeBack(perPartition, ratio)
+		written += n
+		errs = append(errs, err)
+	}
+
+	return written, errors.Join(errs...)
+}
+
+// writeBack writes up to maxPages of the coldest dirty frames of the
+// partition when at least ratio of its frames are dirty, and returns how many
+// were written
+func (p *partition) writeBack(maxPages int, ratio float64) (int, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return 0, util.ErrClosed
+	}
+
+	dirty := 0
+	for _, frame := range p.frames {
+		if frame.dirty.Load() {
+			dirty++
+		}
+	}
+	if dirty == 0 || float64(dirty) < ratio*float64(len(p.frames)) {
+		p.mu.Unlock()
+		return 0, nil
+	}
+
+	// the frames are latched so that they aren't changed while they're
+	// written, and pinned so that they aren't evicted
+	frames := []*frame{}
+	for _, id := range p.replacer.victims(len(p.frames)) {
+		if len(frames) == maxPages {
+			break
+		}
+
+		frame := p.frames[id]
+		if !frame.dirty.Load() || !frame.mu.TryRLock() {
+			continue
+		}
+		frame.pin()
+		p.replacer.setEvictable(frame.id, false)
+		frames = append(frames, frame)
+	}
+	p.mu.Unlock()
+
+	// writers wait for the latch, so a frame dirtied again is marked after
+	// it's cleaned here
+	for _, frame := range frames {
+		frame.dirty.Store(false)
+	}
+
+	errs := waitWrites(scheduleWrites(p.diskScheduler, pages(frames)))
+	for i, frame := range frames {
+		if errs[i] != nil {
+			frame.dirty.Store(true)
+		}
+
+		frame.mu.RUnlock()
+		p.unpin(frame)
+	}
+
+	written := 0
+	for _, err := range errs {
+		if err == nil {
+			written++
+		}
+	}
+
+	return written, errors.Join(errs...)
+}
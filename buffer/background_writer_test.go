@@ -0,0 +1,111 @@
+package buffer
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jobala/petro/storage/disk"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackgroundWriter(t *testing.T) {
+	setup := func(t *testing.T) (*os.File, *BufferpoolManager) {
+		file := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(file.Name())
+		})
+
+		replacer := NewLrukReplacer(5, 2)
+		diskScheduler := disk.NewScheduler(disk.NewManager(file))
+		bufferMgr := NewBufferpoolManager(5, replacer, diskScheduler)
+
+		for pageId := int64(1); pageId <= 4; pageId++ {
+			pageGuard, err := bufferMgr.WritePage(pageId)
+			assert.NoError(t, err)
+			copy(*pageGuard.GetDataMut(), fmt.Sprintf("page %d", pageId))
+			pageGuard.Drop()
+		}
+
+		return file, bufferMgr
+	}
+
+	dirtyFrames := func(bufferMgr *BufferpoolManager) int {
+		dirty := 0
+		for _, frame := range bufferMgr.partitions[0].frames {
+			if frame.dirty.Load() {
+				dirty++
+			}
+		}
+		return dirty
+	}
+
+	onDisk := func(t *testing.T, file *os.File, pageId int) string {
+		data, err := os.ReadFile(file.Name())
+		assert.NoError(t, err)
+		if len(data) < (pageId+1)*disk.PAGE_SIZE {
+			return ""
+		}
+		return string(bytes.Trim(data[pageId*disk.PAGE_SIZE:(pageId+1)*disk.PAGE_SIZE], "\x00"))
+	}
+
+	t.Run("writes back the coldest dirty frames", func(t *testing.T) {
+		file, bufferMgr := setup(t)
+
+		written, err := bufferMgr.writeBack(2, 0.5)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, written)
+		assert.Equal(t, 2, dirtyFrames(bufferMgr))
+
+		// the pages written first are the coldest
+		assert.Equal(t, "page 1", onDisk(t, file, 1))
+		assert.Equal(t, "page 2", onDisk(t, file, 2))
+	})
+
+	t.Run("waits for the dirty ratio", func(t *testing.T) {
+		_, bufferMgr := setup(t)
+
+		written, err := bufferMgr.writeBack(8, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, written)
+		assert.Equal(t, 4, dirtyFrames(bufferMgr))
+	})
+
+	t.Run("skips frames in use", func(t *testing.T) {
+		file, bufferMgr := setup(t)
+
+		pageGuard, err := bufferMgr.WritePage(1)
+		assert.NoError(t, err)
+
+		written, err := bufferMgr.writeBack(8, 0.1)
+		assert.NoError(t, err)
+		assert.Equal(t, 3, written)
+		assert.Equal(t, "", onDisk(t, file, 1))
+		pageGuard.Drop()
+
+		// a frame dirtied again after it was written is written again
+		pageGuard, err = bufferMgr.WritePage(2)
+		assert.NoError(t, err)
+		copy(*pageGuard.GetDataMut(), "page 2 again")
+		pageGuard.Drop()
+
+		written, err = bufferMgr.writeBack(8, 0.1)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, written)
+		assert.Equal(t, "page 2 again", onDisk(t, file, 2))
+	})
+
+	t.Run("runs in the background until stopped", func(t *testing.T) {
+		file, bufferMgr := setup(t)
+
+		bufferMgr.StartBackgroundWriter(WriterOptions{Interval: 10 * time.Millisecond, DirtyRatio: 0.1})
+		assert.Eventually(t, func() bool {
+			return onDisk(t, file, 4) == "page 4"
+		}, time.Second, 10*time.Millisecond)
+
+		assert.NoError(t, bufferMgr.Close())
+		assert.Nil(t, bufferMgr.writerStop)
+	})
+}
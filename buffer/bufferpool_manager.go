@@ -1,181 +1,322 @@
 package buffer
 
 import (
-	"fmt"
+	"cmp"
+	"errors"
+	"slices"
 	"sync"
 	"sync/atomic"
 
 	"github.com/jobala/petro/storage/disk"
+	"github.com/jobala/petro/util"
 )
 
 const BUFFER_CAPACITY = 20
 
 func NewBufferpoolManager(size int, replacer *lrukReplacer, diskScheduler *disk.DiskScheduler) *BufferpoolManager {
-	frames := make([]*frame, size)
-	freeFrames := make([]int, size)
-
-	for i := range size {
-		f := &frame{
-			id:   i,
-			data: make([]byte, disk.PAGE_SIZE),
-		}
+	return newBufferpoolManager([]*partition{newPartition(size, replacer, diskScheduler)}, diskScheduler)
+}
 
-		frames[i] = f
-		freeFrames[i] = i
+// NewPartitionedBufferpoolManager splits size frames between partitions, each
+// with its own page table, free frames and LRU-K replacer. Pages are assigned
+// to partitions by id, so fetches of pages in different partitions don't
+// contend for a lock. A page can only be cached in its partition's frames.
+func NewPartitionedBufferpoolManager(size, partitions, k int, diskScheduler *disk.DiskScheduler) *BufferpoolManager {
+	partitions = min(max(partitions, 1), max(size, 1))
+
+	parts := make([]*partition, partitions)
+	for i := range parts {
+		frames := partitionShare(size, partitions, i)
+		parts[i] = newPartition(frames, NewLrukReplacer(frames, k), diskScheduler)
 	}
 
+	return newBufferpoolManager(parts, diskScheduler)
+}
+
+func newBufferpoolManager(partitions []*partition, diskScheduler *disk.DiskScheduler) *BufferpoolManager {
 	bpm := &BufferpoolManager{
-		mu:            sync.Mutex{},
-		frames:        frames,
-		pageTable:     make(map[int64]int),
-		replacer:      replacer,
+		partitions:    partitions,
 		diskScheduler: diskScheduler,
-		freeFrames:    freeFrames,
 	}
-	bpm.cond = *sync.NewCond(&bpm.mu)
+
+	// continue issuing page ids after the pages already on disk, page 0 is
+	// the header page
+	if count, err := diskScheduler.PageCount(); err == nil && count > 1 {
+		bpm.nextPageId.Store(count - 1)
+	}
+
 	return bpm
 }
 
 func (b *BufferpoolManager) ReadPage(pageId int64) (*ReadPageGuard, error) {
-	b.mu.Lock()
-	defer b.mu.Unlock()
-	var frame *frame
+	p := b.partitionOf(pageId)
+
+	frame, err := p.fetch(pageId)
+	if err != nil {
+		return nil, err
+	}
 
-	for {
-		if id, ok := b.pageTable[pageId]; ok {
-			frame := b.frames[id]
+	frame.mu.RLock()
+	return NewReadPageGuard(frame, p), nil
+}
 
-			b.replacer.recordAccess(frame.id)
-			b.replacer.setEvictable(frame.id, false)
-			frame.mu.RLock()
-			frame.pin()
+func (b *BufferpoolManager) WritePage(pageId int64) (*WritePageGuard, error) {
+	p := b.partitionOf(pageId)
 
-			return NewReadPageGuard(frame, b), nil
-		}
+	frame, err := p.fetch(pageId)
+	if err != nil {
+		return nil, err
+	}
 
-		// try to get a frame
-		if len(b.freeFrames) > 0 {
-			id := b.freeFrames[0]
-			frame = b.frames[id]
-			b.freeFrames = b.freeFrames[1:]
-		} else {
-			if id, _ := b.replacer.evict(); id != disk.INVALID_PAGE_ID {
-				frame = b.frames[id]
-				b.flush(frame)
-			}
-		}
+	frame.mu.Lock()
+	frame.dirty.Store(true)
+	return NewWritePageGuard(frame, p), nil
+}
 
-		// got a frame
-		if frame != nil {
-			delete(b.pageTable, frame.pageId)
-			b.pageTable[pageId] = frame.id
+// ReadCachedPage returns a guard on pageId when the page is in the pool and
+// loaded, it never reads from disk
+func (b *BufferpoolManager) ReadCachedPage(pageId int64) (*ReadPageGuard, bool) {
+	p := b.partitionOf(pageId)
 
-			b.replacer.recordAccess(frame.id)
-			b.replacer.setEvictable(frame.id, false)
+	frame := p.cached(pageId)
+	if frame == nil {
+		return nil, false
+	}
 
-			frame.mu.RLock()
-			frame.reset()
-			frame.pin()
-			frame.pageId = pageId
-			diskReq := disk.NewRequest(pageId, nil, false)
-			respCh := b.diskScheduler.Schedule(diskReq)
-			resp := <-respCh
-			copy(frame.data, resp.Data)
+	frame.mu.RLock()
+	return NewReadPageGuard(frame, p), true
+}
 
-			return NewReadPageGuard(frame, b), nil
-		}
+// Prefetch starts loading the pages that aren't in the pool and returns
+// without waiting for them. Fetching a page that is being loaded waits for
+// it. Prefetching doesn't write, pages that would evict a dirty page or find
+// every frame pinned are skipped, and pages that fail to load are left out of
+// the pool.
+func (b *BufferpoolManager) Prefetch(pageIds ...int64) {
+	byPartition := map[*partition][]int64{}
+	for _, pageId := range pageIds {
+		p := b.partitionOf(pageId)
+		byPartition[p] = append(byPartition[p], pageId)
+	}
 
-		// failed to get a frame, wait for a frame to become available
-		b.cond.Wait()
+	for p, pageIds := range byPartition {
+		p.prefetch(pageIds)
 	}
 }
 
-func (b *BufferpoolManager) WritePage(pageId int64) (*WritePageGuard, error) {
-	b.mu.Lock()
-	defer b.mu.Unlock()
+// Size returns the number of frames in the pool
+func (b *BufferpoolManager) Size() int {
+	size := 0
+	for _, p := range b.partitions {
+		p.mu.Lock()
+		size += len(p.frames)
+		p.mu.Unlock()
+	}
 
-	var frame *frame
+	return size
+}
 
-	for {
-		if id, ok := b.pageTable[pageId]; ok {
-			frame := b.frames[id]
+// PageSize returns the size of the pages the pool caches
+func (b *BufferpoolManager) PageSize() int {
+	return b.diskScheduler.PageSize()
+}
 
-			b.replacer.recordAccess(frame.id)
-			b.replacer.setEvictable(frame.id, false)
-			frame.mu.Lock()
-			frame.pin()
-			frame.dirty = true
+func (b *BufferpoolManager) NewPageId() int64 {
+	return b.nextPageId.Add(1)
+}
 
-			return NewWritePageGuard(frame, b), nil
-		}
+// FlushAll writes every dirty frame to disk and syncs the db file as the
+// disk manager's sync mode asks. Pages are copied under their latches, so it
+// waits for the write guards held on dirty pages to be dropped.
+func (b *BufferpoolManager) FlushAll() error {
+	b.lockAll()
+	closed := b.partitions[0].closed
+	b.unlockAll()
+	if closed {
+		return util.ErrClosed
+	}
 
-		// try getting a frame
-		if len(b.freeFrames) > 0 {
-			id := b.freeFrames[0]
-			frame = b.frames[id]
-			b.freeFrames = b.freeFrames[1:]
-		} else {
-			if id, _ := b.replacer.evict(); id != disk.INVALID_PAGE_ID {
-				frame = b.frames[id]
-				b.flush(frame)
-			}
-		}
+	if err := errors.Join(b.flush()...); err != nil {
+		return err
+	}
+
+	return b.diskScheduler.Sync()
+}
+
+// Close stops the background writer, writes the dirty frames to disk and
+// closes the disk scheduler, later page fetches return ErrClosed
+func (b *BufferpoolManager) Close() error {
+	b.StopBackgroundWriter()
+
+	b.lockAll()
+	if b.partitions[0].closed {
+		b.unlockAll()
+		return nil
+	}
+
+	// wake the fetches waiting for a frame, they find the pool closed
+	for _, p := range b.partitions {
+		p.closed = true
+		p.cond.Broadcast()
+	}
+	b.unlockAll()
+
+	errs := b.flush()
+	errs = append(errs, b.diskScheduler.Close())
+
+	return errors.Join(errs...)
+}
+
+// flush writes every dirty frame to disk and returns the error of each write.
+// Pages being written back by evictions are waited for, a page that failed to
+// be written is back in its frame and is flushed with the others.
+func (b *BufferpoolManager) flush() []error {
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+
+	b.lockAll()
+	frames, evictions := b.pinDirty(nil)
+	b.unlockAll()
+
+	for _, done := range evictions {
+		<-done
+	}
 
-		// got the frame, return a page guard
-		if frame != nil {
-			delete(b.pageTable, frame.pageId)
-			b.pageTable[pageId] = frame.id
-
-			b.replacer.recordAccess(frame.id)
-			b.replacer.setEvictable(frame.id, false)
-
-			frame.mu.Lock()
-			frame.reset()
-			frame.pin()
-			frame.dirty = true
-			frame.pageId = pageId
-
-			diskReq := disk.NewRequest(pageId, nil, false)
-			respCh := b.diskScheduler.Schedule(diskReq)
-			resp := <-respCh
-			copy(frame.data, resp.Data)
-			return NewWritePageGuard(frame, b), nil
+	if len(evictions) > 0 {
+		b.lockAll()
+		more, _ := b.pinDirty(frames)
+		b.unlockAll()
+		frames = append(frames, more...)
+	}
+
+	errs := waitWrites(scheduleWrites(b.diskScheduler, snapshot(frames)))
+	for i, frame := range frames {
+		if errs[i] != nil {
+			frame.dirty.Store(true)
 		}
+		b.partitionOf(frame.pageId).unpin(frame)
+	}
+
+	return errs
+}
 
-		// failed to get a frame, wait for a frame to become available
-		// pageGuard.Drop will send a signal
-		fmt.Println("waiting for a frame to become available")
-		b.cond.Wait()
+// partitionOf returns the partition caching pageId
+func (b *BufferpoolManager) partitionOf(pageId int64) *partition {
+	return b.partitions[pageId%int64(len(b.partitions))]
+}
+
+// lockAll locks every partition in order
+func (b *BufferpoolManager) lockAll() {
+	for _, p := range b.partitions {
+		p.mu.Lock()
 	}
 }
 
-func (b *BufferpoolManager) NewPageId() int64 {
-	return b.nextPageId.Add(1)
+func (b *BufferpoolManager) unlockAll() {
+	for _, p := range b.partitions {
+		p.mu.Unlock()
+	}
+}
+
+// pinDirty pins the dirty frames of every partition that aren't in pinned,
+// see partition.pinDirty. Callers must hold every partition's mu.
+func (b *BufferpoolManager) pinDirty(pinned []*frame) ([]*frame, []chan struct{}) {
+	frames, evictions := []*frame{}, []chan struct{}{}
+	for _, p := range b.partitions {
+		f, e := p.pinDirty(pinned)
+		frames = append(frames, f...)
+		evictions = append(evictions, e...)
+	}
+
+	return frames, evictions
+}
+
+// pages sorts frames by page id and returns their pages, the frames must keep
+// their pages and contents until the writes are done
+func pages(frames []*frame) []page {
+	sortFrames(frames)
+
+	pages := make([]page, len(frames))
+	for i, frame := range frames {
+		pages[i] = page{pageId: frame.pageId, data: frame.data}
+	}
+
+	return pages
 }
 
-func (b *BufferpoolManager) FlushAll() {
-	for _, frame := range b.frames {
-		b.flush(frame)
+// snapshot sorts frames by page id and copies their pages under their latches.
+// Each frame is marked clean as it's copied, so a write made after the copy
+// dirties it again.
+func snapshot(frames []*frame) []page {
+	sortFrames(frames)
+
+	pages := make([]page, len(frames))
+	for i, frame := range frames {
+		frame.mu.RLock()
+		frame.dirty.Store(false)
+		pages[i] = page{pageId: frame.pageId, data: slices.Clone(frame.data)}
+		frame.mu.RUnlock()
 	}
+
+	return pages
 }
 
-func (b *BufferpoolManager) flush(frame *frame) {
-	if frame.dirty {
-		writeReq := disk.NewRequest(frame.pageId, frame.data, true)
-		respCh := b.diskScheduler.Schedule(writeReq)
+func sortFrames(frames []*frame) {
+	slices.SortFunc(frames, func(a, b *frame) int {
+		return cmp.Compare(a.pageId, b.pageId)
+	})
+}
+
+// scheduleWrites queues the writes of pages in a single batch, so that
+// adjacent pages are written together
+func scheduleWrites(diskScheduler *disk.DiskScheduler, pages []page) []pageWrite {
+	reqs := make([]disk.DiskReq, len(pages))
+	for i, page := range pages {
+		reqs[i] = disk.NewRequest(page.pageId, page.data, true)
+	}
+
+	writes := make([]pageWrite, len(pages))
+	for i, respCh := range diskScheduler.ScheduleBatch(reqs) {
+		writes[i] = pageWrite{pageId: pages[i].pageId, respCh: respCh}
+	}
+
+	return writes
+}
 
-		// block until data is written to disk
-		<-respCh
+// waitWrites returns the error of each write
+func waitWrites(writes []pageWrite) []error {
+	errs := make([]error, len(writes))
+	for i, write := range writes {
+		if resp := <-write.respCh; resp.Err != nil {
+			errs[i] = &util.IOError{Op: "write", PageId: write.pageId, Err: resp.Err}
+		}
 	}
+
+	return errs
+}
+
+// page is a page to be written
+type page struct {
+	pageId int64
+	data   []byte
+}
+
+type pageWrite struct {
+	pageId int64
+	respCh <-chan disk.DiskResp
 }
 
 type BufferpoolManager struct {
-	mu            sync.Mutex
-	frames        []*frame
-	pageTable     map[int64]int
+	partitions    []*partition
 	nextPageId    atomic.Int64
 	diskScheduler *disk.DiskScheduler
-	replacer      *lrukReplacer
-	freeFrames    []int
-	cond          sync.Cond
+	resizeMu      sync.Mutex
+
+	// flushMu keeps flushes and the background writer apart, so a flush
+	// doesn't miss a page the writer marked clean but hasn't written yet
+	flushMu sync.Mutex
+
+	writerMu   sync.Mutex
+	writerStop chan struct{}
+	writerDone chan struct{}
 }
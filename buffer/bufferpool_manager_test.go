@@ -6,8 +6,10 @@ import (
 	"os"
 	"path"
 	"testing"
+	"time"
 
 	"github.com/jobala/petro/storage/disk"
+	"github.com/jobala/petro/util"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -33,7 +35,7 @@ func TestBufferPoolManager(t *testing.T) {
 		assert.NoError(t, err)
 
 		assert.Equal(t, data, pageGuard.GetData())
-		assert.Equal(t, data, bufferMgr.frames[0].data)
+		assert.Equal(t, data, bufferMgr.partitions[0].frames[0].data)
 	})
 
 	t.Run("evicts least recently used page", func(t *testing.T) {
@@ -76,11 +78,11 @@ func TestBufferPoolManager(t *testing.T) {
 		}
 
 		// page id 1, should have been evicted
-		assert.Equal(t, bufferMgr.frames[0].pageId, int64(2))
-		assert.Equal(t, bufferMgr.frames[1].pageId, int64(3))
+		assert.Equal(t, bufferMgr.partitions[0].frames[0].pageId, int64(2))
+		assert.Equal(t, bufferMgr.partitions[0].frames[1].pageId, int64(3))
 
 		// buffermanager's pagetable shouldn't have evicted pageId
-		_, ok := bufferMgr.pageTable[1]
+		_, ok := bufferMgr.partitions[0].pageTable[1]
 		assert.Equal(t, false, ok)
 	})
 
@@ -101,13 +103,15 @@ func TestBufferPoolManager(t *testing.T) {
 
 		pageGuard, err := bufferMgr.WritePage(int64(pageId))
 		copy(*pageGuard.GetDataMut(), data)
-		defer pageGuard.Drop()
 
 		assert.NoError(t, err)
-		assert.Equal(t, data, bufferMgr.frames[0].data)
-		assert.True(t, bufferMgr.frames[0].dirty, true)
+		assert.Equal(t, data, bufferMgr.partitions[0].frames[0].data)
+		assert.True(t, bufferMgr.partitions[0].frames[0].dirty.Load())
 
-		bufferMgr.flush(bufferMgr.frames[0])
+		// flushing waits for the page's write guard
+		pageGuard.Drop()
+		assert.NoError(t, bufferMgr.FlushAll())
+		assert.False(t, bufferMgr.partitions[0].frames[0].dirty.Load())
 		res := syncRead(pageId, diskScheduler)
 		assert.Equal(t, data, res)
 	})
@@ -170,6 +174,326 @@ func TestBufferPoolManager(t *testing.T) {
 			assert.Equal(t, data, string(bytes.Trim(pageGuard.GetData(), "\x00")))
 		}
 	})
+
+	t.Run("keeps page 0 cached when free frames are used", func(t *testing.T) {
+		file := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(file.Name())
+		})
+
+		replacer := NewLrukReplacer(4, 2)
+		diskMgr := disk.NewManager(file)
+		diskScheduler := disk.NewScheduler(diskMgr)
+		bufferMgr := NewBufferpoolManager(4, replacer, diskScheduler)
+
+		pageGuard, err := bufferMgr.WritePage(0)
+		assert.NoError(t, err)
+		copy(*pageGuard.GetDataMut(), []byte("header"))
+		pageGuard.Drop()
+
+		for pageId := range 2 {
+			pageGuard, err := bufferMgr.ReadPage(int64(pageId + 1))
+			assert.NoError(t, err)
+			pageGuard.Drop()
+		}
+
+		readGuard, err := bufferMgr.ReadPage(0)
+		assert.NoError(t, err)
+		readGuard.Drop()
+		assert.Equal(t, "header", string(bytes.Trim(readGuard.GetData(), "\x00")))
+	})
+
+	t.Run("fails fetching pages that can't be read", func(t *testing.T) {
+		file := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(file.Name())
+		})
+
+		keys := disk.StaticKeys{Current: 1, Keys: map[uint32][]byte{1: bytes.Repeat([]byte{1}, 32)}}
+		replacer := NewLrukReplacer(2, 2)
+		diskMgr := disk.NewManager(file, disk.WithEncryption(keys))
+		diskScheduler := disk.NewScheduler(diskMgr)
+		bufferMgr := NewBufferpoolManager(2, replacer, diskScheduler)
+
+		data := make([]byte, disk.PAGE_SIZE)
+		copy(data, []byte("hello, world!"))
+		syncWrite(1, data, diskScheduler)
+
+		// corrupt the page on disk
+		_, err := file.WriteAt([]byte("garbage"), disk.FILE_HEADER_SIZE+disk.PAGE_SIZE+disk.ENCRYPTION_OVERHEAD+100)
+		assert.NoError(t, err)
+
+		_, err = bufferMgr.ReadPage(1)
+		var ioErr *util.IOError
+		assert.ErrorAs(t, err, &ioErr)
+		assert.Equal(t, int64(1), ioErr.PageId)
+		assert.ErrorIs(t, err, util.ErrCorruptPage)
+
+		_, err = bufferMgr.WritePage(1)
+		assert.ErrorIs(t, err, util.ErrCorruptPage)
+
+		// the failed fetches don't hold on to frames
+		assert.NotContains(t, bufferMgr.partitions[0].pageTable, int64(1))
+		assert.Len(t, bufferMgr.partitions[0].freeFrames, 2)
+
+		syncWrite(1, data, diskScheduler)
+		pageGuard, err := bufferMgr.ReadPage(1)
+		assert.NoError(t, err)
+		assert.Equal(t, data, pageGuard.GetData())
+		pageGuard.Drop()
+	})
+
+	t.Run("flush all writes every dirty frame", func(t *testing.T) {
+		file := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(file.Name())
+		})
+
+		replacer := NewLrukReplacer(5, 2)
+		diskMgr := disk.NewManager(file)
+		diskScheduler := disk.NewScheduler(diskMgr)
+		bufferMgr := NewBufferpoolManager(5, replacer, diskScheduler)
+
+		for _, pageId := range []int64{3, 1, 4, 2} {
+			pageGuard, err := bufferMgr.WritePage(pageId)
+			assert.NoError(t, err)
+			copy(*pageGuard.GetDataMut(), fmt.Sprintf("page %d", pageId))
+			pageGuard.Drop()
+		}
+		assert.NoError(t, bufferMgr.FlushAll())
+
+		data, err := os.ReadFile(file.Name())
+		assert.NoError(t, err)
+		for pageId := 1; pageId <= 4; pageId++ {
+			page := data[pageId*disk.PAGE_SIZE : (pageId+1)*disk.PAGE_SIZE]
+			assert.Equal(t, fmt.Sprintf("page %d", pageId), string(bytes.Trim(page, "\x00")))
+		}
+	})
+
+	t.Run("flush all waits for pages being written back", func(t *testing.T) {
+		file := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(file.Name())
+		})
+
+		replacer := NewLrukReplacer(1, 2)
+		diskMgr := disk.NewManager(file)
+		diskScheduler := disk.NewScheduler(diskMgr)
+		bufferMgr := NewBufferpoolManager(1, replacer, diskScheduler)
+
+		pageGuard, err := bufferMgr.WritePage(1)
+		assert.NoError(t, err)
+		copy(*pageGuard.GetDataMut(), "page 1")
+		pageGuard.Drop()
+
+		// page 1 is evicted for page 2 but isn't written back yet
+		p := bufferMgr.partitions[0]
+		p.mu.Lock()
+		frame := p.getFrame()
+		evicted := p.reserve(frame, 2)
+		p.mu.Unlock()
+
+		flushed := make(chan error)
+		go func() {
+			flushed <- bufferMgr.FlushAll()
+		}()
+
+		select {
+		case <-flushed:
+			t.Fatal("flush returned before the write back")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		assert.NoError(t, p.writeVictim(evicted))
+		p.mu.Lock()
+		p.finishLoad(frame, evicted, nil, nil)
+		p.unpinLocked(frame)
+		p.mu.Unlock()
+
+		assert.NoError(t, <-flushed)
+		assert.Equal(t, "page 1", string(bytes.Trim(syncRead(1, diskScheduler), "\x00")))
+	})
+
+	t.Run("prefetches pages", func(t *testing.T) {
+		file := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(file.Name())
+		})
+
+		replacer := NewLrukReplacer(3, 2)
+		diskMgr := disk.NewManager(file)
+		diskScheduler := disk.NewScheduler(diskMgr)
+		bufferMgr := NewBufferpoolManager(3, replacer, diskScheduler)
+
+		pages := map[int64][]byte{}
+		for pageId := range int64(5) {
+			data := make([]byte, disk.PAGE_SIZE)
+			copy(data, fmt.Sprintf("page %d", pageId))
+			syncWrite(int(pageId), data, diskScheduler)
+			pages[pageId] = data
+		}
+
+		pinned, err := bufferMgr.ReadPage(0)
+		assert.NoError(t, err)
+
+		// the pool has room for two of the pages
+		bufferMgr.Prefetch(1, 2, 3)
+
+		for _, pageId := range []int64{1, 2} {
+			pageGuard, err := bufferMgr.ReadPage(pageId)
+			assert.NoError(t, err)
+			assert.Equal(t, pages[pageId], pageGuard.GetData())
+			pageGuard.Drop()
+		}
+
+		bufferMgr.partitions[0].mu.Lock()
+		_, ok := bufferMgr.partitions[0].pageTable[3]
+		bufferMgr.partitions[0].mu.Unlock()
+		assert.False(t, ok)
+		pinned.Drop()
+
+		pageGuard, err := bufferMgr.ReadPage(3)
+		assert.NoError(t, err)
+		assert.Equal(t, pages[3], pageGuard.GetData())
+		pageGuard.Drop()
+	})
+
+	t.Run("reads cached pages without going to disk", func(t *testing.T) {
+		file := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(file.Name())
+		})
+
+		replacer := NewLrukReplacer(3, 2)
+		diskMgr := disk.NewManager(file)
+		diskScheduler := disk.NewScheduler(diskMgr)
+		bufferMgr := NewBufferpoolManager(3, replacer, diskScheduler)
+
+		data := make([]byte, disk.PAGE_SIZE)
+		copy(data, "page 1")
+		syncWrite(1, data, diskScheduler)
+
+		_, ok := bufferMgr.ReadCachedPage(1)
+		assert.False(t, ok)
+
+		pageGuard, err := bufferMgr.ReadPage(1)
+		assert.NoError(t, err)
+		pageGuard.Drop()
+
+		pageGuard, ok = bufferMgr.ReadCachedPage(1)
+		assert.True(t, ok)
+		assert.Equal(t, data, pageGuard.GetData())
+		pageGuard.Drop()
+	})
+
+	t.Run("fetches don't wait for another page's read", func(t *testing.T) {
+		file := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(file.Name())
+		})
+
+		codec := &slowCodec{gate: make(chan struct{})}
+		replacer := NewLrukReplacer(5, 2)
+		diskMgr := disk.NewManager(file, disk.WithCodec(codec))
+		diskScheduler := disk.NewScheduler(diskMgr)
+		bufferMgr := NewBufferpoolManager(5, replacer, diskScheduler)
+
+		for pageId, text := range []string{"header", "slow page", "fast page"} {
+			data := make([]byte, disk.PAGE_SIZE)
+			copy(data, text)
+			syncWrite(pageId, data, diskScheduler)
+		}
+
+		read := func(pageId int64) <-chan string {
+			res := make(chan string, 1)
+			go func() {
+				pageGuard, err := bufferMgr.ReadPage(pageId)
+				assert.NoError(t, err)
+				res <- string(bytes.Trim(pageGuard.GetData(), "\x00"))
+				pageGuard.Drop()
+			}()
+			return res
+		}
+
+		// page 1 is stuck loading and a second fetch of it waits on its frame
+		first := read(1)
+		assert.Eventually(t, func() bool {
+			bufferMgr.partitions[0].mu.Lock()
+			defer bufferMgr.partitions[0].mu.Unlock()
+			_, ok := bufferMgr.partitions[0].pageTable[1]
+			return ok
+		}, time.Second, time.Millisecond)
+		second := read(1)
+
+		select {
+		case text := <-read(2):
+			assert.Equal(t, "fast page", text)
+		case <-time.After(time.Second):
+			t.Fatal("fetching page 2 waited for page 1")
+		}
+
+		close(codec.gate)
+		assert.Equal(t, "slow page", <-first)
+		assert.Equal(t, "slow page", <-second)
+	})
+
+	t.Run("close flushes dirty frames", func(t *testing.T) {
+		file := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(file.Name())
+		})
+
+		replacer := NewLrukReplacer(2, 2)
+		diskMgr := disk.NewManager(file)
+		diskScheduler := disk.NewScheduler(diskMgr)
+		bufferMgr := NewBufferpoolManager(2, replacer, diskScheduler)
+
+		pageGuard, err := bufferMgr.WritePage(1)
+		assert.NoError(t, err)
+		copy(*pageGuard.GetDataMut(), []byte("hello, world!"))
+		pageGuard.Drop()
+
+		assert.NoError(t, bufferMgr.Close())
+		assert.NoError(t, bufferMgr.Close())
+
+		_, err = bufferMgr.ReadPage(1)
+		assert.ErrorIs(t, err, util.ErrClosed)
+		_, err = bufferMgr.WritePage(1)
+		assert.ErrorIs(t, err, util.ErrClosed)
+		assert.ErrorIs(t, bufferMgr.FlushAll(), util.ErrClosed)
+
+		data, err := os.ReadFile(file.Name())
+		assert.NoError(t, err)
+		assert.Equal(t, "hello, world!", string(bytes.Trim(data[disk.PAGE_SIZE:], "\x00")))
+	})
+
+	t.Run("frames take the disk manager's page size", func(t *testing.T) {
+		file := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(file.Name())
+		})
+
+		pageSize := 2 * disk.PAGE_SIZE
+		diskScheduler := disk.NewScheduler(disk.NewManager(file, disk.WithPageSize(pageSize)))
+		bufferMgr := NewBufferpoolManager(2, NewLrukReplacer(2, 2), diskScheduler)
+		assert.Equal(t, pageSize, bufferMgr.PageSize())
+
+		// pages 1 to 3 don't fit in the pool together
+		for pageId := range int64(3) {
+			pageGuard, err := bufferMgr.WritePage(pageId + 1)
+			assert.NoError(t, err)
+			assert.Len(t, *pageGuard.GetDataMut(), pageSize)
+			copy((*pageGuard.GetDataMut())[pageSize-20:], fmt.Sprintf("page %d", pageId+1))
+			pageGuard.Drop()
+		}
+
+		for pageId := range int64(3) {
+			pageGuard, err := bufferMgr.ReadPage(pageId + 1)
+			assert.NoError(t, err)
+			assert.Equal(t, fmt.Sprintf("page %d", pageId+1), string(bytes.Trim(pageGuard.GetData()[pageSize-20:], "\x00")))
+			pageGuard.Drop()
+		}
+	})
 }
 
 func CreateDbFile(t *testing.T) *os.File {
@@ -210,3 +534,20 @@ func syncRead(pageId int, diskScheduler *disk.DiskScheduler) []byte {
 
 	return res.Data
 }
+
+// slowCodec stores pages without their trailing zeros, pages starting with
+// "slow" are read once gate is closed
+type slowCodec struct {
+	gate chan struct{}
+}
+
+func (c *slowCodec) Compress(data []byte) ([]byte, error) {
+	return bytes.TrimRight(data, "\x00"), nil
+}
+
+func (c *slowCodec) Decompress(data []byte) ([]byte, error) {
+	if bytes.HasPrefix(data, []byte("slow")) {
+		<-c.gate
+	}
+	return data, nil
+}
@@ -3,8 +3,6 @@ package buffer
 import (
 	"sync"
 	"sync/atomic"
-
-	"github.com/jobala/petro/storage/disk"
 )
 
 func (f *frame) pin() {
@@ -16,9 +14,9 @@ func (f *frame) unpin() int32 {
 }
 
 func (f *frame) reset() {
-	f.dirty = false
+	f.dirty.Store(false)
 	f.pins.Store(0)
-	f.data = make([]byte, disk.PAGE_SIZE)
+	f.data = make([]byte, len(f.data))
 }
 
 type frame struct {
@@ -26,6 +24,18 @@ type frame struct {
 	id     int
 	data   []byte
 	pins   atomic.Int32
-	dirty  bool
+	dirty  atomic.Bool
 	pageId int64
+
+	// loading is closed once the frame's page is read, fetches of the page
+	// wait on it
+	loading chan struct{}
+
+	// writing is set while the frame's previous page is written back, until
+	// loading is closed
+	writing bool
+
+	// retiring is set while Resize removes the frame, it's kept out of the
+	// replacer's reach
+	retiring bool
 }
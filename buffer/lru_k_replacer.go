@@ -1,7 +1,9 @@
 package buffer
 
 import (
+	"cmp"
 	"fmt"
+	"slices"
 	"sync"
 )
 
@@ -78,8 +80,9 @@ func (lru *lrukReplacer) evict() (int, error) {
 		curr = curr.prev
 	}
 
+	// nothing to evict, callers have to wait for a frame to be unpinned
 	if curr == nil {
-		return INVALID_FRAME_ID, fmt.Errorf("no evictable nodes found")
+		return INVALID_FRAME_ID, nil
 	}
 
 	curr = curr.prev
@@ -105,6 +108,38 @@ func (lru *lrukReplacer) evict() (int, error) {
 	return frameId, nil
 }
 
+// victims returns up to n evictable frames in the order evict would pick them
+func (lru *lrukReplacer) victims(n int) []int {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	nodes := []*lrukNode{}
+	for curr := lru.tail.prev; curr != lru.head; curr = curr.prev {
+		if curr.isEvictable {
+			nodes = append(nodes, curr)
+		}
+	}
+
+	// nodes without k accesses go first, then the ones accessed least
+	// recently, ties keep their place in the list like they do in evict
+	slices.SortStableFunc(nodes, func(a, b *lrukNode) int {
+		if a.hasKAccess() != b.hasKAccess() {
+			if b.hasKAccess() {
+				return -1
+			}
+			return 1
+		}
+		return cmp.Compare(a.kthAccess(), b.kthAccess())
+	})
+
+	frameIds := []int{}
+	for _, node := range nodes[:min(n, len(nodes))] {
+		frameIds = append(frameIds, node.frameId)
+	}
+
+	return frameIds
+}
+
 func (lru *lrukReplacer) remove(frameId int) error {
 	lru.mu.Lock()
 	defer lru.mu.Unlock()
@@ -125,7 +160,7 @@ func (lru *lrukReplacer) remove(frameId int) error {
 	front.prev = back
 
 	delete(lru.nodeStore, frameId)
-	lru.currSize += 1
+	lru.currSize -= 1
 
 	return nil
 }
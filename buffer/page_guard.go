@@ -5,54 +5,42 @@ import (
 	"encoding/gob"
 )
 
-func NewReadPageGuard(frame *frame, bpm *BufferpoolManager) *ReadPageGuard {
+func NewReadPageGuard(frame *frame, partition *partition) *ReadPageGuard {
 	return &ReadPageGuard{
 		PageGuard: PageGuard{
-			frame: frame,
-			bpm:   bpm,
+			frame:     frame,
+			partition: partition,
 		},
 	}
 }
 
-func NewWritePageGuard(frame *frame, bpm *BufferpoolManager) *WritePageGuard {
+func NewWritePageGuard(frame *frame, partition *partition) *WritePageGuard {
 	return &WritePageGuard{
 		PageGuard: PageGuard{
-			frame: frame,
-			bpm:   bpm,
+			frame:     frame,
+			partition: partition,
 		},
 	}
 }
 
 func (pg *ReadPageGuard) Drop() {
-	if pg == nil || pg.frame == nil {
+	if pg == nil || pg.frame == nil || pg.dropped {
 		return
 	}
-
-	pg.frame.unpin()
-	if pg.frame.pins.Load() == 0 {
-		pg.bpm.replacer.setEvictable(pg.frame.id, true)
-	}
+	pg.dropped = true
 
 	pg.frame.mu.RUnlock()
-	pg.bpm.mu.Lock()
-	pg.bpm.cond.Signal()
-	pg.bpm.mu.Unlock()
+	pg.partition.unpin(pg.frame)
 }
 
 func (pg *WritePageGuard) Drop() {
-	if pg == nil || pg.frame == nil {
+	if pg == nil || pg.frame == nil || pg.dropped {
 		return
 	}
-
-	pg.frame.unpin()
-	if pg.frame.pins.Load() == 0 {
-		pg.bpm.replacer.setEvictable(pg.frame.id, true)
-	}
+	pg.dropped = true
 
 	pg.frame.mu.Unlock()
-	pg.bpm.mu.Lock()
-	pg.bpm.cond.Signal()
-	pg.bpm.mu.Unlock()
+	pg.partition.unpin(pg.frame)
 }
 
 func (pg *ReadPageGuard) GetData() []byte {
@@ -85,8 +73,11 @@ func ToStruct[T any](data []byte) (T, error) {
 }
 
 type PageGuard struct {
-	frame *frame
-	bpm   *BufferpoolManager
+	frame     *frame
+	partition *partition
+
+	// dropping a guard twice would unpin and unlatch its frame twice
+	dropped bool
 }
 
 type ReadPageGuard struct {
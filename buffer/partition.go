@@ -0,0 +1,356 @@
+package buffer
+
+import (
+	"slices"
+	"sync"
+
+	"github.com/jobala/petro/storage/disk"
+	"github.com/jobala/petro/util"
+)
+
+// newPartition creates a partition of size frames, frame ids are local to the
+// partition
+func newPartition(size int, replacer *lrukReplacer, diskScheduler *disk.DiskScheduler) *partition {
+	frames := make([]*frame, size)
+	freeFrames := make([]int, size)
+
+	for i := range size {
+		f := &frame{
+			id:   i,
+			data: make([]byte, diskScheduler.PageSize()),
+		}
+
+		frames[i] = f
+		freeFrames[i] = i
+	}
+
+	p := &partition{
+		frames:        frames,
+		pageTable:     make(map[int64]int),
+		replacer:      replacer,
+		diskScheduler: diskScheduler,
+		freeFrames:    freeFrames,
+	}
+	p.cond = *sync.NewCond(&p.mu)
+
+	return p
+}
+
+// fetch returns the pinned frame holding pageId, loading the page into a free
+// or evicted frame when it isn't in the partition. The page table entry is
+// reserved before the mutex is released for the write back and the read, so
+// fetches of a page being loaded wait on its frame rather than the partition.
+func (p *partition) fetch(pageId int64) (*frame, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for {
+		if p.closed {
+			return nil, util.ErrClosed
+		}
+
+		if id, ok := p.pageTable[pageId]; ok {
+			frame := p.frames[id]
+
+			if loading := frame.loading; loading != nil {
+				p.mu.Unlock()
+				<-loading
+				p.mu.Lock()
+				continue
+			}
+
+			p.replacer.recordAccess(frame.id)
+			p.replacer.setEvictable(frame.id, false)
+			frame.pin()
+
+			return frame, nil
+		}
+
+		frame := p.getFrame()
+		if frame == nil {
+			// failed to get a frame, wait for a frame to become available
+			// pageGuard.Drop will send a signal
+			p.cond.Wait()
+			continue
+		}
+
+		victim := p.reserve(frame, pageId)
+		p.mu.Unlock()
+
+		writeErr := p.writeVictim(victim)
+		var loadErr error
+		if writeErr == nil {
+			loadErr = p.load(frame)
+		}
+
+		p.mu.Lock()
+		p.finishLoad(frame, victim, writeErr, loadErr)
+		if writeErr != nil {
+			return nil, writeErr
+		}
+		if loadErr != nil {
+			return nil, loadErr
+		}
+
+		return frame, nil
+	}
+}
+
+// cached returns the pinned frame holding pageId if the page is in the
+// partition and loaded, or nil
+func (p *partition) cached(pageId int64) *frame {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	id, ok := p.pageTable[pageId]
+	if p.closed || !ok || p.frames[id].loading != nil {
+		return nil
+	}
+
+	frame := p.frames[id]
+	p.replacer.setEvictable(frame.id, false)
+	frame.pin()
+
+	return frame
+}
+
+// getFrame takes a free frame or picks a page to evict, it returns nil when
+// every frame is pinned
+func (p *partition) getFrame() *frame {
+	if len(p.freeFrames) > 0 {
+		id := p.freeFrames[0]
+		p.freeFrames = p.freeFrames[1:]
+		return p.frames[id]
+	}
+
+	if id, err := p.replacer.evict(); err == nil && id != INVALID_FRAME_ID {
+		return p.frames[id]
+	}
+
+	return nil
+}
+
+// reserve maps pageId to frame and marks the frame loading, callers must hold
+// mu. A dirty page being evicted stays mapped to the frame until it's written
+// back, its contents are returned for writeVictim.
+func (p *partition) reserve(frame *frame, pageId int64) victim {
+	evicted := victim{pageId: frame.pageId}
+	if frame.dirty.Load() {
+		evicted.data = frame.data
+		frame.writing = true
+	} else {
+		p.unmap(frame)
+	}
+
+	p.pageTable[pageId] = frame.id
+	p.replacer.recordAccess(frame.id)
+	p.replacer.setEvictable(frame.id, false)
+
+	frame.reset()
+	frame.pin()
+	frame.pageId = pageId
+	frame.loading = make(chan struct{})
+
+	return evicted
+}
+
+// writeVictim writes the evicted page to disk if it was dirty
+func (p *partition) writeVictim(evicted victim) error {
+	if evicted.data == nil {
+		return nil
+	}
+
+	writeReq := disk.NewRequest(evicted.pageId, evicted.data, true)
+	if resp := <-p.diskScheduler.Schedule(writeReq); resp.Err != nil {
+		return &util.IOError{Op: "write", PageId: evicted.pageId, Err: resp.Err}
+	}
+
+	return nil
+}
+
+// finishLoad updates the partition once frame was loaded and wakes the fetches
+// waiting on it, callers must hold mu. An evicted page that couldn't be
+// written back keeps the frame, a page that couldn't be read gives it up.
+func (p *partition) finishLoad(frame *frame, evicted victim, writeErr, loadErr error) {
+	switch {
+	case writeErr != nil:
+		delete(p.pageTable, frame.pageId)
+		frame.data = evicted.data
+		frame.dirty.Store(true)
+		frame.pageId = evicted.pageId
+		p.unpinLocked(frame)
+	case loadErr != nil:
+		p.unmapVictim(evicted, frame)
+		p.discard(frame)
+	default:
+		p.unmapVictim(evicted, frame)
+	}
+
+	close(frame.loading)
+	frame.loading = nil
+	frame.writing = false
+	p.cond.Broadcast()
+}
+
+// prefetch starts loading the pages of the partition that aren't in it, see
+// BufferpoolManager.Prefetch
+func (p *partition) prefetch(pageIds []int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return
+	}
+
+	frames := []*frame{}
+	reqs := []disk.DiskReq{}
+	for _, pageId := range pageIds {
+		if _, ok := p.pageTable[pageId]; ok {
+			continue
+		}
+
+		frame := p.getFrame()
+		if frame == nil {
+			break
+		}
+		if frame.dirty.Load() {
+			// a free frame is never dirty, the page stays in the pool
+			break
+		}
+
+		p.reserve(frame, pageId)
+		frames = append(frames, frame)
+		reqs = append(reqs, disk.NewRequest(pageId, nil, false))
+	}
+
+	if len(reqs) == 0 {
+		return
+	}
+
+	respChs := p.diskScheduler.ScheduleBatch(reqs)
+	go p.finishPrefetch(frames, respChs)
+}
+
+// finishPrefetch adds the prefetched pages to the partition as they're loaded
+func (p *partition) finishPrefetch(frames []*frame, respChs []<-chan disk.DiskResp) {
+	for i, respCh := range respChs {
+		resp := <-respCh
+		frame := frames[i]
+
+		var loadErr error
+		if resp.Err == nil {
+			copy(frame.data, resp.Data)
+		} else {
+			// fetching the page reads it again and reports the error
+			loadErr = resp.Err
+		}
+
+		p.mu.Lock()
+		if loadErr == nil {
+			p.unpinLocked(frame)
+		}
+		p.finishLoad(frame, victim{pageId: frame.pageId}, nil, loadErr)
+		p.mu.Unlock()
+	}
+}
+
+// load reads the page of frame from disk
+func (p *partition) load(frame *frame) error {
+	diskReq := disk.NewRequest(frame.pageId, nil, false)
+	resp := <-p.diskScheduler.Schedule(diskReq)
+	if resp.Err != nil {
+		return &util.IOError{Op: "read", PageId: frame.pageId, Err: resp.Err}
+	}
+
+	copy(frame.data, resp.Data)
+	return nil
+}
+
+// unpin releases a pin on frame, a frame without pins can be evicted
+func (p *partition) unpin(frame *frame) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.unpinLocked(frame)
+	p.cond.Broadcast()
+}
+
+func (p *partition) unpinLocked(frame *frame) {
+	if frame.unpin() == 0 && !frame.retiring {
+		p.replacer.setEvictable(frame.id, true)
+	}
+}
+
+// discard returns a frame whose page failed to load to the free frames,
+// unless Resize is removing it
+func (p *partition) discard(frame *frame) {
+	p.unmap(frame)
+	frame.reset()
+	if !frame.retiring {
+		p.freeFrames = append(p.freeFrames, frame.id)
+	}
+}
+
+// unmap removes the page held by frame from the page table. Free frames hold
+// no page, their zero page id must not unmap the header page.
+func (p *partition) unmap(frame *frame) {
+	p.unmapPage(frame.pageId, frame.id)
+}
+
+// unmapPage removes pageId from the page table if it's mapped to frameId
+func (p *partition) unmapPage(pageId int64, frameId int) {
+	if id, ok := p.pageTable[pageId]; ok && id == frameId {
+		delete(p.pageTable, pageId)
+	}
+}
+
+// unmapVictim removes a dirty page that was written back from the page table,
+// clean pages were unmapped when their frame was reserved
+func (p *partition) unmapVictim(evicted victim, frame *frame) {
+	if evicted.data != nil {
+		p.unmapPage(evicted.pageId, frame.id)
+	}
+}
+
+// pinDirty pins the frames holding a dirty page that aren't in pinned, so that
+// they keep their pages while they're flushed, callers must hold mu. It also
+// returns the loading channels of the frames whose dirty page is being written
+// back, they're closed once the write is done.
+func (p *partition) pinDirty(pinned []*frame) ([]*frame, []chan struct{}) {
+	frames, evictions := []*frame{}, []chan struct{}{}
+	for _, frame := range p.frames {
+		switch {
+		case frame.loading != nil:
+			if frame.writing {
+				evictions = append(evictions, frame.loading)
+			}
+		case frame.dirty.Load() && !slices.Contains(pinned, frame):
+			frame.pin()
+			p.replacer.setEvictable(frame.id, false)
+			frames = append(frames, frame)
+		}
+	}
+
+	return frames, evictions
+}
+
+// victim is the page evicted from a frame, data is set when it was dirty and
+// has to be written back
+type victim struct {
+	pageId int64
+	data   []byte
+}
+
+// partition is a share of the buffer pool's frames with its own page table,
+// free frames and replacer, so that fetches of pages in different partitions
+// don't contend for a lock
+type partition struct {
+	mu            sync.Mutex
+	frames        []*frame
+	pageTable     map[int64]int
+	diskScheduler *disk.DiskScheduler
+	replacer      *lrukReplacer
+	freeFrames    []int
+	cond          sync.Cond
+	closed        bool
+}
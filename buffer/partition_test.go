@@ -0,0 +1,145 @@
+package buffer
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jobala/petro/storage/disk"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPartitionedBufferPool(t *testing.T) {
+	t.Run("splits the frames between partitions", func(t *testing.T) {
+		file := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(file.Name())
+		})
+
+		diskScheduler := disk.NewScheduler(disk.NewManager(file))
+		bufferMgr := NewPartitionedBufferpoolManager(10, 4, 2, diskScheduler)
+
+		sizes := []int{}
+		for _, p := range bufferMgr.partitions {
+			sizes = append(sizes, len(p.frames))
+		}
+		assert.Equal(t, []int{3, 3, 2, 2}, sizes)
+		assert.Same(t, bufferMgr.partitions[1], bufferMgr.partitionOf(5))
+
+		// a partition never gets fewer than one frame
+		bufferMgr = NewPartitionedBufferpoolManager(2, 4, 2, diskScheduler)
+		assert.Len(t, bufferMgr.partitions, 2)
+	})
+
+	t.Run("reads back more pages than it holds", func(t *testing.T) {
+		file := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(file.Name())
+		})
+
+		diskScheduler := disk.NewScheduler(disk.NewManager(file))
+		bufferMgr := NewPartitionedBufferpoolManager(8, 4, 2, diskScheduler)
+
+		for pageId := range int64(40) {
+			pageGuard, err := bufferMgr.WritePage(pageId)
+			assert.NoError(t, err)
+			copy(*pageGuard.GetDataMut(), fmt.Sprintf("page %d", pageId))
+			pageGuard.Drop()
+		}
+		assert.NoError(t, bufferMgr.FlushAll())
+
+		for pageId := range int64(40) {
+			pageGuard, err := bufferMgr.ReadPage(pageId)
+			assert.NoError(t, err)
+			assert.Equal(t, fmt.Sprintf("page %d", pageId), string(bytes.Trim(pageGuard.GetData(), "\x00")))
+			pageGuard.Drop()
+		}
+		assert.NoError(t, bufferMgr.Close())
+	})
+
+	t.Run("a full partition doesn't hold up the others", func(t *testing.T) {
+		file := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(file.Name())
+		})
+
+		diskScheduler := disk.NewScheduler(disk.NewManager(file))
+		bufferMgr := NewPartitionedBufferpoolManager(4, 2, 2, diskScheduler)
+
+		// pages 0 and 2 pin both frames of the first partition
+		pinned := []*ReadPageGuard{}
+		for _, pageId := range []int64{0, 2} {
+			pageGuard, err := bufferMgr.ReadPage(pageId)
+			assert.NoError(t, err)
+			pinned = append(pinned, pageGuard)
+		}
+
+		fetched := make(chan struct{})
+		go func() {
+			pageGuard, err := bufferMgr.ReadPage(4)
+			assert.NoError(t, err)
+			pageGuard.Drop()
+			close(fetched)
+		}()
+
+		for _, pageId := range []int64{1, 3, 5, 7} {
+			pageGuard, err := bufferMgr.ReadPage(pageId)
+			assert.NoError(t, err)
+			pageGuard.Drop()
+		}
+
+		select {
+		case <-fetched:
+			t.Fatal("page 4 was fetched without a free frame in its partition")
+		case <-time.After(20 * time.Millisecond):
+		}
+
+		pinned[0].Drop()
+		<-fetched
+		pinned[1].Drop()
+	})
+}
+
+func BenchmarkBufferPool(b *testing.B) {
+	const frames = 64
+
+	for _, partitions := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("partitions=%d", partitions), func(b *testing.B) {
+			file, err := os.CreateTemp(b.TempDir(), "bench.db")
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			diskScheduler := disk.NewScheduler(disk.NewManager(file))
+			bufferMgr := NewPartitionedBufferpoolManager(frames, partitions, 2, diskScheduler)
+			b.Cleanup(func() {
+				_ = bufferMgr.Close()
+			})
+
+			// the pages fit in the pool, fetches only contend for locks
+			for pageId := range int64(frames) {
+				pageGuard, err := bufferMgr.WritePage(pageId)
+				if err != nil {
+					b.Fatal(err)
+				}
+				pageGuard.Drop()
+			}
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				rnd := rand.New(rand.NewSource(rand.Int63()))
+				for pb.Next() {
+					pageGuard, err := bufferMgr.ReadPage(rnd.Int63n(frames))
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					pageGuard.Drop()
+				}
+			})
+		})
+	}
+}
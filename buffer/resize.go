@@ -0,0 +1,172 @@
+package buffer
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/jobala/petro/util"
+)
+
+// Resize grows or shrinks the pool to size frames while it's in use. Frames
+// added are free, shrinking evicts the pages of the frames removed, writing
+// back the dirty ones, and waits for the ones in use to be released. Fetches
+// of those pages wait for them to be written. Each partition keeps its share
+// of the frames.
+func (b *BufferpoolManager) Resize(size int) error {
+	if size < len(b.partitions) {
+		return fmt.Errorf("the pool needs a frame for each of its %d partitions, got %d", len(b.partitions), size)
+	}
+
+	b.resizeMu.Lock()
+	defer b.resizeMu.Unlock()
+
+	errs := []error{}
+	for i, p := range b.partitions {
+		errs = append(errs, p.resize(partitionShare(size, len(b.partitions), i)))
+	}
+
+	return errors.Join(errs...)
+}
+
+// partitionShare is the number of frames partition i of a pool of size frames
+// gets, the first partitions take the frames left over
+func partitionShare(size, partitions, i int) int {
+	share := size / partitions
+	if i < size%partitions {
+		share++
+	}
+
+	return share
+}
+
+func (p *partition) resize(size int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return util.ErrClosed
+	}
+
+	for id := len(p.frames); id < size; id++ {
+		p.frames = append(p.frames, &frame{
+			id:   id,
+			data: make([]byte, p.diskScheduler.PageSize()),
+		})
+		p.freeFrames = append(p.freeFrames, id)
+	}
+	if size >= len(p.frames) {
+		p.cond.Broadcast()
+		return nil
+	}
+
+	// the frames removed are kept off the free frames and out of the
+	// replacer's reach while their pages are evicted
+	retiring := p.frames[size:]
+	for _, frame := range retiring {
+		frame.retiring = true
+		p.replacer.setEvictable(frame.id, false)
+	}
+	p.freeFrames = slices.DeleteFunc(p.freeFrames, func(id int) bool {
+		return id >= size
+	})
+
+	for {
+		dirty := []*frame{}
+		inUse := false
+
+		for _, frame := range retiring {
+			if frame.loading != nil || frame.pins.Load() > 0 {
+				inUse = true
+				continue
+			}
+			if !p.mapped(frame) {
+				continue
+			}
+
+			if frame.dirty.Load() {
+				dirty = append(dirty, frame)
+			} else {
+				p.unmap(frame)
+			}
+		}
+
+		if len(dirty) > 0 {
+			if err := p.evictDirty(dirty); err != nil {
+				p.cancelResize(retiring)
+				return err
+			}
+			continue
+		}
+
+		if !inUse {
+			break
+		}
+
+		// pageGuard.Drop will send a signal
+		p.cond.Wait()
+		if p.closed {
+			p.cancelResize(retiring)
+			return util.ErrClosed
+		}
+	}
+
+	for _, frame := range retiring {
+		p.replacer.setEvictable(frame.id, true)
+		_ = p.replacer.remove(frame.id)
+	}
+	p.frames = p.frames[:size]
+
+	return nil
+}
+
+// evictDirty writes back the pages of frames and unmaps them, callers must
+// hold mu. Fetches of the pages wait on their frames while they're written.
+func (p *partition) evictDirty(frames []*frame) error {
+	written := make(chan struct{})
+	for _, frame := range frames {
+		frame.loading = written
+		frame.writing = true
+	}
+
+	writes := scheduleWrites(p.diskScheduler, pages(frames))
+	p.mu.Unlock()
+	errs := waitWrites(writes)
+	p.mu.Lock()
+
+	for i, frame := range frames {
+		if errs[i] == nil {
+			p.unmap(frame)
+			frame.reset()
+		}
+		frame.loading = nil
+		frame.writing = false
+	}
+	close(written)
+	p.cond.Broadcast()
+
+	return errors.Join(errs...)
+}
+
+// cancelResize returns the frames that were being removed to the partition,
+// callers must hold mu
+func (p *partition) cancelResize(retiring []*frame) {
+	for _, frame := range retiring {
+		frame.retiring = false
+
+		if !p.mapped(frame) && frame.loading == nil {
+			frame.reset()
+			p.freeFrames = append(p.freeFrames, frame.id)
+		} else if frame.pins.Load() == 0 {
+			p.replacer.setEvictable(frame.id, true)
+		}
+	}
+
+	p.cond.Broadcast()
+}
+
+// mapped reports whether frame holds a page in the page table
+func (p *partition) mapped(frame *frame) bool {
+	id, ok := p.pageTable[frame.pageId]
+	return ok && id == frame.id
+}
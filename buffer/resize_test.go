@@ -0,0 +1,179 @@
+package buffer
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jobala/petro/storage/disk"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResize(t *testing.T) {
+	setup := func(t *testing.T, size int) (*os.File, *BufferpoolManager) {
+		file := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(file.Name())
+		})
+
+		replacer := NewLrukReplacer(size, 2)
+		diskScheduler := disk.NewScheduler(disk.NewManager(file))
+		return file, NewBufferpoolManager(size, replacer, diskScheduler)
+	}
+
+	write := func(t *testing.T, bufferMgr *BufferpoolManager, pageId int64, text string) {
+		pageGuard, err := bufferMgr.WritePage(pageId)
+		assert.NoError(t, err)
+		copy(*pageGuard.GetDataMut(), text)
+		pageGuard.Drop()
+	}
+
+	onDisk := func(t *testing.T, file *os.File, pageId int) string {
+		data, err := os.ReadFile(file.Name())
+		assert.NoError(t, err)
+		return string(bytes.Trim(data[pageId*disk.PAGE_SIZE:(pageId+1)*disk.PAGE_SIZE], "\x00"))
+	}
+
+	t.Run("growing frees fetches waiting for a frame", func(t *testing.T) {
+		_, bufferMgr := setup(t, 2)
+
+		pinned := []*ReadPageGuard{}
+		for _, pageId := range []int64{1, 2} {
+			pageGuard, err := bufferMgr.ReadPage(pageId)
+			assert.NoError(t, err)
+			pinned = append(pinned, pageGuard)
+		}
+
+		fetched := make(chan struct{})
+		go func() {
+			pageGuard, err := bufferMgr.ReadPage(3)
+			assert.NoError(t, err)
+			pageGuard.Drop()
+			close(fetched)
+		}()
+
+		assert.NoError(t, bufferMgr.Resize(4))
+		assert.Equal(t, 4, bufferMgr.Size())
+
+		select {
+		case <-fetched:
+		case <-time.After(time.Second):
+			t.Fatal("the fetch didn't get one of the new frames")
+		}
+
+		for _, pageGuard := range pinned {
+			pageGuard.Drop()
+		}
+	})
+
+	t.Run("shrinking writes back the pages evicted", func(t *testing.T) {
+		file, bufferMgr := setup(t, 6)
+
+		for pageId := range int64(6) {
+			write(t, bufferMgr, pageId, fmt.Sprintf("page %d", pageId))
+		}
+
+		assert.NoError(t, bufferMgr.Resize(2))
+		assert.Equal(t, 2, bufferMgr.Size())
+
+		// frames 2 to 5 held pages 2 to 5
+		for pageId := 2; pageId < 6; pageId++ {
+			assert.Equal(t, fmt.Sprintf("page %d", pageId), onDisk(t, file, pageId))
+		}
+
+		for pageId := range int64(6) {
+			pageGuard, err := bufferMgr.ReadPage(pageId)
+			assert.NoError(t, err)
+			assert.Equal(t, fmt.Sprintf("page %d", pageId), string(bytes.Trim(pageGuard.GetData(), "\x00")))
+			pageGuard.Drop()
+		}
+	})
+
+	t.Run("shrinking waits for pages in use", func(t *testing.T) {
+		file, bufferMgr := setup(t, 4)
+
+		for pageId := range int64(4) {
+			write(t, bufferMgr, pageId, fmt.Sprintf("page %d", pageId))
+		}
+
+		pageGuard, err := bufferMgr.WritePage(3)
+		assert.NoError(t, err)
+
+		resized := make(chan error)
+		go func() {
+			resized <- bufferMgr.Resize(2)
+		}()
+
+		select {
+		case <-resized:
+			t.Fatal("resize removed a frame in use")
+		case <-time.After(20 * time.Millisecond):
+		}
+
+		// pages in the frames that stay can still be used
+		readGuard, err := bufferMgr.ReadPage(0)
+		assert.NoError(t, err)
+		readGuard.Drop()
+
+		copy(*pageGuard.GetDataMut(), "page 3 changed")
+		pageGuard.Drop()
+
+		assert.NoError(t, <-resized)
+		assert.Equal(t, "page 3 changed", onDisk(t, file, 3))
+	})
+
+	t.Run("resizes under concurrent use", func(t *testing.T) {
+		file := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(file.Name())
+		})
+
+		diskScheduler := disk.NewScheduler(disk.NewManager(file))
+		bufferMgr := NewPartitionedBufferpoolManager(16, 2, 2, diskScheduler)
+
+		var wg sync.WaitGroup
+		for worker := range 4 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				// each worker owns the pages congruent to it
+				rnd := rand.New(rand.NewSource(int64(worker)))
+				for range 200 {
+					pageId := int64(rnd.Intn(8)*4 + worker)
+					write(t, bufferMgr, pageId, fmt.Sprintf("page %d", pageId))
+
+					pageGuard, err := bufferMgr.ReadPage(pageId)
+					assert.NoError(t, err)
+					assert.Equal(t, fmt.Sprintf("page %d", pageId), string(bytes.Trim(pageGuard.GetData(), "\x00")))
+					pageGuard.Drop()
+				}
+			}()
+		}
+
+		for _, size := range []int{4, 32, 6, 24, 8, 16} {
+			assert.NoError(t, bufferMgr.Resize(size))
+		}
+		wg.Wait()
+
+		assert.Equal(t, 16, bufferMgr.Size())
+		assert.NoError(t, bufferMgr.Close())
+	})
+
+	t.Run("every partition keeps a frame", func(t *testing.T) {
+		file := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(file.Name())
+		})
+
+		diskScheduler := disk.NewScheduler(disk.NewManager(file))
+		bufferMgr := NewPartitionedBufferpoolManager(8, 4, 2, diskScheduler)
+
+		assert.Error(t, bufferMgr.Resize(3))
+		assert.Equal(t, 8, bufferMgr.Size())
+	})
+}
@@ -2,26 +2,134 @@ package index
 
 import (
 	"cmp"
+	"fmt"
 	"os"
 
 	"github.com/jobala/petro/buffer"
 	"github.com/jobala/petro/storage/disk"
 )
 
-func New[K cmp.Ordered, V any](name string, file *os.File) (*bplusTree[K, V], error) {
-	replacer := buffer.NewLrukReplacer(buffer.BUFFER_CAPACITY, 2)
-	diskMgr := disk.NewManager(file)
-	diskScheduler := disk.NewScheduler(diskMgr)
-	bpm := buffer.NewBufferpoolManager(buffer.BUFFER_CAPACITY, replacer, diskScheduler)
+// Store is the surface shared by the b+tree and the hash index
+type Store[K cmp.Ordered, V any] interface {
+	Get(key K) ([]V, error)
+	Put(key K, value V) (bool, error)
+	Delete(key K) (bool, error)
+	Flush() error
+	Close() error
+}
+
+// OrderedStore is a Store whose keys can be scanned in order, either all at
+// once or a page at a time
+type OrderedStore[K cmp.Ordered, V any] interface {
+	Store[K, V]
+	GetKeyRange(start, stop K) ([]V, error)
+	PutBatch(items map[K]V) error
+	Page(start K, limit int) (*ScanPage[K, V], error)
+	PageAfter(cursor Cursor, limit int) (*ScanPage[K, V], error)
+}
+
+var (
+	_ OrderedStore[int, int] = (*bplusTree[int, int])(nil)
+	_ Store[int, int]        = (*extendibleHash[int, int])(nil)
+)
+
+// New opens the tree called name in file, closing the tree closes file. The
+// buffer pool and disk manager are configured by opts, at most one can be
+// passed.
+func New[K cmp.Ordered, V any](name string, file *os.File, opts ...Options) (*bplusTree[K, V], error) {
+	bpm, err := newBpm(file, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	tree, err := NewBplusTree[K, V](name, bpm)
+	if err != nil {
+		return nil, err
+	}
+	tree.ownsBpm = true
+
+	return tree, nil
+}
+
+// NewHash opens an unordered hash index for point lookups, closing the index
+// closes file. opts are the same as New's.
+func NewHash[K cmp.Ordered, V any](name string, file *os.File, opts ...Options) (*extendibleHash[K, V], error) {
+	bpm, err := newBpm(file, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := NewExtendibleHash[K, V](name, bpm)
+	if err != nil {
+		return nil, err
+	}
+	hash.ownsBpm = true
+
+	return hash, nil
+}
+
+func newBpm(file *os.File, opts []Options) (*buffer.BufferpoolManager, error) {
+	o, err := resolveOptions(opts)
+	if err != nil {
+		return nil, err
+	}
 
-	return NewBplusTree[K, V](name, bpm)
+	return buffer.NewPartitionedBufferpoolManager(o.PoolFrames, o.Partitions, o.K, newDiskScheduler(file, o)), nil
+}
+
+// resolveOptions returns the options passed to New with their defaults
+func resolveOptions(opts []Options) (Options, error) {
+	if len(opts) > 1 {
+		return Options{}, fmt.Errorf("at most one Options can be passed, got %d", len(opts))
+	}
+
+	var o Options
+	if len(opts) == 1 {
+		o = opts[0]
+	}
+
+	return o.withDefaults()
+}
+
+func newDiskScheduler(file *os.File, o Options) *disk.DiskScheduler {
+	diskOpts := []disk.Option{disk.WithPageSize(o.PageSize), disk.WithSyncMode(o.SyncMode), disk.WithSyncInterval(o.SyncInterval)}
+	if o.Codec != nil {
+		diskOpts = append(diskOpts, disk.WithCodec(o.Codec))
+	}
+	if o.Keys != nil {
+		diskOpts = append(diskOpts, disk.WithEncryption(o.Keys))
+	}
+
+	diskMgr := disk.NewManager(file, diskOpts...)
+	return disk.NewScheduler(diskMgr)
 }
 
 func (b *bplusTree[K, V]) GetIterator() *indexIterator[K, V] {
-	return NewIndexIterator[K, V](b.firstPageId, b.bpm)
+	if err := b.checkOpen(); err != nil {
+		return &indexIterator[K, V]{bpm: b.bpm, err: err}
+	}
+
+	if b.isEmpty() {
+		return &indexIterator[K, V]{bpm: b.bpm}
+	}
+
+	return b.newIterator(b.header.FirstPageId)
+}
+
+// newIterator returns an iterator over the tree's live entries starting at
+// the leaf pageId
+func (b *bplusTree[K, V]) newIterator(pageId int64) *indexIterator[K, V] {
+	indexIter := NewIndexIterator[K, V](pageId, b.bpm)
+	indexIter.vlog = b.vlog
+	indexIter.window = b.readAhead
+
+	return b.hideExpired(indexIter)
 }
 
 func (b *bplusTree[K, V]) GetKeyRange(start, stop K) ([]V, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
 	indexIter := b.GetIterator()
 
 	res := []V{}
@@ -34,7 +142,7 @@ func (b *bplusTree[K, V]) GetKeyRange(start, stop K) ([]V, error) {
 			res = append(res, val)
 		}
 
-		if key == stop {
+		if key >= stop {
 			break
 		}
 	}
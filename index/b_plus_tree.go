@@ -2,42 +2,80 @@ package index
 
 import (
 	"cmp"
+	"errors"
 	"fmt"
-	"math"
 	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/jobala/petro/buffer"
 	"github.com/jobala/petro/storage/disk"
+	"github.com/jobala/petro/util"
 )
 
 func NewBplusTree[K cmp.Ordered, V any](name string, bpm *buffer.BufferpoolManager) (*bplusTree[K, V], error) {
-	guard, err := bpm.WritePage(HEADER_PAGE_ID)
-	defer guard.Drop()
-	if err != nil {
-		return nil, fmt.Errorf("error reading header page: %v", err)
+	if err := checkName(name); err != nil {
+		return nil, err
 	}
 
-	headerData := guard.GetDataMut()
-	headerPage, err := buffer.ToStruct[headerPage](*headerData)
+	return openBplusTree[K, V](name, bpm)
+}
+
+// openBplusTree opens the tree called name, unlike NewBplusTree it accepts the
+// reserved names of the trees an index keeps for itself.
+func openBplusTree[K cmp.Ordered, V any](name string, bpm *buffer.BufferpoolManager) (*bplusTree[K, V], error) {
+	catalog, err := readCatalog(bpm)
 	if err != nil {
-		return nil, fmt.Errorf("error getting header page: %v", err)
+		return nil, err
+	}
+
+	header, _ := catalog.header(name)
+	tree := &bplusTree[K, V]{
+		indexName: name,
+		bpm:       bpm,
+		header:    header,
+		limits:    DefaultSizeLimits(),
+		readAhead: DEFAULT_READ_AHEAD,
+		now:       time.Now,
 	}
 
-	*headerData, _ = buffer.ToByteSlice(headerPage)
+	if header.Bloom.ExpectedKeys > 0 {
+		if err := tree.openBloomFilter(); err != nil {
+			return nil, err
+		}
+	}
+
+	if header.ValueLog.Dir != "" {
+		if err := tree.openValueLog(); err != nil {
+			return nil, err
+		}
+	}
 
-	return &bplusTree[K, V]{
-		indexName:   name,
-		bpm:         bpm,
-		header:      headerPage,
-		firstPageId: 1,
-	}, nil
+	return tree, nil
 }
 
 func (b *bplusTree[K, V]) Get(key K) ([]V, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if err := b.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	return b.get(key)
+}
+
+func (b *bplusTree[K, V]) get(key K) ([]V, error) {
 	if b.isEmpty() {
 		return nil, fmt.Errorf("store is empty")
 	}
 
+	if b.bloom != nil && !b.bloom.mayContain(key) {
+		return nil, fmt.Errorf("%w: %v", util.ErrKeyNotFound, key)
+	}
+
 	res := make([]V, 0)
 	leafPageId, err := b.findLeafPageId(b.header.RootPageId, key)
 	if err != nil {
@@ -50,163 +88,287 @@ func (b *bplusTree[K, V]) Get(key K) ([]V, error) {
 	}
 	defer guard.Drop()
 
-	leafPage, err := buffer.ToStruct[bplusLeafPage[K, V]](guard.GetData())
+	leafPage, err := decodeLeaf[K, V](guard.GetData())
 
 	if err != nil {
 		return nil, err
 	}
 
 	valIdx := leafPage.getInsertIdx(key)
-	if leafPage.Keys[valIdx] != key {
-		return nil, fmt.Errorf("key not found: %v", key)
+	if valIdx >= leafPage.getSize() || leafPage.keyAt(valIdx) != key {
+		if b.bloom != nil {
+			b.bloom.falsePositives.Add(1)
+		}
+		return nil, fmt.Errorf("%w: %v", util.ErrKeyNotFound, key)
+	}
+
+	if leafPage.metaAt(valIdx).expired(b.now().UnixNano()) {
+		b.noteExpired(key)
+		return nil, fmt.Errorf("%w: %v", util.ErrKeyNotFound, key)
 	}
 
-	if leafPage.getSize() > 0 && valIdx < 0 || valIdx >= leafPage.getSize() {
-		return nil, fmt.Errorf("key not found: %v", key)
+	val, err := readValue(b.bpm, b.vlog, &leafPage, valIdx)
+	if err != nil {
+		return nil, err
 	}
 
-	res = append(res, leafPage.valueAt(valIdx))
+	res = append(res, val)
 	return res, nil
 }
 
+// Put inserts key or replaces its value if it already exists
 func (b *bplusTree[K, V]) Put(key K, value V) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.checkOpen(); err != nil {
+		return false, err
+	}
+
+	if err := b.reclaimExpired(); err != nil {
+		return false, err
+	}
+
+	if _, err := b.store(key, setTo(value, slotMeta{})); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// store puts key and keeps the secondary and expiry indexes in sync, it
+// returns the value that was stored
+func (b *bplusTree[K, V]) store(key K, update updateFunc[V]) (V, error) {
+	if err := b.markBloomInUse(); err != nil {
+		var zero V
+		return zero, err
+	}
+
+	res, err := b.put(key, update)
+	if err != nil {
+		return res.value, err
+	}
+
+	if res.replaced && res.oldMeta.Overflow != disk.INVALID_PAGE_ID {
+		if err := freeOverflow(b.bpm, res.oldMeta.Overflow); err != nil {
+			return res.value, err
+		}
+	}
+
+	for _, idx := range b.indexes {
+		if err := idx.put(key, res.old, res.replaced, res.value); err != nil {
+			return res.value, err
+		}
+	}
+
+	if err := b.trackExpiry(key, res.oldMeta, res.meta); err != nil {
+		return res.value, err
+	}
+
+	if err := b.bloomAdd(key); err != nil {
+		return res.value, err
+	}
+
+	ev := Event[K, V]{Type: EventPut, Key: key, New: res.value}
+	if res.found {
+		ev.Old, ev.HadOld = res.old, true
+	}
+	b.notify(ev)
+	return res.value, nil
+}
+
+// put stores the entry computed by update under key in a single descent and
+// returns the entry it replaced, if any
+func (b *bplusTree[K, V]) put(key K, update updateFunc[V]) (res putResult[V], err error) {
 	if b.isEmpty() {
+		res.value, res.meta = update(res.old, res.oldMeta, false)
+		stored, meta, err := b.placeValue(key, res.value, res.meta)
+		if err != nil {
+			return res, err
+		}
+		res.meta = meta
+
 		pageId := b.bpm.NewPageId()
 		guard, err := b.bpm.WritePage(pageId)
 		if err != nil {
 			guard.Drop()
-			return false, err
+			return res, err
 		}
 
-		leafPage, err := buffer.ToStruct[bplusLeafPage[K, V]](*guard.GetDataMut())
+		leafPage, err := decodeLeaf[K, V](*guard.GetDataMut())
 		if err != nil {
 			guard.Drop()
-			return false, err
+			return res, err
 		}
 
-		leafPage.init(pageId, int64(INVALID_PAGE))
+		leafPage.init(pageId, int64(INVALID_PAGE), b.bpm.PageSize())
 		leafPage.Size = 1
 		leafPage.setKeyAt(0, key)
-		leafPage.setValAt(0, value)
+		leafPage.setValAt(0, stored)
+		leafPage.setMetaAt(0, res.meta)
 
-		data, err := buffer.ToByteSlice(leafPage)
+		data, err := leafPage.encode()
 		if err != nil {
 			guard.Drop()
-			return false, err
+			return res, err
 		}
 		copy(*guard.GetDataMut(), data)
 
+		// used by iterator
+		b.header.FirstPageId = leafPage.PageId
+
 		if err := b.setRootPageId(pageId); err != nil {
 			guard.Drop()
-			return false, err
+			return res, err
 		}
 
-		// used by iterator
-		b.firstPageId = leafPage.PageId
-
 		guard.Drop()
 	} else {
 		leafPageId, err := b.findLeafPageId(b.header.RootPageId, key)
 		if err != nil {
-			return false, err
+			return res, err
 		}
 
 		guard, err := b.bpm.WritePage(leafPageId)
 		if err != nil {
 			guard.Drop()
-			return false, err
+			return res, err
 		}
 
-		leafPage, err := buffer.ToStruct[bplusLeafPage[K, V]](*guard.GetDataMut())
+		leafPage, err := decodeLeaf[K, V](*guard.GetDataMut())
 		if err != nil {
 			guard.Drop()
-			return false, err
+			return res, err
 		}
 
-		if leafPage.Size < leafPage.MaxSize {
-			leafPage.addKeyVal(key, value)
-			leafPage.Size += 1
-
-			data, err := buffer.ToByteSlice(leafPage)
+		// keys are unique, putting an existing key replaces its value
+		if idx := leafPage.getInsertIdx(key); idx < leafPage.getSize() && leafPage.keyAt(idx) == key {
+			res.old, err = readValue(b.bpm, b.vlog, &leafPage, idx)
 			if err != nil {
 				guard.Drop()
-				return false, err
+				return res, err
 			}
-			copy(*guard.GetDataMut(), data)
-			guard.Drop()
-		} else {
-			// create new leaf node
-			newLeafId := b.bpm.NewPageId()
-			newGuard, err := b.bpm.WritePage(newLeafId)
+			res.oldMeta = leafPage.metaAt(idx)
+			res.replaced = true
+
+			// an expired entry is replaced as if the key was missing
+			res.found = !res.oldMeta.expired(b.now().UnixNano())
+			res.value, res.meta = update(res.old, res.oldMeta, res.found)
+			stored, meta, err := b.placeValue(key, res.value, res.meta)
 			if err != nil {
 				guard.Drop()
-				newGuard.Drop()
-				return false, err
+				return res, err
 			}
-			newLeafPage, err := buffer.ToStruct[bplusLeafPage[K, V]](*newGuard.GetDataMut())
+			res.meta = meta
+			leafPage.setValAt(idx, stored)
+			leafPage.setMetaAt(idx, res.meta)
+		} else {
+			res.value, res.meta = update(res.old, res.oldMeta, false)
+			stored, meta, err := b.placeValue(key, res.value, res.meta)
 			if err != nil {
 				guard.Drop()
-				newGuard.Drop()
-				return false, err
+				return res, err
 			}
-			newLeafPage.init(newLeafId, leafPage.Parent)
-
-			insertIdx := leafPage.getInsertIdx(key)
-			leafPage.Keys = slices.Insert(leafPage.Keys, insertIdx, key)
-			leafPage.Values = slices.Insert(leafPage.Values, insertIdx, value)
-
-			tmpKeyArr := make([]K, leafPage.MaxSize+1)
-			tmpValArr := make([]V, leafPage.MaxSize+1)
-			copy(tmpKeyArr, leafPage.Keys)
-			copy(tmpValArr, leafPage.Values)
-
-			// zero out keys and values in leaf page
-			leafPage.Keys = make([]K, leafPage.MaxSize)
-			leafPage.Values = make([]V, leafPage.MaxSize)
-
-			tmpNexPage := leafPage.Next
-			leafPage.Next = newLeafId
-			newLeafPage.Next = tmpNexPage
-
-			// newLeafPage.Prev = leafPage.PageId
-
-			midPoint := int(math.Ceil(float64(leafPage.MaxSize) / 2))
-
-			// distribute values between leaf and new leaf
-			copy(leafPage.Keys, tmpKeyArr[:midPoint])
-			copy(leafPage.Values, tmpValArr[:midPoint])
-			copy(newLeafPage.Keys, tmpKeyArr[midPoint:])
-			copy(newLeafPage.Values, tmpValArr[midPoint:])
+			res.meta = meta
+			leafPage.addEntry(key, stored, res.meta)
+			leafPage.Size += 1
+		}
 
-			leafPage.Size = int32(midPoint)
-			newLeafPage.Size = int32(int(leafPage.MaxSize)-midPoint) + 1
+		// a leaf splits once it has more than MaxSize entries or no longer
+		// fits in a page, which a larger replacement value can also cause
+		data, err := leafPage.encode()
+		if err == nil && leafPage.Size <= leafPage.MaxSize {
+			copy(*guard.GetDataMut(), data)
+			guard.Drop()
+			return res, nil
+		}
+		if err != nil && !errors.Is(err, util.ErrPageOverflow) {
+			guard.Drop()
+			return res, err
+		}
 
-			leafData, err := buffer.ToByteSlice(leafPage)
-			if err != nil {
-				guard.Drop()
-				newGuard.Drop()
-				return false, err
-			}
-			copy(*guard.GetDataMut(), leafData)
+		if err := b.splitLeaf(guard, &leafPage); err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
 
-			newLeafData, err := buffer.ToByteSlice(newLeafPage)
-			if err != nil {
-				guard.Drop()
-				newGuard.Drop()
-				return false, err
-			}
-			copy(*newGuard.GetDataMut(), newLeafData)
+// splitLeaf moves the upper half of leafPage's entries to a new leaf and
+// links it into the parent. The halves hold the same number of entries unless
+// one of them would overflow its page, then they are balanced by size.
+func (b *bplusTree[K, V]) splitLeaf(guard *buffer.WritePageGuard, leafPage *bplusLeafPage[K, V]) error {
+	newLeafId := b.bpm.NewPageId()
+	newGuard, err := b.bpm.WritePage(newLeafId)
+	if err != nil {
+		guard.Drop()
+		newGuard.Drop()
+		return err
+	}
+	newLeafPage, err := decodeLeaf[K, V](*newGuard.GetDataMut())
+	if err != nil {
+		guard.Drop()
+		newGuard.Drop()
+		return err
+	}
+	newLeafPage.init(newLeafId, leafPage.Parent, b.bpm.PageSize())
+
+	size := leafPage.getSize()
+	tmpKeyArr := slices.Clone(leafPage.Keys[:size])
+	tmpValArr := slices.Clone(leafPage.Values[:size])
+	tmpMetaArr := slices.Clone(leafPage.Meta[:size])
+
+	newLeafPage.Next = leafPage.Next
+	leafPage.Next = newLeafId
+
+	// distribute values between leaf and new leaf
+	distribute := func(midPoint int) (leafData, newLeafData []byte, err error) {
+		leafPage.Keys = make([]K, leafPage.MaxSize)
+		leafPage.Values = make([]V, leafPage.MaxSize)
+		leafPage.Meta = make([]slotMeta, leafPage.MaxSize)
+		copy(leafPage.Keys, tmpKeyArr[:midPoint])
+		copy(leafPage.Values, tmpValArr[:midPoint])
+		copy(leafPage.Meta, tmpMetaArr[:midPoint])
+		copy(newLeafPage.Keys, tmpKeyArr[midPoint:])
+		copy(newLeafPage.Values, tmpValArr[midPoint:])
+		copy(newLeafPage.Meta, tmpMetaArr[midPoint:])
+
+		leafPage.Size = int32(midPoint)
+		newLeafPage.Size = int32(size - midPoint)
+
+		if leafData, err = leafPage.encode(); err != nil {
+			return nil, nil, err
+		}
+		newLeafData, err = newLeafPage.encode()
+		return leafData, newLeafData, err
+	}
 
-			if err := b.insertInParent(guard, newGuard, newLeafPage.keyAt(0)); err != nil {
-				return false, err
-			}
+	leafData, newLeafData, err := distribute(size / 2)
+	if errors.Is(err, util.ErrPageOverflow) {
+		var midPoint int
+		midPoint, err = balancedSplit(size, func(i int) (int, error) {
+			return entrySize(tmpKeyArr[i], tmpValArr[i])
+		})
+		if err == nil {
+			leafData, newLeafData, err = distribute(midPoint)
 		}
 	}
-	return true, nil
+	if err != nil {
+		guard.Drop()
+		newGuard.Drop()
+		return err
+	}
+
+	copy(*guard.GetDataMut(), leafData)
+	copy(*newGuard.GetDataMut(), newLeafData)
+
+	separator := shortestSeparator(leafPage.keyAt(leafPage.getSize()-1), newLeafPage.keyAt(0))
+	return b.insertInParent(guard, newGuard, separator)
 }
+
 func (b *bplusTree[K, V]) insertInParent(leafGuard *buffer.WritePageGuard, newLeafGuard *buffer.WritePageGuard, key K) error {
-	leafPage, _ := buffer.ToStruct[bplusInternalPage[K]](*leafGuard.GetDataMut())
-	newLeafPage, _ := buffer.ToStruct[bplusInternalPage[K]](*newLeafGuard.GetDataMut())
+	leafPage, _ := readPageMeta(*leafGuard.GetDataMut())
+	newLeafPage, _ := readPageMeta(*newLeafGuard.GetDataMut())
 	leafParent := leafPage.Parent
 
 	leafIsRoot := leafPage.PageId == b.header.RootPageId
@@ -218,21 +380,18 @@ func (b *bplusTree[K, V]) insertInParent(leafGuard *buffer.WritePageGuard, newLe
 			return err
 		}
 
-		newRootPage, err := buffer.ToStruct[bplusInternalPage[K]](*parentGuard.GetDataMut())
+		newRootPage, err := decodeInternal[K](*parentGuard.GetDataMut())
 		if err != nil {
 			parentGuard.Drop()
 			return err
 		}
 
-		newRootPage.init(newRootId, disk.INVALID_PAGE_ID)
+		newRootPage.init(newRootId, disk.INVALID_PAGE_ID, b.bpm.PageSize())
 		newRootPage.setKeyAt(1, key)
 		newRootPage.setValAt(0, leafPage.PageId)
 		newRootPage.setValAt(1, newLeafPage.PageId)
 		newRootPage.Size = 2
 
-		leafPage.Parent = newRootId
-		newLeafPage.Parent = newRootId
-
 		if err := b.setRootPageId(newRootId); err != nil {
 			leafGuard.Drop()
 			newLeafGuard.Drop()
@@ -240,7 +399,7 @@ func (b *bplusTree[K, V]) insertInParent(leafGuard *buffer.WritePageGuard, newLe
 			return err
 		}
 
-		data, err := buffer.ToByteSlice(newRootPage)
+		data, err := newRootPage.encode()
 		if err != nil {
 			leafGuard.Drop()
 			newLeafGuard.Drop()
@@ -249,24 +408,19 @@ func (b *bplusTree[K, V]) insertInParent(leafGuard *buffer.WritePageGuard, newLe
 		}
 		copy(*parentGuard.GetDataMut(), data)
 
-		leafData, err := buffer.ToByteSlice(leafPage)
-		if err != nil {
+		if err := b.setParent(leafGuard, newRootId); err != nil {
 			leafGuard.Drop()
 			newLeafGuard.Drop()
 			parentGuard.Drop()
-
 			return err
 		}
-		copy(*leafGuard.GetDataMut(), leafData)
 
-		newLeafData, err := buffer.ToByteSlice(newLeafPage)
-		if err != nil {
+		if err := b.setParent(newLeafGuard, newRootId); err != nil {
 			leafGuard.Drop()
 			newLeafGuard.Drop()
 			parentGuard.Drop()
 			return err
 		}
-		copy(*newLeafGuard.GetDataMut(), newLeafData)
 
 		leafGuard.Drop()
 		newLeafGuard.Drop()
@@ -281,100 +435,116 @@ func (b *bplusTree[K, V]) insertInParent(leafGuard *buffer.WritePageGuard, newLe
 			return err
 		}
 
-		parentPage, err := buffer.ToStruct[bplusInternalPage[K]](*parentGuard.GetDataMut())
+		parentPage, err := decodeInternal[K](*parentGuard.GetDataMut())
 		if err != nil {
 			newLeafGuard.Drop()
 			parentGuard.Drop()
 			return err
 		}
 
-		if parentPage.Size < parentPage.MaxSize {
-			parentPage.addKeyVal(key, newLeafPage.PageId)
-			parentPage.Size += 1
-
-			data, err := buffer.ToByteSlice(parentPage)
-			if err != nil {
-				newLeafGuard.Drop()
-				parentGuard.Drop()
-				return err
-			}
+		parentPage.addKeyVal(key, newLeafPage.PageId)
+		parentPage.Size += 1
 
+		data, err := parentPage.encode()
+		if err == nil && parentPage.Size <= parentPage.MaxSize {
 			copy(*parentGuard.GetDataMut(), data)
 			newLeafGuard.Drop()
 			parentGuard.Drop()
-		} else {
-			insertIdx := parentPage.getInsertIdx(key)
-			parentPage.Keys = slices.Insert(parentPage.Keys, insertIdx, key)
-			parentPage.Values = slices.Insert(parentPage.Values, insertIdx, newLeafPage.PageId)
-
-			tmpKeyArr := make([]K, parentPage.MaxSize+1)
-			tmpValArr := make([]int64, parentPage.MaxSize+1)
+			return nil
+		}
+		if err != nil && !errors.Is(err, util.ErrPageOverflow) {
+			newLeafGuard.Drop()
+			parentGuard.Drop()
+			return err
+		}
 
-			// copy values to tmp and zero out original arrays
-			copy(tmpKeyArr, parentPage.Keys)
-			copy(tmpValArr, parentPage.Values)
-			parentPage.Keys = make([]K, parentPage.MaxSize)
-			parentPage.Values = make([]int64, parentPage.MaxSize)
+		size := parentPage.getSize()
+		tmpKeyArr := slices.Clone(parentPage.Keys[:size])
+		tmpValArr := slices.Clone(parentPage.Values[:size])
 
-			pPrimeId := b.bpm.NewPageId()
-			newLeafPage.Parent = pPrimeId
+		pPrimeId := b.bpm.NewPageId()
 
-			newLeafData, err := buffer.ToByteSlice(newLeafPage)
-			if err != nil {
-				parentGuard.Drop()
-				newLeafGuard.Drop()
-				return err
-			}
-			copy(*newLeafGuard.GetDataMut(), newLeafData)
+		pGuard, err := b.bpm.WritePage(pPrimeId)
+		if err != nil {
+			pGuard.Drop()
+			parentGuard.Drop()
 			newLeafGuard.Drop()
+			return err
+		}
 
-			pGuard, err := b.bpm.WritePage(pPrimeId)
-			if err != nil {
-				pGuard.Drop()
-				parentGuard.Drop()
-				newLeafGuard.Drop()
-				return err
-			}
-
-			pPrime, err := buffer.ToStruct[bplusInternalPage[K]](*pGuard.GetDataMut())
-			if err != nil {
-				pGuard.Drop()
-				parentGuard.Drop()
-				newLeafGuard.Drop()
-				return err
-			}
-			pPrime.init(pPrimeId, parentPage.Parent)
-
-			midPoint := int(math.Ceil(float64(parentPage.MaxSize) / 2))
+		pPrime, err := decodeInternal[K](*pGuard.GetDataMut())
+		if err != nil {
+			pGuard.Drop()
+			parentGuard.Drop()
+			newLeafGuard.Drop()
+			return err
+		}
+		pPrime.init(pPrimeId, parentPage.Parent, b.bpm.PageSize())
 
+		// the key at midPoint moves up to the grandparent
+		distribute := func(midPoint int) (parentData, primeData []byte, err error) {
+			parentPage.Keys = make([]K, parentPage.MaxSize)
+			parentPage.Values = make([]int64, parentPage.MaxSize)
+			pPrime.Keys = make([]K, pPrime.MaxSize)
+			pPrime.Values = make([]int64, pPrime.MaxSize)
 			copy(parentPage.Keys, tmpKeyArr[:midPoint])
 			copy(parentPage.Values, tmpValArr[:midPoint])
 			copy(pPrime.Keys[1:], tmpKeyArr[midPoint+1:])
 			copy(pPrime.Values, tmpValArr[midPoint:])
 
 			parentPage.Size = int32(midPoint)
-			pPrime.Size = int32(parentPage.MaxSize-int32(midPoint)) + 1
+			pPrime.Size = int32(size - midPoint)
 
-			parentData, err := buffer.ToByteSlice(parentPage)
-			if err != nil {
-				pGuard.Drop()
-				parentGuard.Drop()
-				newLeafGuard.Drop()
-				return err
+			if parentData, err = parentPage.encode(); err != nil {
+				return nil, nil, err
+			}
+			primeData, err = pPrime.encode()
+			return parentData, primeData, err
+		}
+
+		midPoint := size / 2
+		parentData, primeData, err := distribute(midPoint)
+		if errors.Is(err, util.ErrPageOverflow) {
+			// the first slot holds no key
+			midPoint, err = balancedSplit(size, func(i int) (int, error) {
+				if i == 0 {
+					return 0, nil
+				}
+				return encodedSize(tmpKeyArr[i])
+			})
+			if err == nil {
+				parentData, primeData, err = distribute(midPoint)
+			}
+		}
+		if err != nil {
+			pGuard.Drop()
+			parentGuard.Drop()
+			newLeafGuard.Drop()
+			return err
+		}
+
+		// children that moved to pPrime need to point at their new parent
+		for _, child := range pPrime.Values[:pPrime.Size] {
+			if child == newLeafPage.PageId {
+				err = b.setParent(newLeafGuard, pPrimeId)
+			} else {
+				err = b.updateParent(child, pPrimeId)
 			}
-			copy(*parentGuard.GetDataMut(), parentData)
 
-			primeData, err := buffer.ToByteSlice(pPrime)
 			if err != nil {
 				pGuard.Drop()
 				parentGuard.Drop()
+				newLeafGuard.Drop()
 				return err
 			}
-			copy(*pGuard.GetDataMut(), primeData)
+		}
+		newLeafGuard.Drop()
 
-			if err := b.insertInParent(parentGuard, pGuard, tmpKeyArr[midPoint]); err != nil {
-				return err
-			}
+		copy(*parentGuard.GetDataMut(), parentData)
+		copy(*pGuard.GetDataMut(), primeData)
+
+		if err := b.insertInParent(parentGuard, pGuard, tmpKeyArr[midPoint]); err != nil {
+			return err
 		}
 	}
 
@@ -388,20 +558,26 @@ func (b *bplusTree[K, V]) findLeafPageId(rootPageId int64, key K) (int64, error)
 		guard, err := b.bpm.ReadPage(currPageId)
 		if err != nil {
 			guard.Drop()
-			return 0, fmt.Errorf("error reading page: %v", err)
+			return 0, fmt.Errorf("error reading page: %w", err)
 		}
 
-		currPage, err := buffer.ToStruct[bplusInternalPage[K]](guard.GetData())
+		meta, err := readPageMeta(guard.GetData())
 		if err != nil {
 			guard.Drop()
 			return 0, fmt.Errorf("error casting page: %v", err)
 		}
 
-		if currPage.isLeafPage() {
+		if meta.PageType == LEAF_PAGE {
 			guard.Drop()
 			return currPageId, nil
 		}
 
+		currPage, err := decodeInternal[K](guard.GetData())
+		if err != nil {
+			guard.Drop()
+			return 0, fmt.Errorf("error casting page: %v", err)
+		}
+
 		childIdx := 0
 		for i := 1; i < currPage.getSize(); i++ {
 			if key >= currPage.keyAt(i) {
@@ -417,23 +593,82 @@ func (b *bplusTree[K, V]) findLeafPageId(rootPageId int64, key K) (int64, error)
 }
 
 func (b *bplusTree[K, V]) Delete(key K) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.checkOpen(); err != nil {
+		return false, err
+	}
+
+	if err := b.reclaimExpired(); err != nil {
+		return false, err
+	}
+
+	oldMeta, ok, err := b.erase(key)
+	if err != nil {
+		return false, err
+	}
+
+	// expired keys are invisible, deleting one only reclaims its slot
+	if oldMeta.expired(b.now().UnixNano()) {
+		return false, fmt.Errorf("%w: %v", util.ErrKeyNotFound, key)
+	}
+
+	return ok, nil
+}
+
+// erase removes key and keeps the secondary and expiry indexes in sync
+func (b *bplusTree[K, V]) erase(key K) (slotMeta, bool, error) {
+	old, oldMeta, ok, err := b.remove(key)
+	if err != nil {
+		return oldMeta, false, err
+	}
+
+	if oldMeta.Overflow != disk.INVALID_PAGE_ID {
+		if err := freeOverflow(b.bpm, oldMeta.Overflow); err != nil {
+			return oldMeta, false, err
+		}
+	}
+
+	for _, idx := range b.indexes {
+		if err := idx.remove(key, old); err != nil {
+			return oldMeta, false, err
+		}
+	}
+
+	if err := b.trackExpiry(key, oldMeta, slotMeta{}); err != nil {
+		return oldMeta, false, err
+	}
+
+	// an expired value was already absent to readers
+	ev := Event[K, V]{Type: EventDelete, Key: key}
+	if ok && !oldMeta.expired(b.now().UnixNano()) {
+		ev.Old, ev.HadOld = old, true
+	}
+	b.notify(ev)
+
+	return oldMeta, ok, nil
+}
+
+// remove deletes key and returns the value it held
+func (b *bplusTree[K, V]) remove(key K) (old V, oldMeta slotMeta, ok bool, err error) {
 	if b.isEmpty() {
-		return false, fmt.Errorf("store is empty")
+		return old, oldMeta, false, fmt.Errorf("store is empty")
 	}
 
 	leafId, err := b.findLeafPageId(b.header.RootPageId, key)
 	if err != nil {
-		return false, err
+		return old, oldMeta, false, err
 	}
 
 	leafGuard, err := b.bpm.WritePage(leafId)
 	if err != nil {
-		return false, err
+		return old, oldMeta, false, err
 	}
-	leafPage, err := buffer.ToStruct[bplusLeafPage[K, V]](*leafGuard.GetDataMut())
+	leafPage, err := decodeLeaf[K, V](*leafGuard.GetDataMut())
 	if err != nil {
 		leafGuard.Drop()
-		return false, err
+		return old, oldMeta, false, err
 	}
 
 	pos := -1
@@ -445,18 +680,25 @@ func (b *bplusTree[K, V]) Delete(key K) (bool, error) {
 	}
 	if pos == -1 {
 		leafGuard.Drop()
-		return false, fmt.Errorf("key not found: %v", key)
+		return old, oldMeta, false, fmt.Errorf("%w: %v", util.ErrKeyNotFound, key)
+	}
+	old, err = readValue(b.bpm, b.vlog, &leafPage, pos)
+	if err != nil {
+		leafGuard.Drop()
+		return old, oldMeta, false, err
 	}
+	oldMeta = leafPage.metaAt(pos)
 
 	leafPage.Keys = slices.Delete(leafPage.Keys, pos, pos+1)
 	leafPage.Values = slices.Delete(leafPage.Values, pos, pos+1)
+	leafPage.Meta = slices.Delete(leafPage.Meta, pos, pos+1)
 	leafPage.Size--
 
 	{
-		data, err := buffer.ToByteSlice(leafPage)
+		data, err := leafPage.encode()
 		if err != nil {
 			leafGuard.Drop()
-			return false, err
+			return old, oldMeta, false, err
 		}
 		copy(*leafGuard.GetDataMut(), data)
 	}
@@ -465,30 +707,34 @@ func (b *bplusTree[K, V]) Delete(key K) (bool, error) {
 		if leafPage.Size == 0 {
 			leafGuard.Drop()
 			if err := b.setRootPageId(disk.INVALID_PAGE_ID); err != nil {
-				return false, err
+				return old, oldMeta, false, err
 			}
-			return true, nil
+			return old, oldMeta, true, nil
 		}
 		leafGuard.Drop()
-		return true, nil
+		return old, oldMeta, true, nil
 	}
 
-	minLeaf := int32(math.Ceil(float64(leafPage.MaxSize) / 2))
-	if leafPage.Size >= minLeaf {
+	underfull, err := leafPage.underfull()
+	if err != nil {
+		leafGuard.Drop()
+		return old, oldMeta, false, err
+	}
+	if !underfull {
 		leafGuard.Drop()
-		return true, nil
+		return old, oldMeta, true, nil
 	}
 
 	parentId := leafPage.Parent
 	leafGuard.Drop()
 	parentGuard, err := b.bpm.WritePage(parentId)
 	if err != nil {
-		return false, err
+		return old, oldMeta, false, err
 	}
-	parentPage, err := buffer.ToStruct[bplusInternalPage[K]](*parentGuard.GetDataMut())
+	parentPage, err := decodeInternal[K](*parentGuard.GetDataMut())
 	if err != nil {
 		parentGuard.Drop()
-		return false, err
+		return old, oldMeta, false, err
 	}
 
 	childIdx := -1
@@ -500,7 +746,7 @@ func (b *bplusTree[K, V]) Delete(key K) (bool, error) {
 	}
 	if childIdx == -1 {
 		parentGuard.Drop()
-		return false, fmt.Errorf("leaf %d not found in parent %d", leafId, parentId)
+		return old, oldMeta, false, fmt.Errorf("leaf %d not found in parent %d", leafId, parentId)
 	}
 
 	loadLeaf := func(id int64) (*buffer.WritePageGuard, *bplusLeafPage[K, V], error) {
@@ -508,7 +754,7 @@ func (b *bplusTree[K, V]) Delete(key K) (bool, error) {
 		if err != nil {
 			return nil, nil, err
 		}
-		lp, err := buffer.ToStruct[bplusLeafPage[K, V]](*g.GetDataMut())
+		lp, err := decodeLeaf[K, V](*g.GetDataMut())
 		if err != nil {
 			g.Drop()
 			return nil, nil, err
@@ -569,68 +815,96 @@ func (b *bplusTree[K, V]) Delete(key K) (bool, error) {
 			leafG, leafP = secondGuard, secondPage
 		}
 
-		minL := int32(math.Ceil(float64(leafP.MaxSize) / 2))
-		if leafP.Size >= minL {
-			leafData, _ := buffer.ToByteSlice(leafP)
-			copy(*leafG.GetDataMut(), leafData)
+		underfull, err := leafP.underfull()
+		if err != nil {
+			leafG.Drop()
+			sibG.Drop()
+			return false, err
+		}
+		if !underfull {
+			leafData, err := leafP.encode()
+			if err != nil {
+				leafG.Drop()
+				sibG.Drop()
+				return false, err
+			}
+			copy(*leafG.GetDataMut(), leafData)
 			leafG.Drop()
 			sibG.Drop()
 			return true, nil
 		}
 
-		minSib := int32(math.Ceil(float64(sibP.MaxSize) / 2))
-		if sibP.Size > minSib {
+		// entries differ in size, so a borrowed entry or a merge can overflow
+		// a page that is underfull by count. The leaf is then left underfull.
+		abort := func(err error) (bool, error) {
+			leafG.Drop()
+			sibG.Drop()
+			if errors.Is(err, util.ErrPageOverflow) {
+				return true, nil
+			}
+			return false, err
+		}
+
+		lend, err := sibP.canLend()
+		if err != nil {
+			return abort(err)
+		}
+		if lend {
+			var sepKey K
 			if borrowLeft {
 				k := sibP.keyAt(int(sibP.Size) - 1)
 				v := sibP.valueAt(int(sibP.Size) - 1)
+				m := sibP.metaAt(int(sibP.Size) - 1)
 				sibP.Keys = sibP.Keys[:sibP.Size-1]
 				sibP.Values = sibP.Values[:sibP.Size-1]
+				sibP.Meta = sibP.Meta[:sibP.Size-1]
 				sibP.Size--
 
 				leafP.Keys = slices.Insert(leafP.Keys, 0, k)
 				leafP.Values = slices.Insert(leafP.Values, 0, v)
+				leafP.Meta = slices.Insert(leafP.Meta, 0, m)
 				leafP.Size++
 
-				if sepKeyIdx >= 1 && sepKeyIdx < int(parentPage.Size) {
-					parentPage.setKeyAt(sepKeyIdx, leafP.keyAt(0))
-				}
+				sepKey = shortestSeparator(sibP.keyAt(int(sibP.Size)-1), leafP.keyAt(0))
 			} else {
 				k := sibP.keyAt(0)
 				v := sibP.valueAt(0)
+				m := sibP.metaAt(0)
 				sibP.Keys = sibP.Keys[1:]
 				sibP.Values = sibP.Values[1:]
+				sibP.Meta = sibP.Meta[1:]
 				sibP.Size--
 
 				leafP.Keys = append(leafP.Keys[:leafP.Size], k)
 				leafP.Values = append(leafP.Values[:leafP.Size], v)
+				leafP.Meta = append(leafP.Meta[:leafP.Size], m)
 				leafP.Size++
 
-				if sepKeyIdx >= 1 && sepKeyIdx < int(parentPage.Size) && sibP.Size > 0 {
-					parentPage.setKeyAt(sepKeyIdx, sibP.keyAt(0))
+				if sibP.Size > 0 {
+					sepKey = shortestSeparator(leafP.keyAt(int(leafP.Size)-1), sibP.keyAt(0))
 				}
 			}
 
-			if d, err := buffer.ToByteSlice(leafP); err == nil {
-				copy(*leafG.GetDataMut(), d)
-			} else {
-				leafG.Drop()
-				sibG.Drop()
-				return false, err
+			leafData, err := leafP.encode()
+			if err != nil {
+				return abort(err)
 			}
-			if d, err := buffer.ToByteSlice(sibP); err == nil {
-				copy(*sibG.GetDataMut(), d)
-			} else {
-				leafG.Drop()
-				sibG.Drop()
-				return false, err
+			sibData, err := sibP.encode()
+			if err != nil {
+				return abort(err)
 			}
-			if d, err := buffer.ToByteSlice(parentPage); err == nil {
-				copy(*parentGuard.GetDataMut(), d)
-			} else {
-				leafG.Drop()
-				sibG.Drop()
-				return false, err
+
+			if sepKeyIdx >= 1 && sepKeyIdx < int(parentPage.Size) && (borrowLeft || sibP.Size > 0) {
+				parentPage.setKeyAt(sepKeyIdx, sepKey)
 			}
+			parentData, err := parentPage.encode()
+			if err != nil {
+				return abort(err)
+			}
+
+			copy(*leafG.GetDataMut(), leafData)
+			copy(*sibG.GetDataMut(), sibData)
+			copy(*parentGuard.GetDataMut(), parentData)
 
 			leafG.Drop()
 			sibG.Drop()
@@ -640,28 +914,27 @@ func (b *bplusTree[K, V]) Delete(key K) (bool, error) {
 		if borrowLeft {
 			sibP.Keys = append(sibP.Keys[:sibP.Size], leafP.Keys[:leafP.Size]...)
 			sibP.Values = append(sibP.Values[:sibP.Size], leafP.Values[:leafP.Size]...)
+			sibP.Meta = append(sibP.Meta[:sibP.Size], leafP.Meta[:leafP.Size]...)
 			sibP.Size += leafP.Size
 			sibP.Next = leafP.Next
 
+			sibData, err := sibP.encode()
+			if err != nil {
+				return abort(err)
+			}
+
 			parentPage.Keys = slices.Delete(parentPage.Keys, childIdx, childIdx+1)
 			parentPage.Values = slices.Delete(parentPage.Values, childIdx, childIdx+1)
 			parentPage.Size--
 
-			if d, err := buffer.ToByteSlice(sibP); err == nil {
-				copy(*sibG.GetDataMut(), d)
-			} else {
-				leafG.Drop()
-				sibG.Drop()
-				return false, err
-			}
-			if d, err := buffer.ToByteSlice(parentPage); err == nil {
-				copy(*parentGuard.GetDataMut(), d)
-			} else {
-				leafG.Drop()
-				sibG.Drop()
-				return false, err
+			parentData, err := parentPage.encode()
+			if err != nil {
+				return abort(err)
 			}
 
+			copy(*sibG.GetDataMut(), sibData)
+			copy(*parentGuard.GetDataMut(), parentData)
+
 			leafG.Drop()
 			sibG.Drop()
 
@@ -669,28 +942,27 @@ func (b *bplusTree[K, V]) Delete(key K) (bool, error) {
 		} else {
 			leafP.Keys = append(leafP.Keys[:leafP.Size], sibP.Keys[:sibP.Size]...)
 			leafP.Values = append(leafP.Values[:leafP.Size], sibP.Values[:sibP.Size]...)
+			leafP.Meta = append(leafP.Meta[:leafP.Size], sibP.Meta[:sibP.Size]...)
 			leafP.Size += sibP.Size
 			leafP.Next = sibP.Next
 
+			leafData, err := leafP.encode()
+			if err != nil {
+				return abort(err)
+			}
+
 			parentPage.Keys = slices.Delete(parentPage.Keys, childIdx+1, childIdx+2)
 			parentPage.Values = slices.Delete(parentPage.Values, childIdx+1, childIdx+2)
 			parentPage.Size--
 
-			if d, err := buffer.ToByteSlice(leafP); err == nil {
-				copy(*leafG.GetDataMut(), d)
-			} else {
-				leafG.Drop()
-				sibG.Drop()
-				return false, err
-			}
-			if d, err := buffer.ToByteSlice(parentPage); err == nil {
-				copy(*parentGuard.GetDataMut(), d)
-			} else {
-				leafG.Drop()
-				sibG.Drop()
-				return false, err
+			parentData, err := parentPage.encode()
+			if err != nil {
+				return abort(err)
 			}
 
+			copy(*leafG.GetDataMut(), leafData)
+			copy(*parentGuard.GetDataMut(), parentData)
+
 			leafG.Drop()
 			sibG.Drop()
 
@@ -701,24 +973,24 @@ func (b *bplusTree[K, V]) Delete(key K) (bool, error) {
 	done, err := tryBorrowOrMerge(true)
 	if err != nil {
 		parentGuard.Drop()
-		return false, err
+		return old, oldMeta, false, err
 	}
 	if done {
 		parentGuard.Drop()
-		return true, nil
+		return old, oldMeta, true, nil
 	}
 
 	done, err = tryBorrowOrMerge(false)
 	if err != nil {
 		parentGuard.Drop()
-		return false, err
+		return old, oldMeta, false, err
 	}
 	parentGuard.Drop()
-	return done, nil
+	return old, oldMeta, done, nil
 }
 
 func (b *bplusTree[K, V]) fixInternalAfterDelete(parentGuard *buffer.WritePageGuard) error {
-	parentPage, err := buffer.ToStruct[bplusInternalPage[K]](*parentGuard.GetDataMut())
+	parentPage, err := decodeInternal[K](*parentGuard.GetDataMut())
 	if err != nil {
 		return err
 	}
@@ -729,37 +1001,16 @@ func (b *bplusTree[K, V]) fixInternalAfterDelete(parentGuard *buffer.WritePageGu
 			if err := b.setRootPageId(onlyChild); err != nil {
 				return err
 			}
-			childGuard, err := b.bpm.WritePage(onlyChild)
-			if err != nil {
+			if err := b.updateParent(onlyChild, disk.INVALID_PAGE_ID); err != nil {
 				return err
 			}
-			childInternal, _ := buffer.ToStruct[bplusInternalPage[K]](*childGuard.GetDataMut())
-			if childInternal.isLeafPage() {
-				childLeaf, _ := buffer.ToStruct[bplusLeafPage[K, any]](*childGuard.GetDataMut())
-				childLeaf.Parent = disk.INVALID_PAGE_ID
-				if d, err := buffer.ToByteSlice(childLeaf); err == nil {
-					copy(*childGuard.GetDataMut(), d)
-				} else {
-					childGuard.Drop()
-					return err
-				}
-			} else {
-				childInternal.Parent = disk.INVALID_PAGE_ID
-				if d, err := buffer.ToByteSlice(childInternal); err == nil {
-					copy(*childGuard.GetDataMut(), d)
-				} else {
-					childGuard.Drop()
-					return err
-				}
-			}
-			childGuard.Drop()
 		}
 		return nil
 	}
 
-	minInternal := int32(math.Ceil(float64(parentPage.MaxSize) / 2))
-	if parentPage.Size >= minInternal {
-		return nil
+	underfull, err := parentPage.underfull()
+	if err != nil || !underfull {
+		return err
 	}
 
 	grandId := parentPage.Parent
@@ -771,7 +1022,7 @@ func (b *bplusTree[K, V]) fixInternalAfterDelete(parentGuard *buffer.WritePageGu
 	if err != nil {
 		return err
 	}
-	grandPage, err := buffer.ToStruct[bplusInternalPage[K]](*grandGuard.GetDataMut())
+	grandPage, err := decodeInternal[K](*grandGuard.GetDataMut())
 	if err != nil {
 		grandGuard.Drop()
 		return err
@@ -803,7 +1054,7 @@ func (b *bplusTree[K, V]) fixInternalAfterDelete(parentGuard *buffer.WritePageGu
 		if err != nil {
 			return nil, nil, err
 		}
-		p, err := buffer.ToStruct[bplusInternalPage[K]](*g.GetDataMut())
+		p, err := decodeInternal[K](*g.GetDataMut())
 		if err != nil {
 			g.Drop()
 			return nil, nil, err
@@ -841,14 +1092,29 @@ func (b *bplusTree[K, V]) fixInternalAfterDelete(parentGuard *buffer.WritePageGu
 			parG, parP = secondG, secondP
 		}
 
-		minSib := int32(math.Ceil(float64(sibP.MaxSize) / 2))
-		if sibP.Size > minSib {
+		// like leaves, internal pages are left underfull when borrowing or
+		// merging would overflow one of them
+		abort := func(err error) error {
+			sibG.Drop()
+			parG.Drop()
+			grandGuard.Drop()
+			if errors.Is(err, util.ErrPageOverflow) {
+				return nil
+			}
+			return err
+		}
+
+		lend, err := sibP.canLend()
+		if err != nil {
+			return abort(err)
+		}
+		if lend {
 			sepKeyIdx := idx
 			sepKey := grandPage.keyAt(sepKeyIdx)
 
 			movePtr := sibP.valueAt(int(sibP.Size - 1))
 			sibP.Values = sibP.Values[:sibP.Size-1]
-			lastKeyOfSib := sibP.keyAt(int(sibP.Size - 0))
+			lastKeyOfSib := sibP.keyAt(int(sibP.Size - 1))
 			sibP.Keys = sibP.Keys[:int(sibP.Size)]
 			sibP.Size--
 
@@ -858,34 +1124,22 @@ func (b *bplusTree[K, V]) fixInternalAfterDelete(parentGuard *buffer.WritePageGu
 
 			grandPage.setKeyAt(sepKeyIdx, lastKeyOfSib)
 
-			childG, err := b.bpm.WritePage(movePtr)
-			if err == nil {
-				ci, _ := buffer.ToStruct[bplusInternalPage[K]](*childG.GetDataMut())
-				if ci.isLeafPage() {
-					cl, _ := buffer.ToStruct[bplusLeafPage[K, any]](*childG.GetDataMut())
-					cl.Parent = parP.PageId
-					if d, e := buffer.ToByteSlice(cl); e == nil {
-						copy(*childG.GetDataMut(), d)
-					}
-				} else {
-					ci.Parent = parP.PageId
-					if d, e := buffer.ToByteSlice(ci); e == nil {
-						copy(*childG.GetDataMut(), d)
-					}
-				}
-				childG.Drop()
+			data, err := encodeInternals(sibP, parP, &grandPage)
+			if err != nil {
+				return abort(err)
 			}
 
-			if d, e := buffer.ToByteSlice(sibP); e == nil {
-				copy(*sibG.GetDataMut(), d)
-			}
-			if d, e := buffer.ToByteSlice(parP); e == nil {
-				copy(*parG.GetDataMut(), d)
-			}
-			if d, e := buffer.ToByteSlice(grandPage); e == nil {
-				copy(*grandGuard.GetDataMut(), d)
+			if err := b.updateParent(movePtr, parP.PageId); err != nil {
+				sibG.Drop()
+				parG.Drop()
+				grandGuard.Drop()
+				return err
 			}
 
+			copy(*sibG.GetDataMut(), data[0])
+			copy(*parG.GetDataMut(), data[1])
+			copy(*grandGuard.GetDataMut(), data[2])
+
 			sibG.Drop()
 			parG.Drop()
 			grandGuard.Drop()
@@ -907,37 +1161,27 @@ func (b *bplusTree[K, V]) fixInternalAfterDelete(parentGuard *buffer.WritePageGu
 		oldSize := sibP.Size
 		sibP.Size = sibP.Size + parP.Size
 
-		for i := int(oldSize); i < int(sibP.Size); i++ {
-			ptr := sibP.valueAt(i)
-			childG, err := b.bpm.WritePage(ptr)
-			if err == nil {
-				ci, _ := buffer.ToStruct[bplusInternalPage[K]](*childG.GetDataMut())
-				if ci.isLeafPage() {
-					cl, _ := buffer.ToStruct[bplusLeafPage[K, any]](*childG.GetDataMut())
-					cl.Parent = sibP.PageId
-					if d, e := buffer.ToByteSlice(cl); e == nil {
-						copy(*childG.GetDataMut(), d)
-					}
-				} else {
-					ci.Parent = sibP.PageId
-					if d, e := buffer.ToByteSlice(ci); e == nil {
-						copy(*childG.GetDataMut(), d)
-					}
-				}
-				childG.Drop()
-			}
-		}
-
 		grandPage.Keys = slices.Delete(grandPage.Keys, sepKeyIdx, sepKeyIdx+1)
 		grandPage.Values = slices.Delete(grandPage.Values, idx, idx+1)
 		grandPage.Size--
 
-		if d, e := buffer.ToByteSlice(sibP); e == nil {
-			copy(*sibG.GetDataMut(), d)
+		data, err := encodeInternals(sibP, &grandPage)
+		if err != nil {
+			return abort(err)
 		}
-		if d, e := buffer.ToByteSlice(grandPage); e == nil {
-			copy(*grandGuard.GetDataMut(), d)
+
+		for i := int(oldSize); i < int(sibP.Size); i++ {
+			ptr := sibP.valueAt(i)
+			if err := b.updateParent(ptr, sibP.PageId); err != nil {
+				sibG.Drop()
+				parG.Drop()
+				grandGuard.Drop()
+				return err
+			}
 		}
+
+		copy(*sibG.GetDataMut(), data[0])
+		copy(*grandGuard.GetDataMut(), data[1])
 		sibG.Drop()
 		parG.Drop()
 
@@ -976,8 +1220,23 @@ func (b *bplusTree[K, V]) fixInternalAfterDelete(parentGuard *buffer.WritePageGu
 			parG, parP = secondG, secondP
 		}
 
-		minSib := int32(math.Ceil(float64(sibP.MaxSize) / 2))
-		if sibP.Size > minSib {
+		// like leaves, internal pages are left underfull when borrowing or
+		// merging would overflow one of them
+		abort := func(err error) error {
+			sibG.Drop()
+			parG.Drop()
+			grandGuard.Drop()
+			if errors.Is(err, util.ErrPageOverflow) {
+				return nil
+			}
+			return err
+		}
+
+		lend, err := sibP.canLend()
+		if err != nil {
+			return abort(err)
+		}
+		if lend {
 			sepKeyIdx := idx + 1
 			sepKey := grandPage.keyAt(sepKeyIdx)
 
@@ -1001,34 +1260,22 @@ func (b *bplusTree[K, V]) fixInternalAfterDelete(parentGuard *buffer.WritePageGu
 				grandPage.setKeyAt(sepKeyIdx, sibFirstKey)
 			}
 
-			childG, err := b.bpm.WritePage(movePtr)
-			if err == nil {
-				ci, _ := buffer.ToStruct[bplusInternalPage[K]](*childG.GetDataMut())
-				if ci.isLeafPage() {
-					cl, _ := buffer.ToStruct[bplusLeafPage[K, any]](*childG.GetDataMut())
-					cl.Parent = parP.PageId
-					if d, e := buffer.ToByteSlice(cl); e == nil {
-						copy(*childG.GetDataMut(), d)
-					}
-				} else {
-					ci.Parent = parP.PageId
-					if d, e := buffer.ToByteSlice(ci); e == nil {
-						copy(*childG.GetDataMut(), d)
-					}
-				}
-				childG.Drop()
+			data, err := encodeInternals(sibP, parP, &grandPage)
+			if err != nil {
+				return abort(err)
 			}
 
-			if d, e := buffer.ToByteSlice(sibP); e == nil {
-				copy(*sibG.GetDataMut(), d)
-			}
-			if d, e := buffer.ToByteSlice(parP); e == nil {
-				copy(*parG.GetDataMut(), d)
-			}
-			if d, e := buffer.ToByteSlice(grandPage); e == nil {
-				copy(*grandGuard.GetDataMut(), d)
+			if err := b.updateParent(movePtr, parP.PageId); err != nil {
+				sibG.Drop()
+				parG.Drop()
+				grandGuard.Drop()
+				return err
 			}
 
+			copy(*sibG.GetDataMut(), data[0])
+			copy(*parG.GetDataMut(), data[1])
+			copy(*grandGuard.GetDataMut(), data[2])
+
 			sibG.Drop()
 			parG.Drop()
 			grandGuard.Drop()
@@ -1050,38 +1297,28 @@ func (b *bplusTree[K, V]) fixInternalAfterDelete(parentGuard *buffer.WritePageGu
 		oldSize := parP.Size
 		parP.Size = parP.Size + sibP.Size
 
-		for i := int(oldSize); i < int(parP.Size); i++ {
-			ptr := parP.valueAt(i)
-			childG, err := b.bpm.WritePage(ptr)
-			if err == nil {
-				ci, _ := buffer.ToStruct[bplusInternalPage[K]](*childG.GetDataMut())
-				if ci.isLeafPage() {
-					cl, _ := buffer.ToStruct[bplusLeafPage[K, any]](*childG.GetDataMut())
-					cl.Parent = parP.PageId
-					if d, e := buffer.ToByteSlice(cl); e == nil {
-						copy(*childG.GetDataMut(), d)
-					}
-				} else {
-					ci.Parent = parP.PageId
-					if d, e := buffer.ToByteSlice(ci); e == nil {
-						copy(*childG.GetDataMut(), d)
-					}
-				}
-				childG.Drop()
-			}
-		}
-
 		grandPage.Keys = slices.Delete(grandPage.Keys, sepKeyIdx, sepKeyIdx+1)
 		grandPage.Values = slices.Delete(grandPage.Values, idx+1, idx+2)
 		grandPage.Size--
 
-		if d, e := buffer.ToByteSlice(parP); e == nil {
-			copy(*parG.GetDataMut(), d)
+		data, err := encodeInternals(parP, &grandPage)
+		if err != nil {
+			return abort(err)
 		}
-		if d, e := buffer.ToByteSlice(grandPage); e == nil {
-			copy(*grandGuard.GetDataMut(), d)
+
+		for i := int(oldSize); i < int(parP.Size); i++ {
+			ptr := parP.valueAt(i)
+			if err := b.updateParent(ptr, parP.PageId); err != nil {
+				sibG.Drop()
+				parG.Drop()
+				grandGuard.Drop()
+				return err
+			}
 		}
 
+		copy(*parG.GetDataMut(), data[0])
+		copy(*grandGuard.GetDataMut(), data[1])
+
 		sibG.Drop()
 		parG.Drop()
 
@@ -1094,43 +1331,371 @@ func (b *bplusTree[K, V]) fixInternalAfterDelete(parentGuard *buffer.WritePageGu
 	return nil
 }
 
+// encodeInternals encodes every page or none of them
+func encodeInternals[K cmp.Ordered](pages ...*bplusInternalPage[K]) ([][]byte, error) {
+	data := make([][]byte, len(pages))
+	for i, page := range pages {
+		d, err := page.encode()
+		if err != nil {
+			return nil, err
+		}
+		data[i] = d
+	}
+
+	return data, nil
+}
+
 func (b *bplusTree[K, V]) isEmpty() bool {
 	// TODO: use appropriate variable name
 	return b.header.RootPageId == 0
 }
 
-func (b *bplusTree[K, V]) Flush() {
-	b.bpm.FlushAll()
+// Flush writes the tree's pages and value log to disk and returns once they
+// are on stable storage, unless the disk manager was told not to sync
+func (b *bplusTree[K, V]) Flush() error {
+	if err := b.checkOpen(); err != nil {
+		return err
+	}
+
+	// the values the tree points at are synced before the tree
+	if b.vlog != nil {
+		if err := b.vlog.sync(); err != nil {
+			return fmt.Errorf("error syncing value log: %w", err)
+		}
+	}
+
+	if err := b.bpm.FlushAll(); err != nil {
+		return fmt.Errorf("error flushing %s: %w", b.indexName, err)
+	}
+
+	return nil
+}
+
+// Close stops the expiry sweeper, closes the watch channels and the value log
+// and flushes the tree. The buffer pool is closed as well when the tree was
+// opened with New. Later calls return ErrClosed.
+func (b *bplusTree[K, V]) Close() error {
+	b.StopExpirySweeper()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.watchMu.Lock()
+	if b.closed.Swap(true) {
+		b.watchMu.Unlock()
+		return nil
+	}
+
+	for w := range b.watchers {
+		b.unwatch(w)
+	}
+	b.watchMu.Unlock()
+
+	errs := []error{}
+	if b.vlog != nil {
+		errs = append(errs, b.vlog.sync())
+	}
+
+	if b.bloom != nil && !b.header.Bloom.Clean {
+		errs = append(errs, b.markBloomClean())
+	}
+
+	if b.ownsBpm {
+		errs = append(errs, b.bpm.Close())
+	} else {
+		errs = append(errs, b.bpm.FlushAll())
+	}
+
+	if b.vlog != nil {
+		b.vlog.close()
+	}
+
+	return errors.Join(errs...)
+}
+
+func (b *bplusTree[K, V]) checkOpen() error {
+	if b.closed.Load() {
+		return fmt.Errorf("%w: %s", util.ErrClosed, b.indexName)
+	}
+
+	return nil
+}
+
+// clear puts the tree's pages and the overflow chains of its values on the
+// free list and leaves the tree empty
+func (b *bplusTree[K, V]) clear() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.isEmpty() {
+		return nil
+	}
+
+	pageIds := []int64{}
+	queue := []int64{b.header.RootPageId}
+	for len(queue) > 0 {
+		pageId := queue[0]
+		queue = queue[1:]
+		pageIds = append(pageIds, pageId)
+
+		guard, err := b.bpm.ReadPage(pageId)
+		if err != nil {
+			return err
+		}
+
+		meta, err := readPageMeta(guard.GetData())
+		if err != nil {
+			guard.Drop()
+			return err
+		}
+
+		if meta.PageType == LEAF_PAGE {
+			leafPage, err := decodeLeaf[K, V](guard.GetData())
+			guard.Drop()
+			if err != nil {
+				return err
+			}
+
+			for i := range leafPage.getSize() {
+				if chain := leafPage.metaAt(i).Overflow; chain != disk.INVALID_PAGE_ID {
+					if err := freeOverflow(b.bpm, chain); err != nil {
+						return err
+					}
+				}
+			}
+			continue
+		}
+
+		internalPage, err := decodeInternal[K](guard.GetData())
+		guard.Drop()
+		if err != nil {
+			return err
+		}
+		queue = append(queue, internalPage.Values[:internalPage.Size]...)
+	}
+
+	if err := freePages(b.bpm, pageIds); err != nil {
+		return err
+	}
+
+	b.header.FirstPageId = disk.INVALID_PAGE_ID
+	return b.setRootPageId(disk.INVALID_PAGE_ID)
 }
 
 func (b *bplusTree[K, V]) setRootPageId(pageId int64) error {
 	b.header.RootPageId = pageId
-	writeGuard, err := b.bpm.WritePage(HEADER_PAGE_ID)
+	return b.saveHeader()
+}
+
+// saveHeader writes the tree's header into the catalog kept on the header
+// page
+func (b *bplusTree[K, V]) saveHeader() error {
+	err := updateCatalog(b.bpm, func(catalog *catalogPage) error {
+		if catalog.Trees == nil {
+			catalog.Trees = map[string]headerPage{}
+		}
+		catalog.Trees[b.indexName] = b.header
+		catalog.RootPageId = disk.INVALID_PAGE_ID
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error setting rootPageId: %w", err)
+	}
+
+	return nil
+}
+
+// updateCatalog applies update to the catalog kept on the header page. The
+// catalog is shared by every index on the buffer pool, so it is read and
+// written under the header page's write guard.
+func updateCatalog(bpm *buffer.BufferpoolManager, update func(*catalogPage) error) error {
+	writeGuard, err := bpm.WritePage(HEADER_PAGE_ID)
 	defer writeGuard.Drop()
 	if err != nil {
-		return fmt.Errorf("error setting rootPageId: %v", err)
+		return err
 	}
 
-	data, err := buffer.ToByteSlice(b.header)
+	catalog, err := buffer.ToStruct[catalogPage](*writeGuard.GetDataMut())
 	if err != nil {
-		return fmt.Errorf("error converting header struct to byteslice: %v", err)
+		return fmt.Errorf("error getting header page: %v", err)
+	}
+
+	if err := update(&catalog); err != nil {
+		return err
+	}
+
+	data, err := encodePage(catalog, bpm.PageSize())
+	if err != nil {
+		return fmt.Errorf("error converting header struct to byteslice: %w", err)
 	}
 
 	copy(*writeGuard.GetDataMut(), data)
 	return nil
 }
 
+// readCatalog returns the catalog kept on the header page
+// header returns the header of the tree called name, it reports false when
+// there's no such tree
+func (c catalogPage) header(name string) (headerPage, bool) {
+	if header, ok := c.Trees[name]; ok {
+		return header, true
+	}
+
+	// files written before the catalog hold a single unnamed tree
+	if c.RootPageId != disk.INVALID_PAGE_ID {
+		return headerPage{RootPageId: c.RootPageId, FirstPageId: 1}, true
+	}
+
+	return headerPage{}, false
+}
+
+func readCatalog(bpm *buffer.BufferpoolManager) (catalogPage, error) {
+	guard, err := bpm.ReadPage(HEADER_PAGE_ID)
+	defer guard.Drop()
+	if err != nil {
+		return catalogPage{}, fmt.Errorf("error reading header page: %w", err)
+	}
+
+	catalog, err := buffer.ToStruct[catalogPage](guard.GetData())
+	if err != nil {
+		return catalogPage{}, fmt.Errorf("error getting header page: %v", err)
+	}
+
+	return catalog, nil
+}
+
+// setParent points the page held by guard at a new parent page
+func (b *bplusTree[K, V]) setParent(guard *buffer.WritePageGuard, parentId int64) error {
+	meta, err := readPageMeta(*guard.GetDataMut())
+	if err != nil {
+		return err
+	}
+
+	var data []byte
+	if meta.PageType == LEAF_PAGE {
+		page, err := decodeLeaf[K, V](*guard.GetDataMut())
+		if err != nil {
+			return err
+		}
+		page.Parent = parentId
+		data, err = page.encode()
+		if err != nil {
+			return err
+		}
+	} else {
+		page, err := decodeInternal[K](*guard.GetDataMut())
+		if err != nil {
+			return err
+		}
+		page.Parent = parentId
+		data, err = page.encode()
+		if err != nil {
+			return err
+		}
+	}
+
+	copy(*guard.GetDataMut(), data)
+	return nil
+}
+
+func (b *bplusTree[K, V]) updateParent(pageId, parentId int64) error {
+	guard, err := b.bpm.WritePage(pageId)
+	if err != nil {
+		return err
+	}
+	defer guard.Drop()
+
+	return b.setParent(guard, parentId)
+}
+
 type bplusTree[K cmp.Ordered, V any] struct {
-	bpm         *buffer.BufferpoolManager
-	indexName   string
-	header      headerPage
-	firstPageId int64
+	mu        sync.RWMutex
+	bpm       *buffer.BufferpoolManager
+	indexName string
+	header    headerPage
+	indexes   map[string]secondaryIndex[K, V]
+	mergeOp   MergeOperator[V]
+	limits    SizeLimits
+	readAhead int
+
+	// now is the clock used for expiry, tests replace it
+	now       func() time.Time
+	expiry    *bplusTree[string, K]
+	bloom     *bloomFilter[K]
+	vlog      *valueLog
+	expiredMu sync.Mutex
+	expired   map[K]struct{}
+
+	watchMu     sync.Mutex
+	watchers    map[*watcher[K, V]]struct{}
+	sweeperMu   sync.Mutex
+	sweeperStop chan struct{}
+	sweeperDone chan struct{}
+
+	// ownsBpm is set when the buffer pool was created for the tree
+	ownsBpm bool
+	closed  atomic.Bool
+}
+
+// updateFunc computes the entry put under a key from the entry it replaces,
+// found is false when the key has no live entry
+type updateFunc[V any] func(old V, oldMeta slotMeta, found bool) (V, slotMeta)
+
+// setTo returns an updateFunc that ignores the entry it replaces
+func setTo[V any](value V, meta slotMeta) updateFunc[V] {
+	return func(V, slotMeta, bool) (V, slotMeta) {
+		return value, meta
+	}
+}
+
+type putResult[V any] struct {
+	old     V
+	oldMeta slotMeta
+
+	// replaced is true when the key had an entry, found only when that entry
+	// had not expired
+	replaced bool
+	found    bool
+
+	value V
+	meta  slotMeta
 }
 
 type headerPage struct {
-	RootPageId int64
+	RootPageId  int64
+	FirstPageId int64
+	Bloom       bloomConfig
+	ValueLog    valueLogConfig
 	/* TODO: track the following
-	1. first leaf page
-	2. last issued paged id
+	1. last issued paged id
 	*/
 }
+
+// RESERVED_PREFIX starts the catalog names of the trees an index keeps for
+// itself, such as its secondary and expiry indexes. Names passed to New,
+// NewHash and their Bplus and Hash counterparts can't start with it.
+const RESERVED_PREFIX = "petro:"
+
+// checkName refuses names in the reserved namespace
+func checkName(name string) error {
+	if strings.HasPrefix(name, RESERVED_PREFIX) {
+		return fmt.Errorf("%w: %s", util.ErrReservedName, name)
+	}
+	return nil
+}
+
+// catalogPage is stored on the header page and maps index names to their
+// headers, which lets several trees share a buffer pool.
+type catalogPage struct {
+	Trees map[string]headerPage
+
+	// HashIndexes maps the name of each hash index to its directory page
+	HashIndexes map[string]int64
+
+	// RootPageId is only set in files written before the catalog existed
+	RootPageId int64
+
+	// FreePageId is the first page of the free list, the freed pages are
+	// linked through their Next field
+	FreePageId int64
+}
@@ -2,7 +2,11 @@ package index
 
 import (
 	"cmp"
+	"fmt"
 	"slices"
+
+	"github.com/jobala/petro/buffer"
+	"github.com/jobala/petro/util"
 )
 
 func (p *BplusPageHeader[K, V]) keyAt(idx int) K {
@@ -60,4 +64,64 @@ type BplusPageHeader[K cmp.Ordered, V any] struct {
 	PageType PAGE_TYPE
 	Keys     []K
 	Values   []V
+
+	// pageSize is the size of the frame the page is kept in, it isn't written
+	pageSize int
+}
+
+// readPageMeta decodes the header fields shared by leaf and internal pages.
+// Keys and values are skipped, their types differ between page kinds and gob
+// refuses to decode a page into a struct with mismatched field types.
+func readPageMeta(data []byte) (pageMetaHeader, error) {
+	meta, err := buffer.ToStruct[pageMeta](data)
+	return meta.BplusPageHeader, err
+}
+
+type pageMeta struct {
+	BplusPageHeader pageMetaHeader
+}
+
+type pageMetaHeader struct {
+	PageId   int64
+	Parent   int64
+	Next     int64
+	Prev     int64
+	Size     int32
+	MaxSize  int32
+	PageType PAGE_TYPE
+}
+
+// encodePage serializes a page. It fails with ErrPageOverflow instead of
+// returning data that copying into a frame of pageSize bytes would truncate.
+func encodePage[T any](page T, pageSize int) ([]byte, error) {
+	data, err := buffer.ToByteSlice(page)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > pageSize {
+		return nil, fmt.Errorf("%w: %T encodes to %d bytes", util.ErrPageOverflow, page, len(data))
+	}
+
+	return data, nil
+}
+
+// encodedSize is the length of v's gob encoding on its own, type information
+// included
+func encodedSize(v any) (int, error) {
+	data, err := buffer.ToByteSlice(v)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+// padSlots extends s with zero values up to n slots. Pages are written
+// without the unused slots past their size, the tree expects them back.
+func padSlots[T any](s []T, n int) []T {
+	if len(s) >= n {
+		return s
+	}
+
+	return append(s, make([]T, n-len(s))...)
 }
@@ -1,26 +1,25 @@
 package index
 
 import (
+	"bytes"
+	"cmp"
+	"context"
 	"fmt"
 	"os"
 	"path"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/jobala/petro/buffer"
 	"github.com/jobala/petro/storage/disk"
+	"github.com/jobala/petro/util"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestBPlusTree(t *testing.T) {
 	t.Run("can store and retrieve values", func(t *testing.T) {
-		file := CreateDbFile(t)
-		t.Cleanup(func() {
-			_ = os.Remove(file.Name())
-		})
-
-		bpm := createBpm(file)
-		bplus, err := NewBplusTree[string, int]("test", bpm)
-		assert.NoError(t, err)
+		bplus := newTestTree[string, int](t, "test")
 
 		register := map[string]int{
 			"john": 25,
@@ -44,14 +43,7 @@ func TestBPlusTree(t *testing.T) {
 	})
 
 	t.Run("stores values in more than a single leaf page", func(t *testing.T) {
-		file := CreateDbFile(t)
-		t.Cleanup(func() {
-			_ = os.Remove(file.Name())
-		})
-
-		bpm := createBpm(file)
-		bplus, err := NewBplusTree[int, int]("test", bpm)
-		assert.NoError(t, err)
+		bplus := newTestTree[int, int](t, "test")
 
 		for i := 100; i >= 0; i-- {
 			inserted, err := bplus.Put(i, i)
@@ -71,14 +63,7 @@ func TestBPlusTree(t *testing.T) {
 	})
 
 	t.Run("stores values in order", func(t *testing.T) {
-		file := CreateDbFile(t)
-		t.Cleanup(func() {
-			_ = os.Remove(file.Name())
-		})
-
-		bpm := createBpm(file)
-		bplus, err := NewBplusTree[int, int]("test", bpm)
-		assert.NoError(t, err)
+		bplus := newTestTree[int, int](t, "test")
 
 		// insert values in reverse order
 		for i := 100; i >= 0; i-- {
@@ -105,16 +90,103 @@ func TestBPlusTree(t *testing.T) {
 		assert.Equal(t, res, expected)
 	})
 
-	t.Run("deletions merge leaf pages", func(t *testing.T) {
+	t.Run("stores non integer values in more than a single leaf page", func(t *testing.T) {
+		bplus := newTestTree[int, string](t, "test")
+
+		for i := 300; i >= 0; i-- {
+			inserted, err := bplus.Put(i, fmt.Sprint(i))
+			assert.NoError(t, err)
+			assert.True(t, inserted)
+		}
+
+		for i := range 301 {
+			val, err := bplus.Get(i)
+			assert.NoError(t, err)
+			assert.Equal(t, fmt.Sprint(i), val[0])
+		}
+	})
+
+	t.Run("putting an existing key replaces its value", func(t *testing.T) {
+		bplus := newTestTree[int, int](t, "test")
+
+		for i := range 150 {
+			_, err := bplus.Put(i, i)
+			assert.NoError(t, err)
+		}
+
+		for i := range 150 {
+			_, err := bplus.Put(i, i*2)
+			assert.NoError(t, err)
+		}
+
+		res, err := bplus.GetKeyRange(0, 149)
+		assert.NoError(t, err)
+		assert.Equal(t, 150, len(res))
+		for i, val := range res {
+			assert.Equal(t, i*2, val)
+		}
+	})
+
+	t.Run("trees on the same bufferpool are independent", func(t *testing.T) {
+		first := newTestTree[int, int](t, "first")
+		bpm := first.bpm
+		second, err := NewBplusTree[int, int]("second", bpm)
+		assert.NoError(t, err)
+
+		for i := range 150 {
+			_, err := first.Put(i, i)
+			assert.NoError(t, err)
+			_, err = second.Put(i, -i)
+			assert.NoError(t, err)
+		}
+
+		reopened, err := NewBplusTree[int, int]("second", bpm)
+		assert.NoError(t, err)
+
+		for i := range 150 {
+			val, err := first.Get(i)
+			assert.NoError(t, err)
+			assert.Equal(t, i, val[0])
+
+			val, err = reopened.Get(i)
+			assert.NoError(t, err)
+			assert.Equal(t, -i, val[0])
+		}
+	})
+
+	t.Run("reopened trees do not overwrite pages on disk", func(t *testing.T) {
 		file := CreateDbFile(t)
 		t.Cleanup(func() {
 			_ = os.Remove(file.Name())
 		})
 
-		bpm := createBpm(file)
-		bplus, err := NewBplusTree[int, int]("test", bpm)
+		bplus, err := NewBplusTree[int, int]("test", createBpm(file))
+		assert.NoError(t, err)
+
+		for i := range 300 {
+			_, err := bplus.Put(i, i)
+			assert.NoError(t, err)
+		}
+		assert.NoError(t, bplus.Flush())
+
+		reopened, err := NewBplusTree[int, int]("test", createBpm(file))
 		assert.NoError(t, err)
 
+		for i := 300; i < 600; i++ {
+			_, err := reopened.Put(i, i)
+			assert.NoError(t, err)
+		}
+
+		for i := range 600 {
+			val, err := reopened.Get(i)
+			assert.NoError(t, err)
+			assert.Equal(t, i, val[0])
+		}
+	})
+
+	t.Run("deletions merge leaf pages", func(t *testing.T) {
+		bplus := newTestTree[int, int](t, "test")
+
 		for i := 200; i >= 0; i-- {
 			inserted, err := bplus.Put(i, i)
 			assert.NoError(t, err)
@@ -144,14 +216,7 @@ func TestBPlusTree(t *testing.T) {
 	})
 
 	t.Run("batch insert", func(t *testing.T) {
-		file := CreateDbFile(t)
-		t.Cleanup(func() {
-			_ = os.Remove(file.Name())
-		})
-
-		bpm := createBpm(file)
-		bplus, err := NewBplusTree[string, int]("test", bpm)
-		assert.NoError(t, err)
+		bplus := newTestTree[string, int](t, "test")
 
 		register := map[string]int{
 			"john": 25,
@@ -159,7 +224,7 @@ func TestBPlusTree(t *testing.T) {
 			"jane": 40,
 		}
 
-		err = bplus.PutBatch(register)
+		err := bplus.PutBatch(register)
 		assert.NoError(t, err)
 
 		for k, v := range register {
@@ -171,14 +236,7 @@ func TestBPlusTree(t *testing.T) {
 	})
 
 	t.Run("range queries", func(t *testing.T) {
-		file := CreateDbFile(t)
-		t.Cleanup(func() {
-			_ = os.Remove(file.Name())
-		})
-
-		bpm := createBpm(file)
-		bplus, err := NewBplusTree[int, int]("test", bpm)
-		assert.NoError(t, err)
+		bplus := newTestTree[int, int](t, "test")
 
 		for i := 100; i >= 0; i-- {
 			inserted, err := bplus.Put(i, i)
@@ -199,54 +257,186 @@ func TestBPlusTree(t *testing.T) {
 	})
 
 	t.Run("handles get queries on an empty store", func(t *testing.T) {
-		file := CreateDbFile(t)
-		t.Cleanup(func() {
-			_ = os.Remove(file.Name())
-		})
+		bplus := newTestTree[string, int](t, "test")
 
-		bpm := createBpm(file)
-		bplus, err := NewBplusTree[string, int]("test", bpm)
+		_, err := bplus.Get("notfound")
+		assert.NotErrorIs(t, err, fmt.Errorf("store is empty"))
+	})
+
+	t.Run("handles getting a deleted key", func(t *testing.T) {
+		bplus := newTestTree[string, int](t, "test")
+
+		_, err := bplus.Put("John", 25)
 		assert.NoError(t, err)
+		_, err = bplus.Put("Doe", 30)
+		assert.NoError(t, err)
+
+		_, err = bplus.Delete("Doe")
+		assert.NoError(t, err)
+
+		_, err = bplus.Get("Doe")
+		assert.ErrorIs(t, err, util.ErrKeyNotFound)
+	})
+
+	t.Run("internal pages borrowing from their left sibling keep their keys reachable", func(t *testing.T) {
+		bplus := newTestTree[string, int](t, "test")
+
+		// long separators keep internal pages to a few entries
+		key := func(i int) string {
+			return strings.Repeat("k", 200) + fmt.Sprintf("%06d", i)
+		}
 
-		_, err = bplus.Get("notfound")
+		// the root ends up with several internal children, the left ones are
+		// given more leaves so that the right ones borrow from them
+		keys := []int{}
+		for i := range 2000 {
+			keys = append(keys, i*4)
+		}
+		for i := range 200 {
+			keys = append(keys, i*4+1, i*4+2)
+		}
+		for _, k := range keys {
+			_, err := bplus.Put(key(k), k)
+			assert.NoError(t, err)
+		}
+
+		for k := 1999 * 4; k >= 4000; k -= 4 {
+			_, err := bplus.Delete(key(k))
+			assert.NoError(t, err)
+		}
+
+		for _, k := range keys {
+			if k >= 4000 {
+				continue
+			}
+
+			val, err := bplus.Get(key(k))
+			assert.NoError(t, err)
+			assert.Equal(t, []int{k}, val)
+		}
+	})
+
+	t.Run("internal pages are sized by bytes", func(t *testing.T) {
+		bplus := newTestTree[int, string](t, "test")
+		bpm := bplus.bpm
+
+		// small keys fit well over a hundred leaves under the root, the
+		// values keep the leaves to a few dozen entries
+		value := strings.Repeat("v", 100)
+		for i := range 4000 {
+			_, err := bplus.Put(i, value)
+			assert.NoError(t, err)
+		}
+
+		guard, err := bpm.ReadPage(bplus.header.RootPageId)
+		assert.NoError(t, err)
+		root, err := decodeInternal[int](guard.GetData())
+		guard.Drop()
+		assert.NoError(t, err)
+		assert.Greater(t, int(root.Size), 100)
+	})
+
+	t.Run("handles deleting from an empty store", func(t *testing.T) {
+		bplus := newTestTree[string, int](t, "test")
+
+		_, err := bplus.Delete("notfound")
 		assert.NotErrorIs(t, err, fmt.Errorf("store is empty"))
+
 	})
 
-	t.Run("handles getting a deleted key", func(t *testing.T) {
+	t.Run("returns disk errors", func(t *testing.T) {
 		file := CreateDbFile(t)
 		t.Cleanup(func() {
 			_ = os.Remove(file.Name())
 		})
 
-		bpm := createBpm(file)
-		bplus, err := NewBplusTree[string, int]("test", bpm)
-		assert.NoError(t, err)
+		keys := disk.StaticKeys{Current: 1, Keys: map[uint32][]byte{1: bytes.Repeat([]byte{1}, 32)}}
+		newBpm := func() *buffer.BufferpoolManager {
+			diskMgr := disk.NewManager(file, disk.WithEncryption(keys))
+			replacer := buffer.NewLrukReplacer(buffer.BUFFER_CAPACITY, 2)
+			return buffer.NewBufferpoolManager(buffer.BUFFER_CAPACITY, replacer, disk.NewScheduler(diskMgr))
+		}
 
-		_, err = bplus.Put("John", 25)
+		bplus, err := NewBplusTree[string, string]("test", newBpm())
 		assert.NoError(t, err)
-		_, err = bplus.Put("Doe", 30)
+		_, err = bplus.Put("john", "doe")
 		assert.NoError(t, err)
+		assert.NoError(t, bplus.Flush())
 
-		_, err = bplus.Delete("Doe")
+		// corrupt the root on disk and read it through a cold buffer pool
+		offset := disk.FILE_HEADER_SIZE + bplus.header.RootPageId*(disk.PAGE_SIZE+disk.ENCRYPTION_OVERHEAD) + 100
+		_, err = file.WriteAt([]byte("garbage"), offset)
 		assert.NoError(t, err)
 
-		_, err = bplus.Get("Doe")
-		assert.NotErrorIs(t, err, fmt.Errorf("key not found"))
+		bplus, err = NewBplusTree[string, string]("test", newBpm())
+		assert.NoError(t, err)
+
+		_, err = bplus.Get("john")
+		var ioErr *util.IOError
+		assert.ErrorAs(t, err, &ioErr)
+		assert.Equal(t, bplus.header.RootPageId, ioErr.PageId)
+		assert.ErrorIs(t, err, util.ErrCorruptPage)
+
+		_, err = bplus.Put("jane", "doe")
+		assert.ErrorIs(t, err, util.ErrCorruptPage)
 	})
 
-	t.Run("handles deleting from an empty store", func(t *testing.T) {
+	t.Run("close flushes the tree and releases the file", func(t *testing.T) {
 		file := CreateDbFile(t)
 		t.Cleanup(func() {
 			_ = os.Remove(file.Name())
 		})
 
-		bpm := createBpm(file)
-		bplus, err := NewBplusTree[string, int]("test", bpm)
+		bplus, err := New[string, string]("test", file)
+		assert.NoError(t, err)
+		_, err = bplus.Put("john", "doe")
 		assert.NoError(t, err)
 
-		_, err = bplus.Delete("notfound")
-		assert.NotErrorIs(t, err, fmt.Errorf("store is empty"))
+		events, err := bplus.Watch(context.Background(), "john", WatchOptions{})
+		assert.NoError(t, err)
+		bplus.StartExpirySweeper(time.Millisecond)
+
+		assert.NoError(t, bplus.Close())
+		assert.NoError(t, bplus.Close())
+
+		_, ok := <-events
+		assert.False(t, ok)
 
+		_, err = bplus.Get("john")
+		assert.ErrorIs(t, err, util.ErrClosed)
+		_, err = bplus.Put("jane", "doe")
+		assert.ErrorIs(t, err, util.ErrClosed)
+		_, err = bplus.Delete("john")
+		assert.ErrorIs(t, err, util.ErrClosed)
+		_, _, err = bplus.GetIterator().Next()
+		assert.ErrorIs(t, err, util.ErrClosed)
+		assert.ErrorIs(t, bplus.Flush(), util.ErrClosed)
+
+		_, err = file.Stat()
+		assert.ErrorIs(t, err, os.ErrClosed)
+
+		file, err = os.OpenFile(file.Name(), os.O_RDWR, 0644)
+		assert.NoError(t, err)
+
+		bplus, err = New[string, string]("test", file)
+		assert.NoError(t, err)
+		val, err := bplus.Get("john")
+		assert.NoError(t, err)
+		assert.Equal(t, "doe", val[0])
+		assert.NoError(t, bplus.Close())
+	})
+
+	t.Run("close leaves a shared buffer pool open", func(t *testing.T) {
+		first := newTestTree[string, string](t, "first")
+		bpm := first.bpm
+		second, err := NewBplusTree[string, string]("second", bpm)
+		assert.NoError(t, err)
+
+		assert.NoError(t, first.Close())
+
+		_, err = second.Put("john", "doe")
+		assert.NoError(t, err)
+		assert.NoError(t, bpm.Close())
 	})
 }
 
@@ -273,3 +463,18 @@ func CreateDbFile(t *testing.T) *os.File {
 	assert.Equal(t, int64(disk.PAGE_SIZE), fileInfo.Size())
 	return file
 }
+
+// newTestTree creates a tree called name on a new db file
+func newTestTree[K cmp.Ordered, V any](t *testing.T, name string) *bplusTree[K, V] {
+	t.Helper()
+
+	file := CreateDbFile(t)
+	t.Cleanup(func() {
+		_ = os.Remove(file.Name())
+	})
+
+	bplus, err := NewBplusTree[K, V](name, createBpm(file))
+	assert.NoError(t, err)
+
+	return bplus
+}
@@ -0,0 +1,355 @@
+package index
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"sync/atomic"
+
+	"github.com/jobala/petro/buffer"
+	"github.com/jobala/petro/storage/disk"
+)
+
+// bloomPageBytes is the number of filter bytes stored in a page of pageSize
+// bytes, the rest of the page is left for the gob encoding overhead
+func bloomPageBytes(pageSize int) int {
+	return pageSize - 128
+}
+
+// EnableBloomFilter adds a Bloom filter sized for expectedKeys keys at a false
+// positive rate of fpRate. Get consults it before descending the tree, so most
+// lookups for missing keys never read a page.
+//
+// The filter is stored in its own pages and reloaded when the tree is opened.
+// It is rebuilt from the tree's keys if its pages are missing, the tree wasn't
+// closed cleanly or it is enabled with different parameters, in which case the
+// old filter's pages are freed. Deleted keys stay in the filter, they only cost
+// a wasted read.
+//
+// A put that sets new bits re-encodes the filter pages holding them, they're
+// written out with the tree's other pages. The first put after the tree is
+// opened also flushes the buffer pool, so that the filter is marked in use on
+// disk before any key it's missing is.
+func (b *bplusTree[K, V]) EnableBloomFilter(expectedKeys int, fpRate float64) error {
+	if expectedKeys <= 0 {
+		return fmt.Errorf("expected keys must be positive, got %d", expectedKeys)
+	}
+	if fpRate <= 0 || fpRate >= 1 {
+		return fmt.Errorf("false positive rate must be between 0 and 1, got %v", fpRate)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.checkOpen(); err != nil {
+		return err
+	}
+
+	config := bloomConfig{ExpectedKeys: expectedKeys, FalsePositiveRate: fpRate}
+	if b.bloom != nil && b.header.Bloom.ExpectedKeys == expectedKeys && b.header.Bloom.FalsePositiveRate == fpRate {
+		return nil
+	}
+
+	stale := []int64{}
+	if b.bloom != nil {
+		stale = b.bloom.pageIds
+		b.bloom = nil
+	}
+
+	b.header.Bloom = config
+	if err := b.openBloomFilter(); err != nil {
+		return err
+	}
+
+	// the old pages are freed once the header points at the new filter
+	if err := freePages(b.bpm, stale); err != nil {
+		return fmt.Errorf("error freeing bloom filter: %w", err)
+	}
+
+	return nil
+}
+
+// BloomFilterStats reports how the Bloom filter has done since the tree was
+// opened
+func (b *bplusTree[K, V]) BloomFilterStats() BloomFilterStats {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.bloom == nil {
+		return BloomFilterStats{}
+	}
+
+	return BloomFilterStats{
+		Lookups:        b.bloom.lookups.Load(),
+		Skipped:        b.bloom.skipped.Load(),
+		FalsePositives: b.bloom.falsePositives.Load(),
+	}
+}
+
+// openBloomFilter loads the filter described by the tree's header and
+// rebuilds it when it can't be loaded or the tree wasn't closed cleanly. A
+// filter that's loaded stays marked clean until the tree is first written to.
+func (b *bplusTree[K, V]) openBloomFilter() error {
+	config := b.header.Bloom
+
+	filter := newBloomFilter[K](config.ExpectedKeys, config.FalsePositiveRate, b.bpm.PageSize())
+	if config.PageId != disk.INVALID_PAGE_ID {
+		err := filter.load(b.bpm, config.PageId)
+		if err == nil && config.Clean {
+			b.bloom = filter
+			return nil
+		}
+
+		if err == nil {
+			// the pages are rewritten with the rebuilt bits
+			clear(filter.bits)
+		} else {
+			filter = newBloomFilter[K](config.ExpectedKeys, config.FalsePositiveRate, b.bpm.PageSize())
+		}
+	}
+
+	if !b.isEmpty() {
+		indexIter := b.GetIterator()
+		for !indexIter.IsEnd() {
+			key, _, err := indexIter.Next()
+			if err != nil {
+				return fmt.Errorf("error rebuilding bloom filter: %w", err)
+			}
+			filter.add(key)
+		}
+	}
+
+	if err := filter.save(b.bpm); err != nil {
+		return fmt.Errorf("error saving bloom filter: %w", err)
+	}
+
+	b.bloom = filter
+	b.header.Bloom.PageId = filter.pageIds[0]
+	b.header.Bloom.Clean = false
+	return b.saveHeader()
+}
+
+// markBloomInUse clears the filter's clean flag and writes it out before the
+// first key is added, so a crash before Close leaves the filter to be rebuilt
+func (b *bplusTree[K, V]) markBloomInUse() error {
+	if b.bloom == nil || !b.header.Bloom.Clean {
+		return nil
+	}
+
+	b.header.Bloom.Clean = false
+	if err := b.saveHeader(); err != nil {
+		return err
+	}
+
+	if err := b.bpm.FlushAll(); err != nil {
+		return fmt.Errorf("error saving bloom filter: %w", err)
+	}
+
+	return nil
+}
+
+// markBloomClean sets the filter's clean flag once its pages are written,
+// only the header is left to be flushed
+func (b *bplusTree[K, V]) markBloomClean() error {
+	if err := b.bpm.FlushAll(); err != nil {
+		return fmt.Errorf("error saving bloom filter: %w", err)
+	}
+
+	b.header.Bloom.Clean = true
+	return b.saveHeader()
+}
+
+// bloomAdd adds key to the filter, if there is one, and writes the pages
+// holding its bits
+func (b *bplusTree[K, V]) bloomAdd(key K) error {
+	if b.bloom == nil {
+		return nil
+	}
+
+	for chunk := range b.bloom.add(key) {
+		if err := b.bloom.writeChunk(b.bpm, chunk); err != nil {
+			return fmt.Errorf("error saving bloom filter: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func newBloomFilter[K cmp.Ordered](expectedKeys int, fpRate float64, pageSize int) *bloomFilter[K] {
+	numBits := math.Ceil(-float64(expectedKeys) * math.Log(fpRate) / (math.Ln2 * math.Ln2))
+	numBytes := max(int(math.Ceil(numBits/8)), 1)
+	numHashes := max(int(math.Round(float64(numBytes*8)/float64(expectedKeys)*math.Ln2)), 1)
+
+	return &bloomFilter[K]{
+		bits:      make([]byte, numBytes),
+		numHashes: numHashes,
+		pageBytes: bloomPageBytes(pageSize),
+	}
+}
+
+// add sets the bits of key and returns the chunks that changed
+func (f *bloomFilter[K]) add(key K) map[int]struct{} {
+	changed := map[int]struct{}{}
+
+	h1, h2 := bloomHash(key)
+	numBits := uint64(len(f.bits)) * 8
+	for i := range uint64(f.numHashes) {
+		bit := (h1 + i*h2) % numBits
+		mask := byte(1) << (bit % 8)
+
+		if f.bits[bit/8]&mask == 0 {
+			f.bits[bit/8] |= mask
+			changed[int(bit/8)/f.pageBytes] = struct{}{}
+		}
+	}
+
+	return changed
+}
+
+// mayContain reports false if key was never added, true means key was
+// probably added
+func (f *bloomFilter[K]) mayContain(key K) bool {
+	f.lookups.Add(1)
+
+	h1, h2 := bloomHash(key)
+	numBits := uint64(len(f.bits)) * 8
+	for i := range uint64(f.numHashes) {
+		bit := (h1 + i*h2) % numBits
+		if f.bits[bit/8]&(byte(1)<<(bit%8)) == 0 {
+			f.skipped.Add(1)
+			return false
+		}
+	}
+
+	return true
+}
+
+// save writes every chunk of the filter, allocating its pages on first save
+func (f *bloomFilter[K]) save(bpm *buffer.BufferpoolManager) error {
+	numChunks := (len(f.bits) + f.pageBytes - 1) / f.pageBytes
+	if len(f.pageIds) < numChunks {
+		pageIds, err := allocPages(bpm, numChunks-len(f.pageIds))
+		if err != nil {
+			return err
+		}
+		f.pageIds = append(f.pageIds, pageIds...)
+	}
+
+	for chunk := range numChunks {
+		if err := f.writeChunk(bpm, chunk); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (f *bloomFilter[K]) writeChunk(bpm *buffer.BufferpoolManager, chunk int) error {
+	guard, err := bpm.WritePage(f.pageIds[chunk])
+	if err != nil {
+		return err
+	}
+	defer guard.Drop()
+
+	page := bloomPage{
+		Next: disk.INVALID_PAGE_ID,
+		Bits: f.bits[chunk*f.pageBytes : min((chunk+1)*f.pageBytes, len(f.bits))],
+	}
+	if chunk+1 < len(f.pageIds) {
+		page.Next = f.pageIds[chunk+1]
+	}
+
+	data, err := encodePage(page, bpm.PageSize())
+	if err != nil {
+		return err
+	}
+
+	copy(*guard.GetDataMut(), data)
+	return nil
+}
+
+// load reads the filter's bits from the page chain starting at pageId. It
+// fails if the chain doesn't hold exactly the filter's bits.
+func (f *bloomFilter[K]) load(bpm *buffer.BufferpoolManager, pageId int64) error {
+	bits := make([]byte, 0, len(f.bits))
+	pageIds := []int64{}
+
+	for pageId != disk.INVALID_PAGE_ID && len(bits) < len(f.bits) {
+		guard, err := bpm.ReadPage(pageId)
+		if err != nil {
+			return err
+		}
+
+		page, err := buffer.ToStruct[bloomPage](guard.GetData())
+		guard.Drop()
+		if err != nil {
+			return err
+		}
+		if len(page.Bits) == 0 {
+			return fmt.Errorf("bloom page %d is missing", pageId)
+		}
+
+		bits = append(bits, page.Bits...)
+		pageIds = append(pageIds, pageId)
+		pageId = page.Next
+	}
+
+	if len(bits) != len(f.bits) {
+		return fmt.Errorf("bloom filter has %d bytes, expected %d", len(bits), len(f.bits))
+	}
+
+	f.bits = bits
+	f.pageIds = pageIds
+	return nil
+}
+
+// bloomHash returns the two hashes used to derive a key's bit positions
+func bloomHash[K cmp.Ordered](key K) (uint64, uint64) {
+	sum := hashKey(key)
+
+	// the step is made odd so it is never zero
+	return sum & math.MaxUint32, sum>>32 | 1
+}
+
+type bloomFilter[K cmp.Ordered] struct {
+	bits      []byte
+	numHashes int
+	pageIds   []int64
+
+	// pageBytes is the number of filter bytes each page holds
+	pageBytes int
+
+	lookups        atomic.Int64
+	skipped        atomic.Int64
+	falsePositives atomic.Int64
+}
+
+type bloomPage struct {
+	Next int64
+	Bits []byte
+}
+
+// bloomConfig is kept in the tree's header, a zero ExpectedKeys means the
+// tree has no filter
+type bloomConfig struct {
+	PageId            int64
+	ExpectedKeys      int
+	FalsePositiveRate float64
+
+	// Clean is set when the tree is closed and cleared when it's opened, a
+	// filter found without it may have missed keys and is rebuilt
+	Clean bool
+}
+
+type BloomFilterStats struct {
+	// Lookups is the number of lookups that consulted the filter
+	Lookups int64
+
+	// Skipped is the number of lookups the filter answered without reading a
+	// page
+	Skipped int64
+
+	// FalsePositives is the number of lookups the filter let through for keys
+	// that were not in the tree
+	FalsePositives int64
+}
@@ -0,0 +1,212 @@
+package index
+
+import (
+	"os"
+	"testing"
+
+	"github.com/jobala/petro/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBloomFilter(t *testing.T) {
+	t.Run("skips reads for missing keys", func(t *testing.T) {
+		bplus := newTestTree[int, int](t, "test")
+
+		err := bplus.EnableBloomFilter(1000, 0.01)
+		assert.NoError(t, err)
+
+		for i := range 1000 {
+			_, err := bplus.Put(i, i)
+			assert.NoError(t, err)
+		}
+
+		for i := range 1000 {
+			val, err := bplus.Get(i)
+			assert.NoError(t, err)
+			assert.Equal(t, i, val[0])
+		}
+
+		for i := 1000; i < 2000; i++ {
+			_, err := bplus.Get(i)
+			assert.ErrorIs(t, err, util.ErrKeyNotFound)
+		}
+
+		stats := bplus.BloomFilterStats()
+		assert.Equal(t, int64(2000), stats.Lookups)
+		assert.Equal(t, int64(1000), stats.Skipped+stats.FalsePositives)
+		assert.Less(t, stats.FalsePositives, int64(50))
+	})
+
+	t.Run("is built from existing keys", func(t *testing.T) {
+		bplus := newTestTree[string, int](t, "test")
+
+		_, err := bplus.Put("john", 25)
+		assert.NoError(t, err)
+
+		err = bplus.EnableBloomFilter(100, 0.01)
+		assert.NoError(t, err)
+
+		_, err = bplus.Get("john")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(0), bplus.BloomFilterStats().Skipped)
+	})
+
+	t.Run("is reloaded when the tree is opened", func(t *testing.T) {
+		file := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(file.Name())
+		})
+
+		bpm := createBpm(file)
+		bplus, err := NewBplusTree[int, int]("test", bpm)
+		assert.NoError(t, err)
+
+		// spans several pages
+		err = bplus.EnableBloomFilter(10000, 0.01)
+		assert.NoError(t, err)
+		assert.Greater(t, len(bplus.bloom.pageIds), 1)
+
+		for i := range 500 {
+			_, err := bplus.Put(i, i)
+			assert.NoError(t, err)
+		}
+		assert.NoError(t, bplus.Close())
+
+		reopened, err := NewBplusTree[int, int]("test", createBpm(file))
+		assert.NoError(t, err)
+		assert.NotNil(t, reopened.bloom)
+		assert.Equal(t, bplus.bloom.pageIds, reopened.bloom.pageIds)
+		assert.Equal(t, bplus.bloom.bits, reopened.bloom.bits)
+
+		for i := range 500 {
+			val, err := reopened.Get(i)
+			assert.NoError(t, err)
+			assert.Equal(t, i, val[0])
+		}
+	})
+
+	t.Run("is marked in use on the first write", func(t *testing.T) {
+		bplus := newTestTree[int, int](t, "test")
+		bpm := bplus.bpm
+
+		err := bplus.EnableBloomFilter(1000, 0.01)
+		assert.NoError(t, err)
+		for i := range 100 {
+			_, err := bplus.Put(i, i)
+			assert.NoError(t, err)
+		}
+		assert.NoError(t, bplus.Close())
+
+		clean := func() bool {
+			catalog, err := readCatalog(bpm)
+			assert.NoError(t, err)
+			return catalog.Trees["test"].Bloom.Clean
+		}
+
+		// opening and reading leave the filter clean
+		reopened, err := NewBplusTree[int, int]("test", bpm)
+		assert.NoError(t, err)
+		_, err = reopened.Get(1)
+		assert.NoError(t, err)
+		assert.True(t, clean())
+
+		_, err = reopened.Put(100, 100)
+		assert.NoError(t, err)
+		assert.False(t, clean())
+
+		assert.NoError(t, reopened.Close())
+		assert.True(t, clean())
+	})
+
+	t.Run("is rebuilt when its pages are missing", func(t *testing.T) {
+		bplus := newTestTree[int, int](t, "test")
+		bpm := bplus.bpm
+
+		err := bplus.EnableBloomFilter(1000, 0.01)
+		assert.NoError(t, err)
+
+		for i := range 500 {
+			_, err := bplus.Put(i, i)
+			assert.NoError(t, err)
+		}
+
+		// wipe the filter's first page
+		guard, err := bpm.WritePage(bplus.header.Bloom.PageId)
+		assert.NoError(t, err)
+		clear(*guard.GetDataMut())
+		guard.Drop()
+
+		reopened, err := NewBplusTree[int, int]("test", bpm)
+		assert.NoError(t, err)
+		assert.NotEqual(t, bplus.header.Bloom.PageId, reopened.header.Bloom.PageId)
+
+		for i := range 500 {
+			val, err := reopened.Get(i)
+			assert.NoError(t, err)
+			assert.Equal(t, i, val[0])
+		}
+		assert.Equal(t, int64(0), reopened.BloomFilterStats().Skipped)
+	})
+
+	t.Run("is rebuilt when the tree wasn't closed", func(t *testing.T) {
+		file := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(file.Name())
+		})
+
+		bpm := createBpm(file)
+		bplus, err := NewBplusTree[int, int]("test", bpm)
+		assert.NoError(t, err)
+
+		err = bplus.EnableBloomFilter(1000, 0.01)
+		assert.NoError(t, err)
+
+		for i := range 500 {
+			_, err := bplus.Put(i, i)
+			assert.NoError(t, err)
+		}
+
+		// the filter's bits were lost while the tree's pages were written
+		err = bplus.bloom.load(bpm, bplus.header.Bloom.PageId)
+		assert.NoError(t, err)
+		clear(bplus.bloom.bits)
+		assert.NoError(t, bplus.bloom.save(bpm))
+		assert.NoError(t, bplus.Flush())
+
+		reopened, err := NewBplusTree[int, int]("test", createBpm(file))
+		assert.NoError(t, err)
+		assert.False(t, reopened.header.Bloom.Clean)
+
+		for i := range 500 {
+			val, err := reopened.Get(i)
+			assert.NoError(t, err)
+			assert.Equal(t, i, val[0])
+		}
+		assert.Equal(t, int64(0), reopened.BloomFilterStats().Skipped)
+	})
+
+	t.Run("frees its pages when enabled with new parameters", func(t *testing.T) {
+		bplus := newTestTree[int, int](t, "test")
+		bpm := bplus.bpm
+
+		err := bplus.EnableBloomFilter(10000, 0.01)
+		assert.NoError(t, err)
+		stale := bplus.bloom.pageIds
+
+		err = bplus.EnableBloomFilter(20000, 0.01)
+		assert.NoError(t, err)
+		assert.NotContains(t, bplus.bloom.pageIds, stale[0])
+
+		pageIds, err := allocPages(bpm, len(stale))
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, stale, pageIds)
+	})
+
+	t.Run("rejects invalid parameters", func(t *testing.T) {
+		bplus := newTestTree[int, int](t, "test")
+
+		assert.Error(t, bplus.EnableBloomFilter(0, 0.01))
+		assert.Error(t, bplus.EnableBloomFilter(100, 0))
+		assert.Error(t, bplus.EnableBloomFilter(100, 1))
+	})
+}
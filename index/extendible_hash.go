@@ -0,0 +1,673 @@
+package index
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"sync"
+
+	"github.com/jobala/petro/buffer"
+	"github.com/jobala/petro/util"
+)
+
+const (
+	// DIR_SLOTS_PER_PAGE is the number of directory slots stored in a page
+	DIR_SLOTS_PER_PAGE = 256
+
+	// MAX_GLOBAL_DEPTH bounds the directory to 256 pages, as many as the
+	// directory's header page can address
+	MAX_GLOBAL_DEPTH = 16
+)
+
+// NewExtendibleHash opens the hash index called name on bpm, creating it if
+// it doesn't exist.
+//
+// The index keeps a directory that maps the low GlobalDepth bits of a key's
+// hash to a bucket page, spread over pages of DIR_SLOTS_PER_PAGE slots that
+// are listed in a header page. A bucket that has no room for an entry is split
+// in two, doubling the directory when the bucket is already addressed by every
+// directory bit, and an emptied bucket is merged back into its split image and
+// freed. Unlike bplusTree it keeps no order between keys, lookups read the
+// header, a directory page and a single bucket.
+//
+// Entries are never moved to overflow pages, so keys and values are limited to
+// what fits in a bucket, see SetSizeLimits.
+func NewExtendibleHash[K cmp.Ordered, V any](name string, bpm *buffer.BufferpoolManager) (*extendibleHash[K, V], error) {
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+
+	catalog, err := readCatalog(bpm)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &extendibleHash[K, V]{
+		indexName: name,
+		bpm:       bpm,
+		limits:    defaultHashSizeLimits(bpm.PageSize()),
+	}
+
+	if dirPageId, ok := catalog.HashIndexes[name]; ok {
+		h.dirPageId = dirPageId
+		return h, nil
+	}
+
+	if err := h.create(); err != nil {
+		return nil, fmt.Errorf("error creating hash index %s: %w", name, err)
+	}
+
+	return h, nil
+}
+
+func (h *extendibleHash[K, V]) Get(key K) ([]V, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if h.closed {
+		return nil, fmt.Errorf("%w: %s", util.ErrClosed, h.indexName)
+	}
+
+	bucketId, err := h.bucketOf(hashKey(key))
+	if err != nil {
+		return nil, err
+	}
+
+	guard, err := h.bpm.ReadPage(bucketId)
+	if err != nil {
+		return nil, err
+	}
+	defer guard.Drop()
+
+	bucket, err := buffer.ToStruct[hashBucketPage[K, V]](guard.GetData())
+	if err != nil {
+		return nil, err
+	}
+
+	idx, ok := bucket.find(key)
+	if !ok {
+		return nil, fmt.Errorf("%w: %v", util.ErrKeyNotFound, key)
+	}
+
+	return []V{bucket.Values[idx]}, nil
+}
+
+// Put inserts key or replaces its value if it already exists. Entries over the
+// index's size limits are refused with ErrKeyTooLarge or ErrValueTooLarge.
+func (h *extendibleHash[K, V]) Put(key K, value V) (bool, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return false, fmt.Errorf("%w: %s", util.ErrClosed, h.indexName)
+	}
+
+	if _, err := h.limits.check(key, value); err != nil {
+		return false, err
+	}
+
+	hash := hashKey(key)
+	for {
+		bucketId, err := h.bucketOf(hash)
+		if err != nil {
+			return false, err
+		}
+
+		guard, err := h.bpm.WritePage(bucketId)
+		if err != nil {
+			return false, err
+		}
+
+		bucket, err := buffer.ToStruct[hashBucketPage[K, V]](*guard.GetDataMut())
+		if err != nil {
+			guard.Drop()
+			return false, err
+		}
+
+		kept := bucket.clone()
+		if idx, ok := bucket.find(key); ok {
+			bucket.Values[idx] = value
+		} else {
+			bucket.Keys = append(bucket.Keys, key)
+			bucket.Values = append(bucket.Values, value)
+		}
+
+		err = writeHashPage(guard, bucket)
+		guard.Drop()
+		if !errors.Is(err, util.ErrPageOverflow) {
+			return err == nil, err
+		}
+
+		// the bucket has no room for the entry, split it and try again.
+		// Every key may land in the same half, so several splits can be
+		// needed.
+		if err := h.split(hash, bucketId, kept); err != nil {
+			return false, err
+		}
+	}
+}
+
+func (h *extendibleHash[K, V]) Delete(key K) (bool, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return false, fmt.Errorf("%w: %s", util.ErrClosed, h.indexName)
+	}
+
+	hash := hashKey(key)
+	bucketId, err := h.bucketOf(hash)
+	if err != nil {
+		return false, err
+	}
+
+	guard, err := h.bpm.WritePage(bucketId)
+	if err != nil {
+		return false, err
+	}
+
+	bucket, err := buffer.ToStruct[hashBucketPage[K, V]](*guard.GetDataMut())
+	if err != nil {
+		guard.Drop()
+		return false, err
+	}
+
+	idx, ok := bucket.find(key)
+	if !ok {
+		guard.Drop()
+		return false, fmt.Errorf("%w: %v", util.ErrKeyNotFound, key)
+	}
+
+	bucket.Keys = slices.Delete(bucket.Keys, idx, idx+1)
+	bucket.Values = slices.Delete(bucket.Values, idx, idx+1)
+	err = writeHashPage(guard, bucket)
+	guard.Drop()
+	if err != nil {
+		return false, err
+	}
+
+	if len(bucket.Keys) == 0 {
+		if err := h.merge(hash); err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// SetSizeLimits changes the limits Put enforces. A key of MaxKeySize and a
+// value of MaxValueSize have to fit in MaxEntrySize together, so that a
+// bucket always holds several entries. Entries stored under earlier limits
+// are kept.
+func (h *extendibleHash[K, V]) SetSizeLimits(limits SizeLimits) error {
+	if limits.MaxKeySize <= 0 || limits.MaxValueSize <= 0 {
+		return fmt.Errorf("size limits must be positive, got %+v", limits)
+	}
+	if maxEntry := MaxEntrySize(h.bpm.PageSize()); limits.MaxKeySize+limits.MaxValueSize > maxEntry {
+		return fmt.Errorf("entries can take at most %d bytes, got %d", maxEntry, limits.MaxKeySize+limits.MaxValueSize)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.limits = limits
+	return nil
+}
+
+// create allocates the directory with a single empty bucket and registers
+// the index in the catalog
+func (h *extendibleHash[K, V]) create() error {
+	pageIds, err := allocPages(h.bpm, 2)
+	if err != nil {
+		return err
+	}
+	h.dirPageId, pageIds = pageIds[0], pageIds[1:]
+	bucketId := pageIds[0]
+
+	if err := h.writeBucket(bucketId, hashBucketPage[K, V]{}); err != nil {
+		return err
+	}
+
+	dir := hashDirectory{
+		LocalDepths:   []uint8{0},
+		BucketPageIds: []int64{bucketId},
+	}
+	if err := h.writeDirectory(hashHeaderPage{}, dir); err != nil {
+		return err
+	}
+
+	return updateCatalog(h.bpm, func(catalog *catalogPage) error {
+		if catalog.HashIndexes == nil {
+			catalog.HashIndexes = map[string]int64{}
+		}
+		catalog.HashIndexes[h.indexName] = h.dirPageId
+		return nil
+	})
+}
+
+// split moves the entries of bucket, stored at bucketId, whose hash has the
+// bucket's next bit set into a new bucket. hash is the hash of the key being
+// inserted.
+func (h *extendibleHash[K, V]) split(hash uint64, bucketId int64, bucket hashBucketPage[K, V]) error {
+	header, err := h.readHeader()
+	if err != nil {
+		return err
+	}
+
+	dir, err := h.loadDirectory(header)
+	if err != nil {
+		return err
+	}
+
+	slot := dir.slotOf(hash)
+	localDepth := dir.LocalDepths[slot]
+
+	if localDepth == dir.GlobalDepth {
+		if dir.GlobalDepth == MAX_GLOBAL_DEPTH {
+			return fmt.Errorf("hash index %s is full", h.indexName)
+		}
+		dir.grow()
+	}
+
+	pageIds, err := allocPages(h.bpm, 1)
+	if err != nil {
+		return err
+	}
+	imageId := pageIds[0]
+	highBit := uint64(1) << localDepth
+
+	image := hashBucketPage[K, V]{}
+	kept := hashBucketPage[K, V]{}
+	for i, key := range bucket.Keys {
+		if hashKey(key)&highBit != 0 {
+			image.Keys = append(image.Keys, key)
+			image.Values = append(image.Values, bucket.Values[i])
+		} else {
+			kept.Keys = append(kept.Keys, key)
+			kept.Values = append(kept.Values, bucket.Values[i])
+		}
+	}
+
+	if err := h.writeBucket(imageId, image); err != nil {
+		return err
+	}
+	if err := h.writeBucket(bucketId, kept); err != nil {
+		return err
+	}
+
+	for i, id := range dir.BucketPageIds {
+		if id != bucketId {
+			continue
+		}
+
+		dir.LocalDepths[i] = localDepth + 1
+		if uint64(i)&highBit != 0 {
+			dir.BucketPageIds[i] = imageId
+		}
+	}
+
+	return h.writeDirectory(header, dir)
+}
+
+// merge folds the emptied bucket addressed by hash into its split image. The
+// merged bucket is folded into its own image in turn while either of them is
+// empty, which also merges empty buckets whose image had been split further.
+// The directory is then shrunk and the emptied buckets' pages freed.
+func (h *extendibleHash[K, V]) merge(hash uint64) error {
+	header, err := h.readHeader()
+	if err != nil {
+		return err
+	}
+
+	dir, err := h.loadDirectory(header)
+	if err != nil {
+		return err
+	}
+
+	freed := []int64{}
+	for {
+		slot := dir.slotOf(hash)
+		imageSlot, ok := dir.imageOf(slot)
+		if !ok {
+			break
+		}
+
+		empty, err := h.isEmpty(dir.BucketPageIds[slot])
+		if err != nil {
+			return err
+		}
+		if !empty {
+			slot = imageSlot
+			if empty, err = h.isEmpty(dir.BucketPageIds[slot]); err != nil {
+				return err
+			}
+		}
+		if !empty {
+			break
+		}
+
+		freed = append(freed, dir.BucketPageIds[slot])
+		dir.merge(slot)
+	}
+
+	if len(freed) == 0 {
+		return nil
+	}
+	dir.shrink()
+
+	if err := h.writeDirectory(header, dir); err != nil {
+		return err
+	}
+
+	// the buckets are freed once the directory no longer points at them
+	return freePages(h.bpm, freed)
+}
+
+func (h *extendibleHash[K, V]) isEmpty(bucketId int64) (bool, error) {
+	guard, err := h.bpm.ReadPage(bucketId)
+	if err != nil {
+		return false, err
+	}
+	defer guard.Drop()
+
+	bucket, err := buffer.ToStruct[hashBucketPage[K, V]](guard.GetData())
+	if err != nil {
+		return false, err
+	}
+
+	return len(bucket.Keys) == 0, nil
+}
+
+func (h *extendibleHash[K, V]) writeBucket(pageId int64, bucket hashBucketPage[K, V]) error {
+	guard, err := h.bpm.WritePage(pageId)
+	if err != nil {
+		return err
+	}
+	defer guard.Drop()
+
+	return writeHashPage(guard, bucket)
+}
+
+// bucketOf returns the bucket addressed by hash, reading only the directory
+// page holding its slot
+func (h *extendibleHash[K, V]) bucketOf(hash uint64) (int64, error) {
+	header, err := h.readHeader()
+	if err != nil {
+		return 0, err
+	}
+
+	slot := int(hash & (uint64(1)<<header.GlobalDepth - 1))
+	guard, err := h.bpm.ReadPage(header.DirPageIds[slot/DIR_SLOTS_PER_PAGE])
+	if err != nil {
+		return 0, err
+	}
+	defer guard.Drop()
+
+	page, err := buffer.ToStruct[hashDirectoryPage](guard.GetData())
+	if err != nil {
+		return 0, err
+	}
+
+	return page.BucketPageIds[slot%DIR_SLOTS_PER_PAGE], nil
+}
+
+func (h *extendibleHash[K, V]) readHeader() (hashHeaderPage, error) {
+	guard, err := h.bpm.ReadPage(h.dirPageId)
+	if err != nil {
+		return hashHeaderPage{}, err
+	}
+	defer guard.Drop()
+
+	return buffer.ToStruct[hashHeaderPage](guard.GetData())
+}
+
+func (h *extendibleHash[K, V]) readDirectory() (hashDirectory, error) {
+	header, err := h.readHeader()
+	if err != nil {
+		return hashDirectory{}, err
+	}
+
+	return h.loadDirectory(header)
+}
+
+// loadDirectory reads every directory page listed in header
+func (h *extendibleHash[K, V]) loadDirectory(header hashHeaderPage) (hashDirectory, error) {
+	dir := hashDirectory{GlobalDepth: header.GlobalDepth}
+	for _, pageId := range header.DirPageIds {
+		guard, err := h.bpm.ReadPage(pageId)
+		if err != nil {
+			return hashDirectory{}, err
+		}
+
+		page, err := buffer.ToStruct[hashDirectoryPage](guard.GetData())
+		guard.Drop()
+		if err != nil {
+			return hashDirectory{}, err
+		}
+
+		dir.LocalDepths = append(dir.LocalDepths, page.LocalDepths...)
+		dir.BucketPageIds = append(dir.BucketPageIds, page.BucketPageIds...)
+	}
+
+	return dir, nil
+}
+
+// writeDirectory writes dir over the directory pages listed in header,
+// allocating pages when it grew and freeing them when it shrank
+func (h *extendibleHash[K, V]) writeDirectory(header hashHeaderPage, dir hashDirectory) error {
+	numPages := (len(dir.BucketPageIds) + DIR_SLOTS_PER_PAGE - 1) / DIR_SLOTS_PER_PAGE
+	pageIds := header.DirPageIds
+	stale := []int64{}
+
+	if len(pageIds) < numPages {
+		allocated, err := allocPages(h.bpm, numPages-len(pageIds))
+		if err != nil {
+			return err
+		}
+		pageIds = append(slices.Clone(pageIds), allocated...)
+	} else {
+		pageIds, stale = pageIds[:numPages], pageIds[numPages:]
+	}
+
+	for i, pageId := range pageIds {
+		start := i * DIR_SLOTS_PER_PAGE
+		end := min(start+DIR_SLOTS_PER_PAGE, len(dir.BucketPageIds))
+
+		guard, err := h.bpm.WritePage(pageId)
+		if err != nil {
+			return err
+		}
+		err = writeHashPage(guard, hashDirectoryPage{
+			LocalDepths:   dir.LocalDepths[start:end],
+			BucketPageIds: dir.BucketPageIds[start:end],
+		})
+		guard.Drop()
+		if err != nil {
+			return err
+		}
+	}
+
+	guard, err := h.bpm.WritePage(h.dirPageId)
+	if err != nil {
+		return err
+	}
+	err = writeHashPage(guard, hashHeaderPage{GlobalDepth: dir.GlobalDepth, DirPageIds: pageIds})
+	guard.Drop()
+	if err != nil {
+		return err
+	}
+
+	return freePages(h.bpm, stale)
+}
+
+func (h *extendibleHash[K, V]) Flush() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return fmt.Errorf("%w: %s", util.ErrClosed, h.indexName)
+	}
+
+	if err := h.bpm.FlushAll(); err != nil {
+		return fmt.Errorf("error flushing %s: %w", h.indexName, err)
+	}
+
+	return nil
+}
+
+// Close flushes the index, the buffer pool is closed as well when the index
+// was opened with NewHash. Later calls return ErrClosed.
+func (h *extendibleHash[K, V]) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return nil
+	}
+	h.closed = true
+
+	if h.ownsBpm {
+		return h.bpm.Close()
+	}
+
+	return h.bpm.FlushAll()
+}
+
+// slotOf returns the directory slot addressed by the low GlobalDepth bits of
+// hash
+func (d *hashDirectory) slotOf(hash uint64) int {
+	return int(hash & (uint64(1)<<d.GlobalDepth - 1))
+}
+
+// grow doubles the directory, the new half points at the same buckets as the
+// old one
+func (d *hashDirectory) grow() {
+	d.BucketPageIds = append(d.BucketPageIds, d.BucketPageIds...)
+	d.LocalDepths = append(d.LocalDepths, d.LocalDepths...)
+	d.GlobalDepth++
+}
+
+// imageOf returns a slot of the split image of the bucket at slot, if the
+// image has the bucket's local depth
+func (d *hashDirectory) imageOf(slot int) (int, bool) {
+	localDepth := d.LocalDepths[slot]
+	if localDepth == 0 {
+		return 0, false
+	}
+
+	imageSlot := slot ^ (1 << (localDepth - 1))
+	return imageSlot, d.LocalDepths[imageSlot] == localDepth
+}
+
+// merge points the slots of the bucket at slot to its split image when both
+// have the same local depth. It reports whether the directory changed.
+func (d *hashDirectory) merge(slot int) bool {
+	imageSlot, ok := d.imageOf(slot)
+	if !ok {
+		return false
+	}
+
+	localDepth := d.LocalDepths[slot]
+	bucketId := d.BucketPageIds[slot]
+	imageId := d.BucketPageIds[imageSlot]
+	for i, id := range d.BucketPageIds {
+		if id == bucketId || id == imageId {
+			d.BucketPageIds[i] = imageId
+			d.LocalDepths[i] = localDepth - 1
+		}
+	}
+
+	return true
+}
+
+// shrink halves the directory while no bucket needs all of its bits
+func (d *hashDirectory) shrink() {
+	for d.GlobalDepth > 0 && slices.Max(d.LocalDepths) < d.GlobalDepth {
+		half := len(d.BucketPageIds) / 2
+		d.BucketPageIds = d.BucketPageIds[:half]
+		d.LocalDepths = d.LocalDepths[:half]
+		d.GlobalDepth--
+	}
+}
+
+func (b *hashBucketPage[K, V]) clone() hashBucketPage[K, V] {
+	return hashBucketPage[K, V]{
+		Keys:   slices.Clone(b.Keys),
+		Values: slices.Clone(b.Values),
+	}
+}
+
+func (b *hashBucketPage[K, V]) find(key K) (int, bool) {
+	idx := slices.Index(b.Keys, key)
+	return idx, idx != -1
+}
+
+func writeHashPage[T any](guard *buffer.WritePageGuard, page T) error {
+	data, err := encodePage(page, len(*guard.GetDataMut()))
+	if err != nil {
+		return err
+	}
+
+	copy(*guard.GetDataMut(), data)
+	return nil
+}
+
+// hashKey hashes the binary encoding of key, equal keys such as -0.0 and 0.0
+// hash the same
+func hashKey[K cmp.Ordered](key K) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(appendKey(nil, key))
+	return h.Sum64()
+}
+
+// defaultHashSizeLimits leaves room for a value next to a key of the default
+// size in the entries of pages of pageSize bytes
+func defaultHashSizeLimits(pageSize int) SizeLimits {
+	return SizeLimits{
+		MaxKeySize:   DEFAULT_MAX_KEY_SIZE,
+		MaxValueSize: MaxEntrySize(pageSize) - DEFAULT_MAX_KEY_SIZE,
+	}
+}
+
+type extendibleHash[K cmp.Ordered, V any] struct {
+	mu        sync.RWMutex
+	bpm       *buffer.BufferpoolManager
+	indexName string
+	limits    SizeLimits
+
+	// dirPageId is the directory's header page
+	dirPageId int64
+
+	// ownsBpm is set when the buffer pool was created for the index
+	ownsBpm bool
+	closed  bool
+}
+
+// hashHeaderPage lists the directory's pages in slot order
+type hashHeaderPage struct {
+	GlobalDepth uint8
+	DirPageIds  []int64
+}
+
+// hashDirectoryPage holds DIR_SLOTS_PER_PAGE consecutive directory slots, the
+// last page can hold fewer
+type hashDirectoryPage struct {
+	LocalDepths   []uint8
+	BucketPageIds []int64
+}
+
+// hashDirectory is the whole directory as read from its pages
+type hashDirectory struct {
+	GlobalDepth uint8
+
+	// slot i holds the bucket of keys whose hash ends in the bits of i
+	LocalDepths   []uint8
+	BucketPageIds []int64
+}
+
+type hashBucketPage[K cmp.Ordered, V any] struct {
+	Keys   []K
+	Values []V
+}
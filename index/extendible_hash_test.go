@@ -0,0 +1,331 @@
+package index
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/jobala/petro/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtendibleHash(t *testing.T) {
+	t.Run("can store and retrieve values", func(t *testing.T) {
+		file := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(file.Name())
+		})
+
+		bpm := createBpm(file)
+		hash, err := NewExtendibleHash[string, int]("test", bpm)
+		assert.NoError(t, err)
+
+		register := map[string]int{
+			"john": 25,
+			"doe":  45,
+			"jane": 40,
+		}
+
+		for k, v := range register {
+			inserted, err := hash.Put(k, v)
+			assert.NoError(t, err)
+			assert.True(t, inserted)
+		}
+
+		for k, v := range register {
+			val, err := hash.Get(k)
+			assert.NoError(t, err)
+			assert.Equal(t, v, val[0])
+		}
+
+		_, err = hash.Get("notfound")
+		assert.ErrorIs(t, err, util.ErrKeyNotFound)
+	})
+
+	t.Run("splits buckets and doubles the directory", func(t *testing.T) {
+		file := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(file.Name())
+		})
+
+		bpm := createBpm(file)
+		hash, err := NewExtendibleHash[int, string]("test", bpm)
+		assert.NoError(t, err)
+
+		for i := range 5000 {
+			_, err := hash.Put(i, fmt.Sprint(i))
+			assert.NoError(t, err)
+		}
+
+		dir, err := hash.readDirectory()
+		assert.NoError(t, err)
+		assert.Greater(t, dir.GlobalDepth, uint8(2))
+		assert.Equal(t, 1<<dir.GlobalDepth, len(dir.BucketPageIds))
+
+		for i := range 5000 {
+			val, err := hash.Get(i)
+			assert.NoError(t, err)
+			assert.Equal(t, fmt.Sprint(i), val[0])
+		}
+	})
+
+	t.Run("putting an existing key replaces its value", func(t *testing.T) {
+		file := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(file.Name())
+		})
+
+		bpm := createBpm(file)
+		hash, err := NewExtendibleHash[int, int]("test", bpm)
+		assert.NoError(t, err)
+
+		for i := range 300 {
+			_, err := hash.Put(i, i)
+			assert.NoError(t, err)
+		}
+
+		for i := range 300 {
+			_, err := hash.Put(i, i*2)
+			assert.NoError(t, err)
+		}
+
+		for i := range 300 {
+			val, err := hash.Get(i)
+			assert.NoError(t, err)
+			assert.Equal(t, i*2, val[0])
+		}
+	})
+
+	t.Run("deletions merge buckets and shrink the directory", func(t *testing.T) {
+		file := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(file.Name())
+		})
+
+		bpm := createBpm(file)
+		hash, err := NewExtendibleHash[int, int]("test", bpm)
+		assert.NoError(t, err)
+
+		for i := range 1000 {
+			_, err := hash.Put(i, i)
+			assert.NoError(t, err)
+		}
+
+		for i := range 1000 {
+			if i%10 == 0 {
+				continue
+			}
+
+			ok, err := hash.Delete(i)
+			assert.NoError(t, err)
+			assert.True(t, ok)
+		}
+
+		_, err = hash.Delete(1)
+		assert.ErrorIs(t, err, util.ErrKeyNotFound)
+
+		for i := range 1000 {
+			val, err := hash.Get(i)
+			if i%10 == 0 {
+				assert.NoError(t, err)
+				assert.Equal(t, i, val[0])
+			} else {
+				assert.ErrorIs(t, err, util.ErrKeyNotFound)
+			}
+		}
+
+		for i := 0; i < 1000; i += 10 {
+			_, err := hash.Delete(i)
+			assert.NoError(t, err)
+		}
+
+		dir, err := hash.readDirectory()
+		assert.NoError(t, err)
+		assert.Less(t, dir.GlobalDepth, uint8(4))
+	})
+
+	t.Run("is registered in the catalog", func(t *testing.T) {
+		file := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(file.Name())
+		})
+
+		bpm := createBpm(file)
+		hash, err := NewExtendibleHash[int, int]("test", bpm)
+		assert.NoError(t, err)
+		tree, err := NewBplusTree[int, int]("test", bpm)
+		assert.NoError(t, err)
+
+		for i := range 300 {
+			_, err := hash.Put(i, i)
+			assert.NoError(t, err)
+			_, err = tree.Put(i, -i)
+			assert.NoError(t, err)
+		}
+		assert.NoError(t, hash.Flush())
+
+		reopened, err := NewExtendibleHash[int, int]("test", createBpm(file))
+		assert.NoError(t, err)
+		assert.Equal(t, hash.dirPageId, reopened.dirPageId)
+
+		for i := range 300 {
+			val, err := reopened.Get(i)
+			assert.NoError(t, err)
+			assert.Equal(t, i, val[0])
+		}
+	})
+
+	t.Run("close flushes the index and releases the file", func(t *testing.T) {
+		file := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(file.Name())
+		})
+
+		hash, err := NewHash[string, int]("test", file)
+		assert.NoError(t, err)
+		_, err = hash.Put("john", 30)
+		assert.NoError(t, err)
+
+		assert.NoError(t, hash.Close())
+
+		_, err = hash.Get("john")
+		assert.ErrorIs(t, err, util.ErrClosed)
+		_, err = hash.Put("jane", 20)
+		assert.ErrorIs(t, err, util.ErrClosed)
+
+		file, err = os.OpenFile(file.Name(), os.O_RDWR, 0644)
+		assert.NoError(t, err)
+
+		hash, err = NewHash[string, int]("test", file)
+		assert.NoError(t, err)
+		val, err := hash.Get("john")
+		assert.NoError(t, err)
+		assert.Equal(t, 30, val[0])
+		assert.NoError(t, hash.Close())
+	})
+
+	t.Run("spreads a large directory over several pages", func(t *testing.T) {
+		file := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(file.Name())
+		})
+
+		bpm := createBpm(file)
+		hash, err := NewExtendibleHash[int, string]("test", bpm)
+		assert.NoError(t, err)
+
+		value := strings.Repeat("x", 400)
+		for i := range 2500 {
+			_, err := hash.Put(i, value)
+			assert.NoError(t, err)
+		}
+
+		header, err := hash.readHeader()
+		assert.NoError(t, err)
+		assert.Greater(t, len(header.DirPageIds), 1)
+
+		for i := range 2500 {
+			val, err := hash.Get(i)
+			assert.NoError(t, err)
+			assert.Equal(t, value, val[0])
+		}
+
+		// emptying the index frees every bucket but one and the directory
+		// pages past the first
+		for i := range 2500 {
+			_, err := hash.Delete(i)
+			assert.NoError(t, err)
+		}
+
+		header, err = hash.readHeader()
+		assert.NoError(t, err)
+		assert.Equal(t, uint8(0), header.GlobalDepth)
+		assert.Equal(t, 1, len(header.DirPageIds))
+
+		catalog, err := readCatalog(bpm)
+		assert.NoError(t, err)
+		assert.NotEqual(t, int64(0), catalog.FreePageId)
+
+		// refilling the index reuses the freed pages
+		next := bpm.NewPageId()
+		for i := range 2500 {
+			_, err := hash.Put(i, value)
+			assert.NoError(t, err)
+		}
+		assert.Equal(t, next+1, bpm.NewPageId())
+	})
+
+	t.Run("splits buckets by the size of their entries", func(t *testing.T) {
+		file := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(file.Name())
+		})
+
+		bpm := createBpm(file)
+		hash, err := NewExtendibleHash[int, string]("test", bpm)
+		assert.NoError(t, err)
+
+		value := strings.Repeat("x", MAX_ENTRY_SIZE-DEFAULT_MAX_KEY_SIZE-16)
+		for i := range 50 {
+			_, err := hash.Put(i, value)
+			assert.NoError(t, err)
+		}
+
+		for i := range 50 {
+			val, err := hash.Get(i)
+			assert.NoError(t, err)
+			assert.Equal(t, value, val[0])
+		}
+	})
+
+	t.Run("enforces size limits", func(t *testing.T) {
+		file := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(file.Name())
+		})
+
+		bpm := createBpm(file)
+		hash, err := NewExtendibleHash[string, string]("test", bpm)
+		assert.NoError(t, err)
+
+		_, err = hash.Put(strings.Repeat("k", DEFAULT_MAX_KEY_SIZE), "v")
+		assert.ErrorIs(t, err, util.ErrKeyTooLarge)
+
+		_, err = hash.Put("k", strings.Repeat("v", MAX_ENTRY_SIZE))
+		assert.ErrorIs(t, err, util.ErrValueTooLarge)
+
+		err = hash.SetSizeLimits(SizeLimits{MaxKeySize: 16, MaxValueSize: MAX_ENTRY_SIZE})
+		assert.Error(t, err)
+
+		err = hash.SetSizeLimits(SizeLimits{MaxKeySize: 16, MaxValueSize: MAX_ENTRY_SIZE - 16})
+		assert.NoError(t, err)
+
+		_, err = hash.Put("k", strings.Repeat("v", MAX_ENTRY_SIZE-64))
+		assert.NoError(t, err)
+	})
+
+	t.Run("equal float keys hash the same", func(t *testing.T) {
+		file := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(file.Name())
+		})
+
+		bpm := createBpm(file)
+		hash, err := NewExtendibleHash[float64, int]("test", bpm)
+		assert.NoError(t, err)
+
+		for i := range 2000 {
+			_, err := hash.Put(float64(i), i)
+			assert.NoError(t, err)
+		}
+
+		_, err = hash.Put(math.Copysign(0, -1), -1)
+		assert.NoError(t, err)
+
+		val, err := hash.Get(0)
+		assert.NoError(t, err)
+		assert.Equal(t, -1, val[0])
+	})
+}
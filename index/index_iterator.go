@@ -8,8 +8,15 @@ import (
 )
 
 func NewIndexIterator[K cmp.Ordered, V any](pageId int64, bpm *buffer.BufferpoolManager) *indexIterator[K, V] {
-	guard, _ := bpm.ReadPage(pageId)
-	firstPage, _ := buffer.ToStruct[bplusLeafPage[K, V]](guard.GetData())
+	guard, err := bpm.ReadPage(pageId)
+	if err != nil {
+		return &indexIterator[K, V]{
+			bpm: bpm,
+			err: fmt.Errorf("error getting guard for page: %w", err),
+		}
+	}
+	defer guard.Drop()
+	firstPage, _ := decodeLeaf[K, V](guard.GetData())
 
 	return &indexIterator[K, V]{
 		currPage: firstPage,
@@ -21,40 +28,94 @@ func NewIndexIterator[K cmp.Ordered, V any](pageId int64, bpm *buffer.Bufferpool
 func (it *indexIterator[K, V]) Next() (K, V, error) {
 	var key K
 	var val V
-	if it.pos < it.currPage.getSize() {
-		key = it.currPage.keyAt(it.pos)
-		val = it.currPage.valueAt(it.pos)
-		it.pos += 1
 
-		return key, val, nil
-	}
+	it.settle()
+	if it.err != nil {
+		err := it.err
 
-	it.pos = 0
-	guard, err := it.bpm.ReadPage(it.currPage.Next)
-	if err != nil {
-		return key, val, fmt.Errorf("error getting guard for page: %v", err)
+		// a failed iterator is exhausted
+		it.err = nil
+		it.currPage = bplusLeafPage[K, V]{}
+		it.pos = 0
+
+		return key, val, err
 	}
-	defer guard.Drop()
 
-	nextPage, err := buffer.ToStruct[bplusLeafPage[K, V]](guard.GetData())
-	if err != nil {
-		return key, val, fmt.Errorf("error casting page: %v", err)
+	if it.pos >= it.currPage.getSize() {
+		return key, val, fmt.Errorf("iterator is exhausted")
 	}
-	it.currPage = nextPage
 
 	key = it.currPage.keyAt(it.pos)
-	val = it.currPage.valueAt(it.pos)
+	val, err := readValue(it.bpm, it.vlog, &it.currPage, it.pos)
 	it.pos += 1
 
-	return key, val, nil
+	return key, val, err
 }
 
 func (it *indexIterator[K, V]) IsEnd() bool {
-	return it.currPage.Next == 0 && it.pos >= it.currPage.getSize()
+	it.settle()
+
+	// a pending error is returned by the next call to Next
+	return it.err == nil && it.pos >= it.currPage.getSize()
+}
+
+// settle moves the iterator onto the next live entry. It skips expired
+// entries and follows the leaf chain until an entry is found or the chain
+// ends.
+func (it *indexIterator[K, V]) settle() {
+	for it.err == nil {
+		if it.pos < it.currPage.getSize() {
+			if !it.currPage.metaAt(it.pos).expired(it.now) {
+				return
+			}
+
+			if it.onExpired != nil {
+				it.onExpired(it.currPage.keyAt(it.pos))
+			}
+			it.pos += 1
+			continue
+		}
+
+		if it.currPage.Next == 0 {
+			return
+		}
+
+		pageId := it.currPage.Next
+		guard, err := it.bpm.ReadPage(pageId)
+		if err != nil {
+			it.err = fmt.Errorf("error getting guard for page: %w", err)
+			return
+		}
+
+		nextPage, err := decodeLeaf[K, V](guard.GetData())
+		guard.Drop()
+		if err != nil {
+			it.err = fmt.Errorf("error casting page: %v", err)
+			return
+		}
+
+		it.currPage = nextPage
+		it.pos = 0
+		it.readAhead(pageId, &it.currPage)
+	}
 }
 
 type indexIterator[K cmp.Ordered, V any] struct {
 	pos      int
 	currPage bplusLeafPage[K, V]
 	bpm      *buffer.BufferpoolManager
+	vlog     *valueLog
+
+	// entries that expired by now are skipped and passed to onExpired,
+	// a zero now shows every entry
+	now       int64
+	onExpired func(K)
+	err       error
+
+	// window is the number of leaves read ahead of the scan, ahead the
+	// leaves after the current one that were prefetched in chain order and
+	// prefetched the number of leaves requested
+	window     int
+	ahead      []int64
+	prefetched int
 }
@@ -2,15 +2,75 @@ package index
 
 import (
 	"cmp"
+
+	"github.com/jobala/petro/buffer"
 )
 
-func (p *bplusInternalPage[K]) init(pageId, parentPageId int64) {
+// internalSlots is more entries than an internal page of pageSize bytes can
+// hold, an entry takes at least two bytes. Internal pages are sized by their
+// encoding, they split once it no longer fits in a page and are underfull
+// below a quarter of a page.
+func internalSlots(pageSize int) int32 {
+	return int32(pageSize / 2)
+}
+
+func (p *bplusInternalPage[K]) init(pageId, parentPageId int64, pageSize int) {
 	p.PageType = INTERNAL_PAGE
 	p.PageId = pageId
 	p.Parent = parentPageId
-	p.Keys = make([]K, SLOT_SIZE)
-	p.Values = make([]int64, SLOT_SIZE)
-	p.MaxSize = SLOT_SIZE // todo: calculate max size
+	p.pageSize = pageSize
+	p.MaxSize = internalSlots(pageSize)
+	p.Keys = make([]K, p.MaxSize)
+	p.Values = make([]int64, p.MaxSize)
+}
+
+// encode serializes the page without the unused slots past Size
+func (p *bplusInternalPage[K]) encode() ([]byte, error) {
+	page := *p
+	page.Keys = p.Keys[:p.Size]
+	page.Values = p.Values[:p.Size]
+
+	return encodePage(page, p.pageSize)
+}
+
+// decodeInternal reads an internal page written by encode from the frame
+// data, whose length is the page size
+func decodeInternal[K cmp.Ordered](data []byte) (bplusInternalPage[K], error) {
+	page, err := buffer.ToStruct[bplusInternalPage[K]](data)
+	if err != nil {
+		return page, err
+	}
+
+	// pages written while internal pages held a fixed number of entries
+	// take the byte based size as well
+	page.pageSize = len(data)
+	page.MaxSize = max(page.MaxSize, internalSlots(page.pageSize))
+
+	page.Keys = padSlots(page.Keys, int(page.MaxSize))
+	page.Values = padSlots(page.Values, int(page.MaxSize))
+
+	return page, nil
+}
+
+// underfull reports whether the page takes less than a quarter of a page
+func (p *bplusInternalPage[K]) underfull() (bool, error) {
+	data, err := p.encode()
+	if err != nil {
+		return false, err
+	}
+
+	return len(data) < p.pageSize/4, nil
+}
+
+// canLend reports whether the page takes more than half a page, enough to
+// give an entry to an underfull sibling
+func (p *bplusInternalPage[K]) canLend() (bool, error) {
+	data, err := p.encode()
+	if err != nil {
+		return false, err
+	}
+
+	return len(data) > p.pageSize/2, nil
 }
 
 type bplusInternalPage[K cmp.Ordered] struct {
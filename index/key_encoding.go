@@ -0,0 +1,60 @@
+package index
+
+import (
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// appendKey appends an order preserving encoding of key to buf. Encodings
+// compare as bytes the way their keys compare, equal keys such as -0.0 and
+// 0.0 encode the same, and no encoding is a prefix of another, so they can be
+// concatenated into composite keys.
+//
+// Integers and floats take 8 bytes. Strings are written with their 0x00 bytes
+// escaped as 0x00 0xff and end with 0x00 0x01.
+func appendKey[T cmp.Ordered](buf []byte, key T) []byte {
+	v := reflect.ValueOf(key)
+
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		// flipping the sign bit orders negative numbers first
+		return binary.BigEndian.AppendUint64(buf, uint64(v.Int())^(1<<63))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return binary.BigEndian.AppendUint64(buf, v.Uint())
+	case reflect.Float32, reflect.Float64:
+		return binary.BigEndian.AppendUint64(buf, floatBits(v.Float()))
+	case reflect.String:
+		for _, c := range []byte(v.String()) {
+			if c == 0x00 {
+				buf = append(buf, 0x00, 0xff)
+				continue
+			}
+			buf = append(buf, c)
+		}
+		return append(buf, 0x00, 0x01)
+	}
+
+	panic(fmt.Sprintf("unsupported key type %T", key))
+}
+
+// floatBits maps f to an integer with the same order. NaNs sort first, as
+// they do for cmp.Compare.
+func floatBits(f float64) uint64 {
+	if math.IsNaN(f) {
+		return 0
+	}
+
+	// -0.0 == 0.0
+	if f == 0 {
+		f = 0
+	}
+
+	bits := math.Float64bits(f)
+	if bits>>63 == 1 {
+		return ^bits
+	}
+	return bits | 1<<63
+}
@@ -0,0 +1,52 @@
+package index
+
+import (
+	"bytes"
+	"cmp"
+	"math"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyEncoding(t *testing.T) {
+	t.Run("encodings sort like their keys", func(t *testing.T) {
+		assertSorted(t, []int{math.MinInt, -300, -1, 0, 1, 255, 256, math.MaxInt})
+		assertSorted(t, []uint8{0, 1, 127, 128, 255})
+		assertSorted(t, []float64{math.Inf(-1), -1.5, -1e-300, 0, 1e-300, 2.25, math.Inf(1)})
+		assertSorted(t, []string{"", "\x00", "\x00\x00", "\x00a", "a", "a\x00", "ab", "b"})
+	})
+
+	t.Run("equal keys encode the same", func(t *testing.T) {
+		assert.Equal(t, appendKey(nil, 0.0), appendKey(nil, math.Copysign(0, -1)))
+	})
+
+	t.Run("composite keys sort by their first key", func(t *testing.T) {
+		keys := []string{
+			postingKey("a", 2),
+			postingKey("a\x00", 1),
+			postingKey("a", 1),
+			postingKey("", 5),
+			postingKey("ab", 0),
+		}
+		slices.Sort(keys)
+
+		assert.Equal(t, []string{
+			postingKey("", 5),
+			postingKey("a", 1),
+			postingKey("a", 2),
+			postingKey("a\x00", 1),
+			postingKey("ab", 0),
+		}, keys)
+	})
+}
+
+func assertSorted[T cmp.Ordered](t *testing.T, keys []T) {
+	t.Helper()
+
+	for i := 1; i < len(keys); i++ {
+		prev, curr := appendKey(nil, keys[i-1]), appendKey(nil, keys[i])
+		assert.Equal(t, -1, bytes.Compare(prev, curr), "%v < %v", keys[i-1], keys[i])
+	}
+}
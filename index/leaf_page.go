@@ -2,6 +2,10 @@ package index
 
 import (
 	"cmp"
+	"slices"
+	"unicode/utf8"
+
+	"github.com/jobala/petro/buffer"
 )
 
 type PAGE_TYPE = int
@@ -13,17 +17,181 @@ const (
 )
 
 const HEADER_PAGE_ID = 0
-const SLOT_SIZE = 100
 
-func (p *bplusLeafPage[K, V]) init(pageId, parentPageId int64) {
+// leafSlots is more entries than a leaf of pageSize bytes can hold, an entry
+// takes at least three bytes. Leaves are sized by their encoding like
+// internal pages, they split once it no longer fits in a page and are
+// underfull below a quarter of a page.
+func leafSlots(pageSize int) int32 {
+	return int32(pageSize / 3)
+}
+
+func (p *bplusLeafPage[K, V]) init(pageId, parentPageId int64, pageSize int) {
 	p.PageType = LEAF_PAGE
 	p.PageId = pageId
 	p.Parent = parentPageId
-	p.Keys = make([]K, SLOT_SIZE)
-	p.Values = make([]V, SLOT_SIZE)
-	p.MaxSize = SLOT_SIZE // todo: calculate max size
+	p.pageSize = pageSize
+	p.MaxSize = leafSlots(pageSize)
+	p.Keys = make([]K, p.MaxSize)
+	p.Values = make([]V, p.MaxSize)
+	p.Meta = make([]slotMeta, p.MaxSize)
+}
+
+func (p *bplusLeafPage[K, V]) metaAt(idx int) slotMeta {
+	if idx < len(p.Meta) {
+		return p.Meta[idx]
+	}
+
+	return slotMeta{}
+}
+
+func (p *bplusLeafPage[K, V]) setMetaAt(idx int, meta slotMeta) {
+	p.Meta[idx] = meta
+}
+
+func (p *bplusLeafPage[K, V]) addEntry(key K, val V, meta slotMeta) {
+	insertIdx := p.getInsertIdx(key)
+	p.Keys = slices.Insert(p.Keys, insertIdx, key)
+	p.Values = slices.Insert(p.Values, insertIdx, val)
+	p.Meta = slices.Insert(p.Meta, insertIdx, meta)
+}
+
+// alignMeta gives every key slot a Meta entry, pages written before Meta
+// existed have none
+func (p *bplusLeafPage[K, V]) alignMeta() {
+	if len(p.Meta) < len(p.Keys) {
+		p.Meta = append(p.Meta, make([]slotMeta, len(p.Keys)-len(p.Meta))...)
+	}
+}
+
+// encode serializes the page without the unused slots past Size. The prefix
+// shared by string keys is written once.
+func (p *bplusLeafPage[K, V]) encode() ([]byte, error) {
+	page := *p
+	page.Keys = p.Keys[:p.Size]
+	page.Values = p.Values[:p.Size]
+	page.Meta = p.Meta[:min(int(p.Size), len(p.Meta))]
+
+	if keys, ok := any(page.Keys).([]string); ok && len(keys) > 1 {
+		page.Prefix = commonPrefix(keys[0], keys[len(keys)-1])
+		if page.Prefix != "" {
+			suffixes := make([]string, len(keys))
+			for i, key := range keys {
+				suffixes[i] = key[len(page.Prefix):]
+			}
+			page.Keys = any(suffixes).([]K)
+		}
+	}
+
+	return encodePage(page, p.pageSize)
+}
+
+// decodeLeaf reads a leaf page written by encode from the frame data, whose
+// length is the page size
+func decodeLeaf[K cmp.Ordered, V any](data []byte) (bplusLeafPage[K, V], error) {
+	page, err := buffer.ToStruct[bplusLeafPage[K, V]](data)
+	if err != nil {
+		return page, err
+	}
+
+	if keys, ok := any(page.Keys).([]string); ok && page.Prefix != "" {
+		for i := range keys {
+			keys[i] = page.Prefix + keys[i]
+		}
+		page.Prefix = ""
+	}
+
+	// leaves written while they held a fixed number of entries take the
+	// byte based size as well
+	page.pageSize = len(data)
+	page.MaxSize = max(page.MaxSize, leafSlots(page.pageSize))
+
+	page.Keys = padSlots(page.Keys, int(page.MaxSize))
+	page.Values = padSlots(page.Values, int(page.MaxSize))
+	page.alignMeta()
+
+	return page, nil
+}
+
+// underfull reports whether the leaf takes less than a quarter of a page
+func (p *bplusLeafPage[K, V]) underfull() (bool, error) {
+	data, err := p.encode()
+	if err != nil {
+		return false, err
+	}
+
+	return len(data) < p.pageSize/4, nil
+}
+
+// canLend reports whether the leaf takes more than half a page, enough to
+// give an entry to an underfull sibling
+func (p *bplusLeafPage[K, V]) canLend() (bool, error) {
+	data, err := p.encode()
+	if err != nil {
+		return false, err
+	}
+
+	return len(data) > p.pageSize/2, nil
 }
 
 type bplusLeafPage[K cmp.Ordered, V any] struct {
 	BplusPageHeader[K, V]
+
+	// Meta is aligned with Keys and Values
+	Meta []slotMeta
+
+	// Prefix is only set on encoded pages with string keys, it is stripped
+	// from every key
+	Prefix string
+}
+
+// slotMeta holds the bookkeeping of a single leaf entry
+type slotMeta struct {
+	// ExpiresAt is a unix timestamp in nanoseconds, zero never expires
+	ExpiresAt int64
+
+	// Overflow is the first page of the chain holding a value stored out of
+	// line, zero when the value is in the leaf
+	Overflow int64
+
+	// Log points at the value in the value log, if it was put there
+	Log valuePointer
+}
+
+func (m slotMeta) expired(now int64) bool {
+	return m.ExpiresAt != 0 && m.ExpiresAt <= now
+}
+
+// commonPrefix returns the longest prefix of a and b. Keys are sorted, so the
+// prefix of a page's first and last keys is shared by all of them.
+func commonPrefix(a, b string) string {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+
+	return a[:i]
+}
+
+// shortestSeparator returns the shortest key that sorts after left and not
+// after right, which keeps the separators of string keys short. The cut is
+// made after a whole rune, so separators of UTF-8 keys stay valid UTF-8.
+// Other keys are returned as they are.
+func shortestSeparator[K cmp.Ordered](left, right K) K {
+	l, ok := any(left).(string)
+	if !ok || left >= right {
+		return right
+	}
+
+	r := any(right).(string)
+	cut := len(commonPrefix(l, r))
+
+	// the first byte that differs may be in the middle of a rune
+	start := cut
+	for start > 0 && !utf8.RuneStart(r[start]) {
+		start--
+	}
+	_, size := utf8.DecodeRuneInString(r[start:])
+
+	return any(r[:max(start+size, cut+1)]).(K)
 }
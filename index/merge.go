@@ -0,0 +1,86 @@
+package index
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+)
+
+// MergeOperator combines the value stored under a key with an operand. found
+// is false when the key has no value, existing is then the zero value.
+type MergeOperator[V any] func(existing V, found bool, operand V) V
+
+// Number is satisfied by the types AddOperator can add
+type Number interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 |
+		~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 |
+		~float32 | ~float64
+}
+
+// SetMergeOperator sets the operator used by Merge
+func (b *bplusTree[K, V]) SetMergeOperator(op MergeOperator[V]) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.mergeOp = op
+}
+
+// Merge applies the tree's merge operator to the value stored under key and
+// operand, and stores the result. The read and the write happen under the
+// leaf's write guard in a single descent, so concurrent merges don't lose
+// updates. A merged key keeps its ttl.
+func (b *bplusTree[K, V]) Merge(key K, operand V) (V, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.checkOpen(); err != nil {
+		var zero V
+		return zero, err
+	}
+
+	if b.mergeOp == nil {
+		var zero V
+		return zero, fmt.Errorf("no merge operator set on %s", b.indexName)
+	}
+
+	if err := b.reclaimExpired(); err != nil {
+		var zero V
+		return zero, err
+	}
+
+	op := b.mergeOp
+	return b.store(key, func(old V, oldMeta slotMeta, found bool) (V, slotMeta) {
+		if !found {
+			var zero V
+			return op(zero, false, operand), slotMeta{}
+		}
+
+		return op(old, true, operand), oldMeta
+	})
+}
+
+// AddOperator adds the operand to the stored value, a missing key counts as
+// zero
+func AddOperator[V Number]() MergeOperator[V] {
+	return func(existing V, _ bool, operand V) V {
+		return existing + operand
+	}
+}
+
+// AppendOperator appends the operand's elements to the stored list
+func AppendOperator[E any]() MergeOperator[[]E] {
+	return func(existing []E, _ bool, operand []E) []E {
+		return append(slices.Clip(existing), operand...)
+	}
+}
+
+// MaxOperator keeps the larger of the stored value and the operand
+func MaxOperator[V cmp.Ordered]() MergeOperator[V] {
+	return func(existing V, found bool, operand V) V {
+		if !found {
+			return operand
+		}
+
+		return max(existing, operand)
+	}
+}
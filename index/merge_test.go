@@ -0,0 +1,126 @@
+package index
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMerge(t *testing.T) {
+	t.Run("adds to counters", func(t *testing.T) {
+		bplus := newTestTree[int, int](t, "test")
+		bplus.SetMergeOperator(AddOperator[int]())
+
+		// counters spread over several leaves
+		for range 3 {
+			for i := range 300 {
+				_, err := bplus.Merge(i, i)
+				assert.NoError(t, err)
+			}
+		}
+
+		for i := range 300 {
+			val, err := bplus.Get(i)
+			assert.NoError(t, err)
+			assert.Equal(t, i*3, val[0])
+		}
+	})
+
+	t.Run("concurrent merges don't lose updates", func(t *testing.T) {
+		bplus := newTestTree[string, int](t, "test")
+		bplus.SetMergeOperator(AddOperator[int]())
+
+		var wg sync.WaitGroup
+		for range 10 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range 50 {
+					_, err := bplus.Merge("hits", 1)
+					assert.NoError(t, err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		val, err := bplus.Get("hits")
+		assert.NoError(t, err)
+		assert.Equal(t, 500, val[0])
+	})
+
+	t.Run("appends to lists", func(t *testing.T) {
+		file := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(file.Name())
+		})
+
+		bpm := createBpm(file)
+		bplus, err := NewBplusTree[string, []string]("test", bpm)
+		assert.NoError(t, err)
+		bplus.SetMergeOperator(AppendOperator[string]())
+
+		_, err = bplus.Merge("john", []string{"login"})
+		assert.NoError(t, err)
+		merged, err := bplus.Merge("john", []string{"view", "logout"})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"login", "view", "logout"}, merged)
+
+		val, err := bplus.Get("john")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"login", "view", "logout"}, val[0])
+	})
+
+	t.Run("keeps the maximum", func(t *testing.T) {
+		bplus := newTestTree[string, int](t, "test")
+		bplus.SetMergeOperator(MaxOperator[int]())
+
+		for _, score := range []int{-5, -10, -2, -7} {
+			_, err := bplus.Merge("score", score)
+			assert.NoError(t, err)
+		}
+
+		val, err := bplus.Get("score")
+		assert.NoError(t, err)
+		assert.Equal(t, -2, val[0])
+	})
+
+	t.Run("expired values merge as missing and merges keep the ttl", func(t *testing.T) {
+		bplus := newTestTree[string, int](t, "test")
+		bplus.SetMergeOperator(AddOperator[int]())
+		clock := fakeClock(bplus)
+
+		_, err := bplus.PutWithTTL("expired", 10, time.Second)
+		assert.NoError(t, err)
+		_, err = bplus.PutWithTTL("live", 10, time.Hour)
+		assert.NoError(t, err)
+
+		*clock = clock.Add(time.Minute)
+
+		merged, err := bplus.Merge("expired", 1)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, merged)
+
+		merged, err = bplus.Merge("live", 1)
+		assert.NoError(t, err)
+		assert.Equal(t, 11, merged)
+
+		*clock = clock.Add(time.Hour)
+
+		val, err := bplus.Get("expired")
+		assert.NoError(t, err)
+		assert.Equal(t, 1, val[0])
+
+		_, err = bplus.Get("live")
+		assert.Error(t, err)
+	})
+
+	t.Run("fails without an operator", func(t *testing.T) {
+		bplus := newTestTree[string, int](t, "test")
+
+		_, err := bplus.Merge("hits", 1)
+		assert.Error(t, err)
+	})
+}
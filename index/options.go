@@ -0,0 +1,134 @@
+package index
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jobala/petro/buffer"
+	"github.com/jobala/petro/storage/disk"
+)
+
+const (
+	DEFAULT_POOL_FRAMES = buffer.BUFFER_CAPACITY
+	DEFAULT_REPLACER_K  = 2
+
+	// MIN_POOL_FRAMES is the fewest frames a partition of the pool can have,
+	// a write pins a handful of pages at once
+	MIN_POOL_FRAMES = 8
+
+	// MIN_PAGE_SIZE is the smallest page that takes keys of
+	// DEFAULT_MAX_KEY_SIZE
+	MIN_PAGE_SIZE = 2048
+)
+
+type ReplacerPolicy int
+
+const (
+	// LRU_K evicts the page whose k-th most recent access is the oldest
+	LRU_K ReplacerPolicy = iota
+
+	// LRU evicts the least recently used page, it's LRU_K with a K of 1
+	LRU
+)
+
+// Options configures the buffer pool and disk manager created by New and
+// NewHash, zero fields take their defaults
+type Options struct {
+	// PageSize is the size of a page, a multiple of disk.SECTOR_SIZE between
+	// MIN_PAGE_SIZE and disk.MAX_PAGE_SIZE. It defaults to disk.PAGE_SIZE.
+	// Like the codec it has to match how the db file was created. Larger
+	// pages take larger keys, see MaxKeySize.
+	PageSize int
+
+	// PoolFrames is the number of pages the buffer pool caches, it defaults
+	// to DEFAULT_POOL_FRAMES
+	PoolFrames int
+
+	// PoolBytes sizes the pool in bytes instead of frames, it's rounded down
+	// to whole pages of PageSize. Only one of PoolFrames and PoolBytes can be set.
+	PoolBytes int
+
+	// Partitions splits the pool into partitions with their own locks, see
+	// buffer.NewPartitionedBufferpoolManager. It defaults to 1.
+	Partitions int
+
+	Replacer ReplacerPolicy
+
+	// K is the number of accesses LRU_K keeps for each page, it defaults to
+	// DEFAULT_REPLACER_K
+	K int
+
+	// SyncMode decides when the db file is synced, SyncInterval how often
+	// disk.SYNC_PERIODIC does
+	SyncMode     disk.SyncMode
+	SyncInterval time.Duration
+
+	// Codec compresses pages before they're written, see disk.WithCodec. A db
+	// file has to be opened with the codec it was created with, or without
+	// one if it was created without.
+	Codec disk.Codec
+
+	// Keys encrypts pages, see disk.WithEncryption. Like the codec it has to
+	// match how the db file was created.
+	Keys disk.KeyProvider
+}
+
+// withDefaults validates opts and fills in the fields left zero
+func (opts Options) withDefaults() (Options, error) {
+	if opts.PageSize < 0 || opts.PoolFrames < 0 || opts.PoolBytes < 0 || opts.Partitions < 0 || opts.K < 0 || opts.SyncInterval < 0 {
+		return opts, fmt.Errorf("options must not be negative, got %+v", opts)
+	}
+
+	if opts.PageSize == 0 {
+		opts.PageSize = disk.PAGE_SIZE
+	}
+	if opts.PageSize < MIN_PAGE_SIZE || opts.PageSize > disk.MAX_PAGE_SIZE || opts.PageSize%disk.SECTOR_SIZE != 0 {
+		return opts, fmt.Errorf("pages take a multiple of %d bytes between %d and %d, got %d", disk.SECTOR_SIZE, MIN_PAGE_SIZE, disk.MAX_PAGE_SIZE, opts.PageSize)
+	}
+
+	if opts.PoolFrames > 0 && opts.PoolBytes > 0 {
+		return opts, fmt.Errorf("only one of PoolFrames and PoolBytes can be set, got %d and %d", opts.PoolFrames, opts.PoolBytes)
+	}
+	if opts.PoolBytes > 0 {
+		opts.PoolFrames = opts.PoolBytes / opts.PageSize
+	}
+	if opts.PoolFrames == 0 && opts.PoolBytes == 0 {
+		opts.PoolFrames = DEFAULT_POOL_FRAMES
+	}
+
+	if opts.Partitions == 0 {
+		opts.Partitions = 1
+	}
+	if opts.PoolFrames < opts.Partitions*MIN_POOL_FRAMES {
+		return opts, fmt.Errorf("each partition needs at least %d frames, got %d frames for %d partitions", MIN_POOL_FRAMES, opts.PoolFrames, opts.Partitions)
+	}
+
+	switch opts.Replacer {
+	case LRU_K:
+		if opts.K == 0 {
+			opts.K = DEFAULT_REPLACER_K
+		}
+	case LRU:
+		if opts.K > 1 {
+			return opts, fmt.Errorf("LRU keeps a single access, got a K of %d", opts.K)
+		}
+		opts.K = 1
+	default:
+		return opts, fmt.Errorf("unknown replacer policy %d", opts.Replacer)
+	}
+
+	switch opts.SyncMode {
+	case disk.SYNC_ON_FLUSH, disk.SYNC_NONE, disk.SYNC_ALWAYS:
+		if opts.SyncInterval != 0 {
+			return opts, fmt.Errorf("a sync interval only applies to SYNC_PERIODIC")
+		}
+	case disk.SYNC_PERIODIC:
+		if opts.SyncInterval == 0 {
+			opts.SyncInterval = disk.DEFAULT_SYNC_INTERVAL
+		}
+	default:
+		return opts, fmt.Errorf("unknown sync mode %d", opts.SyncMode)
+	}
+
+	return opts, nil
+}
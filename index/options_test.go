@@ -0,0 +1,203 @@
+package index
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jobala/petro/storage/disk"
+	"github.com/jobala/petro/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOptions(t *testing.T) {
+	t.Run("fills in the defaults", func(t *testing.T) {
+		opts, err := Options{}.withDefaults()
+		assert.NoError(t, err)
+		assert.Equal(t, Options{
+			PageSize:   disk.PAGE_SIZE,
+			PoolFrames: DEFAULT_POOL_FRAMES,
+			Partitions: 1,
+			Replacer:   LRU_K,
+			K:          DEFAULT_REPLACER_K,
+			SyncMode:   disk.SYNC_ON_FLUSH,
+		}, opts)
+
+		opts, err = Options{PoolBytes: 1 << 20, Replacer: LRU, SyncMode: disk.SYNC_PERIODIC}.withDefaults()
+		assert.NoError(t, err)
+		assert.Equal(t, 256, opts.PoolFrames)
+		assert.Equal(t, 1, opts.K)
+		assert.Equal(t, disk.DEFAULT_SYNC_INTERVAL, opts.SyncInterval)
+
+		opts, err = Options{PageSize: 4 * disk.PAGE_SIZE, PoolBytes: 1 << 20}.withDefaults()
+		assert.NoError(t, err)
+		assert.Equal(t, 64, opts.PoolFrames)
+	})
+
+	t.Run("rejects invalid options", func(t *testing.T) {
+		invalid := map[string]Options{
+			"negative":          {PoolFrames: -1},
+			"small pages":       {PageSize: MIN_PAGE_SIZE / 2},
+			"large pages":       {PageSize: 2 * disk.MAX_PAGE_SIZE},
+			"partial sectors":   {PageSize: disk.PAGE_SIZE + 100},
+			"frames and bytes":  {PoolFrames: 64, PoolBytes: 1 << 20},
+			"too few frames":    {PoolFrames: MIN_POOL_FRAMES - 1},
+			"small partitions":  {PoolFrames: 64, Partitions: 16},
+			"lru with k":        {Replacer: LRU, K: 2},
+			"unknown replacer":  {Replacer: ReplacerPolicy(9)},
+			"unknown sync mode": {SyncMode: disk.SyncMode(9)},
+			"unused interval":   {SyncMode: disk.SYNC_ALWAYS, SyncInterval: time.Second},
+		}
+
+		for name, opts := range invalid {
+			_, err := opts.withDefaults()
+			assert.Error(t, err, name)
+		}
+	})
+
+	t.Run("configures the tree's buffer pool", func(t *testing.T) {
+		file := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(file.Name())
+		})
+
+		bplus, err := New[int, int]("test", file, Options{PoolFrames: 64, Partitions: 4, Replacer: LRU, SyncMode: disk.SYNC_ALWAYS})
+		assert.NoError(t, err)
+		assert.Equal(t, 64, bplus.bpm.Size())
+
+		for i := range 500 {
+			_, err := bplus.Put(i, i)
+			assert.NoError(t, err)
+		}
+		for i := range 500 {
+			val, err := bplus.Get(i)
+			assert.NoError(t, err)
+			assert.Equal(t, []int{i}, val)
+		}
+		assert.NoError(t, bplus.Close())
+	})
+
+	t.Run("compresses pages with a codec", func(t *testing.T) {
+		file := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(file.Name())
+			_ = os.Remove(file.Name() + ".map")
+		})
+
+		opts := Options{Codec: disk.NewFlateCodec(flate.BestSpeed)}
+		bplus, err := New[int, int]("test", file, opts)
+		assert.NoError(t, err)
+		for i := range 500 {
+			_, err := bplus.Put(i, i)
+			assert.NoError(t, err)
+		}
+		assert.NoError(t, bplus.Close())
+
+		file, err = os.OpenFile(file.Name(), os.O_RDWR, 0644)
+		assert.NoError(t, err)
+		bplus, err = New[int, int]("test", file, opts)
+		assert.NoError(t, err)
+		for i := range 500 {
+			val, err := bplus.Get(i)
+			assert.NoError(t, err)
+			assert.Equal(t, []int{i}, val)
+		}
+		assert.NoError(t, bplus.Close())
+
+		file, err = os.OpenFile(file.Name(), os.O_RDWR, 0644)
+		assert.NoError(t, err)
+		_, err = New[int, int]("test", file)
+		assert.ErrorIs(t, err, util.ErrFormatMismatch)
+		_ = file.Close()
+	})
+
+	t.Run("encrypts pages with a key provider", func(t *testing.T) {
+		file := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(file.Name())
+		})
+
+		opts := Options{Keys: disk.StaticKeys{Current: 1, Keys: map[uint32][]byte{1: bytes.Repeat([]byte{1}, 32)}}}
+		bplus, err := New[string, string]("test", file, opts)
+		assert.NoError(t, err)
+		_, err = bplus.Put("john", "doe")
+		assert.NoError(t, err)
+		assert.NoError(t, bplus.Close())
+
+		data, err := os.ReadFile(file.Name())
+		assert.NoError(t, err)
+		assert.NotContains(t, string(data), "john")
+
+		file, err = os.OpenFile(file.Name(), os.O_RDWR, 0644)
+		assert.NoError(t, err)
+		bplus, err = New[string, string]("test", file, opts)
+		assert.NoError(t, err)
+		val, err := bplus.Get("john")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"doe"}, val)
+		assert.NoError(t, bplus.Close())
+
+		file, err = os.OpenFile(file.Name(), os.O_RDWR, 0644)
+		assert.NoError(t, err)
+		_, err = New[string, string]("test", file)
+		assert.ErrorIs(t, err, util.ErrFormatMismatch)
+		_ = file.Close()
+	})
+
+	t.Run("sizes pages with page size", func(t *testing.T) {
+		file := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(file.Name())
+		})
+
+		opts := Options{PageSize: 4 * disk.PAGE_SIZE}
+		bplus, err := New[string, int]("test", file, opts)
+		assert.NoError(t, err)
+		assert.Equal(t, opts.PageSize, bplus.bpm.PageSize())
+
+		// keys over the limit of the default page size fit
+		maxKey := MaxKeySize(opts.PageSize)
+		assert.Greater(t, maxKey, MAX_KEY_SIZE)
+		assert.NoError(t, bplus.SetSizeLimits(SizeLimits{MaxKeySize: maxKey, MaxValueSize: DEFAULT_MAX_VALUE_SIZE}))
+
+		key := func(i int) string {
+			return fmt.Sprintf("%04d%s", i, strings.Repeat("k", MAX_KEY_SIZE))
+		}
+		for i := range 500 {
+			_, err := bplus.Put(key(i), i)
+			assert.NoError(t, err)
+		}
+		assert.NoError(t, bplus.Close())
+
+		file, err = os.OpenFile(file.Name(), os.O_RDWR, 0644)
+		assert.NoError(t, err)
+		_, err = New[string, int]("test", file)
+		assert.ErrorIs(t, err, util.ErrFormatMismatch)
+
+		bplus, err = New[string, int]("test", file, opts)
+		assert.NoError(t, err)
+		for i := range 500 {
+			val, err := bplus.Get(key(i))
+			assert.NoError(t, err)
+			assert.Equal(t, []int{i}, val)
+		}
+		assert.NoError(t, bplus.Close())
+	})
+
+	t.Run("new fails with invalid options", func(t *testing.T) {
+		file := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(file.Name())
+		})
+
+		_, err := New[int, int]("test", file, Options{PoolFrames: -1})
+		assert.Error(t, err)
+
+		_, err = NewHash[int, int]("test", file, Options{}, Options{})
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,223 @@
+package index
+
+import (
+	"cmp"
+	"encoding/gob"
+	"fmt"
+	"io"
+
+	"github.com/jobala/petro/buffer"
+	"github.com/jobala/petro/storage/disk"
+)
+
+// overflowPageBytes is the share of a value held by each page of its
+// overflow chain, the rest of the page is left for the encoding's framing
+func overflowPageBytes(pageSize int) int {
+	return pageSize - 128
+}
+
+// placeValue checks value against the tree's limits and the entries it adds
+// to the indexes against theirs, and returns what the leaf stores for it.
+// Values over the value log's threshold are appended to the
+// log and values too large to share a leaf with other entries are written to
+// an overflow chain, the leaf then holds the zero value and meta points at
+// where the value went.
+func (b *bplusTree[K, V]) placeValue(key K, value V, meta slotMeta) (V, slotMeta, error) {
+	data, err := b.checkSize(key, value)
+	if err != nil {
+		return value, meta, err
+	}
+	if err := b.checkIndexed(key, value, meta); err != nil {
+		return value, meta, err
+	}
+
+	meta.Overflow = disk.INVALID_PAGE_ID
+	meta.Log = valuePointer{}
+
+	var zero V
+	if b.vlog != nil && len(data) > b.vlog.threshold {
+		keyData, err := buffer.ToByteSlice(key)
+		if err != nil {
+			return value, meta, err
+		}
+
+		meta.Log, err = b.vlog.append(keyData, data)
+		if err != nil {
+			return value, meta, err
+		}
+		return zero, meta, nil
+	}
+
+	if len(data) <= b.inlineLimit() {
+		return value, meta, nil
+	}
+
+	meta.Overflow, err = writeOverflow(b.bpm, data)
+	if err != nil {
+		return value, meta, err
+	}
+
+	return zero, meta, nil
+}
+
+// readValue returns the value of the entry at idx. Values stored in overflow
+// pages are decoded as their chain is read, a page at a time.
+func readValue[K cmp.Ordered, V any](bpm *buffer.BufferpoolManager, vlog *valueLog, page *bplusLeafPage[K, V], idx int) (V, error) {
+	meta := page.metaAt(idx)
+	if meta.Log.Length != 0 {
+		return readLogged[V](vlog, meta.Log)
+	}
+
+	chain := meta.Overflow
+	if chain == disk.INVALID_PAGE_ID {
+		return page.valueAt(idx), nil
+	}
+
+	var val V
+	if err := gob.NewDecoder(&overflowReader{bpm: bpm, next: chain}).Decode(&val); err != nil {
+		return val, fmt.Errorf("error reading overflow chain %d: %w", chain, err)
+	}
+
+	return val, nil
+}
+
+// writeOverflow writes data to a new chain of pages and returns its first page
+func writeOverflow(bpm *buffer.BufferpoolManager, data []byte) (int64, error) {
+	pageBytes := overflowPageBytes(bpm.PageSize())
+	pageIds, err := allocPages(bpm, (len(data)+pageBytes-1)/pageBytes)
+	if err != nil {
+		return disk.INVALID_PAGE_ID, err
+	}
+
+	for i, pageId := range pageIds {
+		page := overflowPage{
+			Next: disk.INVALID_PAGE_ID,
+			Data: data[i*pageBytes : min((i+1)*pageBytes, len(data))],
+		}
+		if i+1 < len(pageIds) {
+			page.Next = pageIds[i+1]
+		}
+
+		if err := writeOverflowPage(bpm, pageId, page); err != nil {
+			return disk.INVALID_PAGE_ID, err
+		}
+	}
+
+	return pageIds[0], nil
+}
+
+// freeOverflow puts the pages of the chain starting at pageId on the free list
+func freeOverflow(bpm *buffer.BufferpoolManager, pageId int64) error {
+	pageIds := []int64{}
+	for pageId != disk.INVALID_PAGE_ID {
+		page, err := readOverflowPage(bpm, pageId)
+		if err != nil {
+			return err
+		}
+
+		pageIds = append(pageIds, pageId)
+		pageId = page.Next
+	}
+
+	return freePages(bpm, pageIds)
+}
+
+// freePages puts pageIds on the free list, the pages mustn't be in use
+func freePages(bpm *buffer.BufferpoolManager, pageIds []int64) error {
+	return updateCatalog(bpm, func(catalog *catalogPage) error {
+		for _, pageId := range pageIds {
+			if err := writeOverflowPage(bpm, pageId, overflowPage{Next: catalog.FreePageId}); err != nil {
+				return err
+			}
+			catalog.FreePageId = pageId
+		}
+
+		return nil
+	})
+}
+
+// allocPages returns n pages, taken from the free list before new ones are
+// allocated
+func allocPages(bpm *buffer.BufferpoolManager, n int) ([]int64, error) {
+	pageIds := []int64{}
+	err := updateCatalog(bpm, func(catalog *catalogPage) error {
+		for len(pageIds) < n && catalog.FreePageId != disk.INVALID_PAGE_ID {
+			page, err := readOverflowPage(bpm, catalog.FreePageId)
+			if err != nil {
+				return err
+			}
+
+			pageIds = append(pageIds, catalog.FreePageId)
+			catalog.FreePageId = page.Next
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for len(pageIds) < n {
+		pageIds = append(pageIds, bpm.NewPageId())
+	}
+
+	return pageIds, nil
+}
+
+func readOverflowPage(bpm *buffer.BufferpoolManager, pageId int64) (overflowPage, error) {
+	guard, err := bpm.ReadPage(pageId)
+	if err != nil {
+		return overflowPage{}, err
+	}
+	defer guard.Drop()
+
+	return buffer.ToStruct[overflowPage](guard.GetData())
+}
+
+func writeOverflowPage(bpm *buffer.BufferpoolManager, pageId int64, page overflowPage) error {
+	guard, err := bpm.WritePage(pageId)
+	if err != nil {
+		return err
+	}
+	defer guard.Drop()
+
+	data, err := encodePage(page, bpm.PageSize())
+	if err != nil {
+		return err
+	}
+
+	copy(*guard.GetDataMut(), data)
+	return nil
+}
+
+// overflowReader reads the data of a chain one page at a time
+type overflowReader struct {
+	bpm  *buffer.BufferpoolManager
+	next int64
+	data []byte
+}
+
+func (r *overflowReader) Read(p []byte) (int, error) {
+	for len(r.data) == 0 {
+		if r.next == disk.INVALID_PAGE_ID {
+			return 0, io.EOF
+		}
+
+		page, err := readOverflowPage(r.bpm, r.next)
+		if err != nil {
+			return 0, err
+		}
+		r.data, r.next = page.Data, page.Next
+	}
+
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// overflowPage holds part of a value stored out of line. Pages on the free
+// list are overflow pages without data.
+type overflowPage struct {
+	Next int64
+	Data []byte
+}
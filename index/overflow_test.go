@@ -0,0 +1,142 @@
+package index
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/jobala/petro/buffer"
+	"github.com/jobala/petro/storage/disk"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOverflow(t *testing.T) {
+	t.Run("stores large values out of line", func(t *testing.T) {
+		file := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(file.Name())
+		})
+
+		bpm := createBpm(file)
+		bplus, err := NewBplusTree[int, []byte]("test", bpm)
+		assert.NoError(t, err)
+
+		blob := func(i int) []byte {
+			return bytes.Repeat([]byte{byte(i)}, 100_000+i)
+		}
+
+		for i := range 10 {
+			_, err := bplus.Put(i, blob(i))
+			assert.NoError(t, err)
+			_, err = bplus.Put(i+10, []byte{byte(i)})
+			assert.NoError(t, err)
+		}
+
+		for i := range 10 {
+			val, err := bplus.Get(i)
+			assert.NoError(t, err)
+			assert.Equal(t, blob(i), val[0])
+		}
+
+		indexIter := bplus.GetIterator()
+		for i := range 20 {
+			key, val, err := indexIter.Next()
+			assert.NoError(t, err)
+			assert.Equal(t, i, key)
+			if i < 10 {
+				assert.Equal(t, blob(i), val)
+			} else {
+				assert.Equal(t, []byte{byte(i - 10)}, val)
+			}
+		}
+		assert.NoError(t, bplus.Flush())
+
+		reopened, err := NewBplusTree[int, []byte]("test", createBpm(file))
+		assert.NoError(t, err)
+		val, err := reopened.Get(9)
+		assert.NoError(t, err)
+		assert.Equal(t, blob(9), val[0])
+	})
+
+	t.Run("reclaims chains on delete and overwrite", func(t *testing.T) {
+		file := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(file.Name())
+		})
+
+		bpm := createBpm(file)
+		bplus, err := NewBplusTree[string, []byte]("test", bpm)
+		assert.NoError(t, err)
+
+		blob := bytes.Repeat([]byte{1}, 10*overflowPageBytes(disk.PAGE_SIZE))
+		_, err = bplus.Put("john", blob)
+		assert.NoError(t, err)
+		_, err = bplus.Put("jane", blob)
+		assert.NoError(t, err)
+
+		_, err = bplus.Put("john", []byte("small"))
+		assert.NoError(t, err)
+		assert.Equal(t, 11, freeListLen(t, bpm))
+
+		_, err = bplus.Delete("jane")
+		assert.NoError(t, err)
+		assert.Equal(t, 22, freeListLen(t, bpm))
+
+		// freed pages are reused before new ones are allocated
+		nextPageId := bpm.NewPageId()
+		_, err = bplus.Put("doe", blob)
+		assert.NoError(t, err)
+		assert.Equal(t, 11, freeListLen(t, bpm))
+		assert.Equal(t, nextPageId+1, bpm.NewPageId())
+
+		val, err := bplus.Get("doe")
+		assert.NoError(t, err)
+		assert.Equal(t, blob, val[0])
+		val, err = bplus.Get("john")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("small"), val[0])
+	})
+
+	t.Run("merges read and grow values stored out of line", func(t *testing.T) {
+		file := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(file.Name())
+		})
+
+		bpm := createBpm(file)
+		bplus, err := NewBplusTree[string, []int]("test", bpm)
+		assert.NoError(t, err)
+		bplus.SetMergeOperator(AppendOperator[int]())
+
+		expected := []int{}
+		for i := range 1500 {
+			_, err := bplus.Merge("events", []int{i})
+			assert.NoError(t, err)
+			expected = append(expected, i)
+		}
+
+		val, err := bplus.Get("events")
+		assert.NoError(t, err)
+		assert.Equal(t, expected, val[0])
+
+		// each merge frees the chain it replaces for the next one to reuse
+		assert.Less(t, bpm.NewPageId(), int64(100))
+	})
+}
+
+// freeListLen counts the pages on the buffer pool's free list
+func freeListLen(t *testing.T, bpm *buffer.BufferpoolManager) int {
+	t.Helper()
+
+	catalog, err := readCatalog(bpm)
+	assert.NoError(t, err)
+
+	n := 0
+	for pageId := catalog.FreePageId; pageId != disk.INVALID_PAGE_ID; n++ {
+		page, err := readOverflowPage(bpm, pageId)
+		assert.NoError(t, err)
+		pageId = page.Next
+	}
+
+	return n
+}
@@ -0,0 +1,130 @@
+package index
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/base64"
+	"encoding/gob"
+	"fmt"
+)
+
+// Page returns up to limit entries starting at the first key >= start. When
+// more entries may follow, the result carries a cursor for PageAfter.
+func (b *bplusTree[K, V]) Page(start K, limit int) (*ScanPage[K, V], error) {
+	return b.scanPage(start, false, limit)
+}
+
+// PageAfter resumes a scan right after the last key encoded in cursor. The
+// cursor holds a key rather than a page position, so it stays valid after the
+// tree has been modified.
+func (b *bplusTree[K, V]) PageAfter(cursor Cursor, limit int) (*ScanPage[K, V], error) {
+	token, err := decodeCursor[K](cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.scanPage(token.LastKey, true, limit)
+}
+
+func (b *bplusTree[K, V]) scanPage(start K, exclusive bool, limit int) (*ScanPage[K, V], error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("limit must be positive, got %d", limit)
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if err := b.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	res := &ScanPage[K, V]{
+		Keys:   []K{},
+		Values: []V{},
+	}
+
+	if b.isEmpty() {
+		return res, nil
+	}
+
+	indexIter, err := b.seek(start)
+	if err != nil {
+		return nil, err
+	}
+
+	for !indexIter.IsEnd() && len(res.Keys) < limit {
+		key, val, err := indexIter.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		if exclusive && key == start {
+			continue
+		}
+
+		res.Keys = append(res.Keys, key)
+		res.Values = append(res.Values, val)
+	}
+
+	if len(res.Keys) == limit && !indexIter.IsEnd() {
+		cursor, err := encodeCursor(res.Keys[len(res.Keys)-1])
+		if err != nil {
+			return nil, err
+		}
+		res.Next = cursor
+	}
+
+	return res, nil
+}
+
+// seek returns an iterator positioned at the first key >= key
+func (b *bplusTree[K, V]) seek(key K) (*indexIterator[K, V], error) {
+	leafPageId, err := b.findLeafPageId(b.header.RootPageId, key)
+	if err != nil {
+		return nil, err
+	}
+
+	indexIter := b.newIterator(leafPageId)
+	indexIter.pos = indexIter.currPage.getInsertIdx(key)
+
+	return indexIter, nil
+}
+
+func encodeCursor[K cmp.Ordered](lastKey K) (Cursor, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(cursorToken[K]{LastKey: lastKey}); err != nil {
+		return "", fmt.Errorf("error encoding cursor: %v", err)
+	}
+
+	return Cursor(base64.RawURLEncoding.EncodeToString(buf.Bytes())), nil
+}
+
+func decodeCursor[K cmp.Ordered](cursor Cursor) (cursorToken[K], error) {
+	var token cursorToken[K]
+
+	data, err := base64.RawURLEncoding.DecodeString(string(cursor))
+	if err != nil {
+		return token, fmt.Errorf("invalid cursor %q: %v", cursor, err)
+	}
+
+	// unlike buffer.ToStruct, a cursor that fails to decode is an error
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&token); err != nil {
+		return token, fmt.Errorf("invalid cursor %q: %v", cursor, err)
+	}
+
+	return token, nil
+}
+
+// Cursor is an opaque continuation token. An empty cursor means the scan is
+// complete.
+type Cursor string
+
+type ScanPage[K cmp.Ordered, V any] struct {
+	Keys   []K
+	Values []V
+	Next   Cursor
+}
+
+type cursorToken[K cmp.Ordered] struct {
+	LastKey K
+}
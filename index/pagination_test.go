@@ -0,0 +1,106 @@
+package index
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPagination(t *testing.T) {
+	t.Run("pages through every entry", func(t *testing.T) {
+		bplus := newTestTree[int, int](t, "test")
+
+		for i := 250; i >= 0; i-- {
+			_, err := bplus.Put(i, i*10)
+			assert.NoError(t, err)
+		}
+
+		page, err := bplus.Page(0, 40)
+		assert.NoError(t, err)
+
+		keys := []int{}
+		values := []int{}
+		for {
+			keys = append(keys, page.Keys...)
+			values = append(values, page.Values...)
+			if page.Next == "" {
+				break
+			}
+
+			page, err = bplus.PageAfter(page.Next, 40)
+			assert.NoError(t, err)
+		}
+
+		assert.Equal(t, 251, len(keys))
+		for i := range 251 {
+			assert.Equal(t, i, keys[i])
+			assert.Equal(t, i*10, values[i])
+		}
+	})
+
+	t.Run("starts at the first key greater or equal to start", func(t *testing.T) {
+		bplus := newTestTree[int, int](t, "test")
+
+		for i := 0; i <= 200; i += 2 {
+			_, err := bplus.Put(i, i)
+			assert.NoError(t, err)
+		}
+
+		page, err := bplus.Page(51, 3)
+		assert.NoError(t, err)
+		assert.Equal(t, []int{52, 54, 56}, page.Keys)
+		assert.NotEmpty(t, page.Next)
+	})
+
+	t.Run("resumes after the tree has changed", func(t *testing.T) {
+		bplus := newTestTree[int, int](t, "test")
+
+		for i := 0; i < 150; i += 2 {
+			_, err := bplus.Put(i, i)
+			assert.NoError(t, err)
+		}
+
+		page, err := bplus.Page(0, 5)
+		assert.NoError(t, err)
+		assert.Equal(t, []int{0, 2, 4, 6, 8}, page.Keys)
+
+		// remove the cursor's key and add keys on both sides of it
+		_, err = bplus.Delete(8)
+		assert.NoError(t, err)
+		_, err = bplus.Put(7, 7)
+		assert.NoError(t, err)
+		_, err = bplus.Put(9, 9)
+		assert.NoError(t, err)
+
+		page, err = bplus.PageAfter(page.Next, 3)
+		assert.NoError(t, err)
+		assert.Equal(t, []int{9, 10, 12}, page.Keys)
+	})
+
+	t.Run("last page has no cursor", func(t *testing.T) {
+		bplus := newTestTree[string, int](t, "test")
+
+		page, err := bplus.Page("", 10)
+		assert.NoError(t, err)
+		assert.Empty(t, page.Keys)
+		assert.Empty(t, page.Next)
+
+		_, err = bplus.Put("john", 25)
+		assert.NoError(t, err)
+
+		page, err = bplus.Page("", 10)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"john"}, page.Keys)
+		assert.Empty(t, page.Next)
+	})
+
+	t.Run("rejects invalid cursors and limits", func(t *testing.T) {
+		bplus := newTestTree[string, int](t, "test")
+
+		_, err := bplus.PageAfter("not a cursor", 10)
+		assert.Error(t, err)
+
+		_, err = bplus.Page("", 0)
+		assert.Error(t, err)
+	})
+}
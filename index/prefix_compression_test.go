@@ -0,0 +1,147 @@
+package index
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/jobala/petro/storage/disk"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrefixCompression(t *testing.T) {
+	// neighbouring keys differ before their last byte, so separators can be
+	// cut short wherever a leaf splits
+	prefix := "tenant/123/orders/" + strings.Repeat("x", 180)
+	key := func(i int) string {
+		return fmt.Sprintf("%s/%04d0", prefix, i)
+	}
+
+	t.Run("leaf pages write the shared prefix once", func(t *testing.T) {
+		var page bplusLeafPage[string, int]
+		page.init(1, disk.INVALID_PAGE_ID, disk.PAGE_SIZE)
+		for i := range 40 {
+			page.setKeyAt(i, key(i))
+			page.setValAt(i, i)
+		}
+		page.Size = 40
+
+		// the keys alone are larger than a page
+		assert.Greater(t, 40*len(key(0)), disk.PAGE_SIZE)
+
+		data, err := page.encode()
+		assert.NoError(t, err)
+
+		decoded, err := decodeLeaf[string, int](data)
+		assert.NoError(t, err)
+		assert.Equal(t, page.Keys[:page.Size], decoded.Keys[:decoded.Size])
+		assert.Equal(t, page.Values[:page.Size], decoded.Values[:decoded.Size])
+		assert.Empty(t, decoded.Prefix)
+	})
+
+	t.Run("separators are truncated", func(t *testing.T) {
+		bplus := newTestTree[string, int](t, "test")
+
+		for i := range 500 {
+			_, err := bplus.Put(key(i), i)
+			assert.NoError(t, err)
+		}
+
+		dump, err := bplus.Dump()
+		assert.NoError(t, err)
+
+		leaves := 0
+		for _, page := range dump.Pages {
+			if page.Type == "leaf" {
+				leaves++
+				continue
+			}
+			for _, sep := range page.Keys {
+				assert.Less(t, len(sep), len(key(0)))
+			}
+		}
+		// without compression a leaf holds at most 19 of these keys
+		assert.Less(t, leaves, 500/19)
+
+		for i := 0; i < 500; i += 2 {
+			_, err := bplus.Delete(key(i))
+			assert.NoError(t, err)
+		}
+
+		for i := range 500 {
+			val, err := bplus.Get(key(i))
+			if i%2 == 0 {
+				assert.Error(t, err)
+				continue
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, i, val[0])
+		}
+	})
+
+	t.Run("shortest separator", func(t *testing.T) {
+		tests := []struct {
+			left, right, want string
+		}{
+			{"tenant/1/a", "tenant/1/b", "tenant/1/b"},
+			{"tenant/1/apple", "tenant/1/banana", "tenant/1/b"},
+			{"tenant/1", "tenant/12", "tenant/12"},
+			{"abc", "abd", "abd"},
+			{"b", "a", "a"},
+			// the keys share the first byte of a two byte rune
+			{"é", "ê", "ê"},
+			{"café/1", "cafê/2", "cafê"},
+			{"日本", "日本語", "日本語"},
+		}
+
+		for _, test := range tests {
+			sep := shortestSeparator(test.left, test.right)
+			assert.Equal(t, test.want, sep)
+			if test.left < test.right {
+				assert.Greater(t, sep, test.left)
+				assert.LessOrEqual(t, sep, test.right)
+			}
+		}
+
+		assert.Equal(t, 7, shortestSeparator(3, 7))
+	})
+
+	t.Run("separators of non-ascii keys are valid utf-8", func(t *testing.T) {
+		bplus := newTestTree[string, int](t, "test")
+
+		// neighbouring keys differ in the last byte of a rune, the padding
+		// keeps the keys from fitting in one leaf
+		runes := []rune("éêëèàâäôöûü日本語")
+		key := func(i int) string {
+			return fmt.Sprintf("%c%c/%s", runes[i/len(runes)], runes[i%len(runes)], strings.Repeat("ü", 60))
+		}
+		n := len(runes) * len(runes)
+
+		for i := range n {
+			_, err := bplus.Put(key(i), i)
+			assert.NoError(t, err)
+		}
+
+		dump, err := bplus.Dump()
+		assert.NoError(t, err)
+
+		internal := 0
+		for _, page := range dump.Pages {
+			if page.Type == "leaf" {
+				continue
+			}
+			internal++
+			for _, sep := range page.Keys {
+				assert.True(t, utf8.ValidString(sep), "%q", sep)
+			}
+		}
+		assert.Greater(t, internal, 0)
+
+		for i := range n {
+			val, err := bplus.Get(key(i))
+			assert.NoError(t, err)
+			assert.Equal(t, i, val[0])
+		}
+	})
+}
@@ -0,0 +1,69 @@
+package index
+
+import "github.com/jobala/petro/storage/disk"
+
+// DEFAULT_READ_AHEAD is the number of leaves iterators prefetch ahead of a
+// scan
+const DEFAULT_READ_AHEAD = 4
+
+// SetReadAhead sets how many leaves iterators load ahead of a scan, zero turns
+// read-ahead off
+func (b *bplusTree[K, V]) SetReadAhead(pages int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.readAhead = max(pages, 0)
+}
+
+// readAhead is called as the iterator moves onto the leaf pageId. The leaves
+// to come are found by following the Next chain from the last leaf
+// prefetched, as far as the leaves already in the pool go, and up to window
+// of them are prefetched. Leaves are found the same way wherever they are in
+// the file.
+func (it *indexIterator[K, V]) readAhead(pageId int64, page *bplusLeafPage[K, V]) {
+	if len(it.ahead) > 0 && it.ahead[0] == pageId {
+		it.ahead = it.ahead[1:]
+	} else {
+		it.ahead = nil
+	}
+
+	if it.window == 0 {
+		return
+	}
+
+	pageIds := []int64{}
+	if len(it.ahead) == 0 && page.Next != disk.INVALID_PAGE_ID {
+		pageIds = append(pageIds, page.Next)
+		it.ahead = append(it.ahead, page.Next)
+	}
+
+	for len(it.ahead) > 0 && len(it.ahead) < it.window {
+		next, ok := it.cachedNext(it.ahead[len(it.ahead)-1])
+		if !ok || next == disk.INVALID_PAGE_ID {
+			break
+		}
+
+		pageIds = append(pageIds, next)
+		it.ahead = append(it.ahead, next)
+	}
+
+	it.bpm.Prefetch(pageIds...)
+	it.prefetched += len(pageIds)
+}
+
+// cachedNext returns the leaf after pageId if pageId is in the buffer pool,
+// leaves that are still being read end the read-ahead
+func (it *indexIterator[K, V]) cachedNext(pageId int64) (int64, bool) {
+	guard, ok := it.bpm.ReadCachedPage(pageId)
+	if !ok {
+		return disk.INVALID_PAGE_ID, false
+	}
+	defer guard.Drop()
+
+	page, err := decodeLeaf[K, V](guard.GetData())
+	if err != nil {
+		return disk.INVALID_PAGE_ID, false
+	}
+
+	return page.Next, true
+}
@@ -0,0 +1,95 @@
+package index
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadAhead(t *testing.T) {
+	scan := func(t *testing.T, bplus *bplusTree[int, int]) (*indexIterator[int, int], []int) {
+		t.Helper()
+
+		keys := []int{}
+		indexIter := bplus.GetIterator()
+		for !indexIter.IsEnd() {
+			key, _, err := indexIter.Next()
+			assert.NoError(t, err)
+			keys = append(keys, key)
+		}
+
+		return indexIter, keys
+	}
+
+	t.Run("sequential scans prefetch the pages ahead", func(t *testing.T) {
+		bplus := newTestTree[int, int](t, "test")
+
+		want := []int{}
+		for i := range 2000 {
+			_, err := bplus.Put(i, i)
+			assert.NoError(t, err)
+			want = append(want, i)
+		}
+
+		indexIter, keys := scan(t, bplus)
+		assert.Equal(t, want, keys)
+		assert.Greater(t, indexIter.prefetched, 0)
+
+		bplus.SetReadAhead(0)
+		indexIter, keys = scan(t, bplus)
+		assert.Equal(t, want, keys)
+		assert.Equal(t, 0, indexIter.prefetched)
+	})
+
+	t.Run("follows the leaf chain", func(t *testing.T) {
+		file := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(file.Name())
+		})
+
+		bplus, err := NewBplusTree[int, [32]byte]("test", createBpm(file))
+		assert.NoError(t, err)
+		bplus.SetReadAhead(3)
+
+		// inserting in reverse splits leaves to the left, so the chain runs
+		// against the order of the leaves in the file. The values keep the
+		// leaves small and the tree fits in the buffer pool.
+		for i := 399; i >= 0; i-- {
+			_, err := bplus.Put(i, [32]byte{byte(i)})
+			assert.NoError(t, err)
+		}
+
+		chain, sizes := []int64{}, []int{}
+		for pageId := bplus.header.FirstPageId; pageId != 0; {
+			guard, err := bplus.bpm.ReadPage(pageId)
+			assert.NoError(t, err)
+			page, err := decodeLeaf[int, [32]byte](guard.GetData())
+			guard.Drop()
+			assert.NoError(t, err)
+
+			chain, sizes = append(chain, pageId), append(sizes, page.getSize())
+			pageId = page.Next
+		}
+		assert.Greater(t, len(chain), 5)
+		assert.Greater(t, chain[1], chain[2])
+
+		// moving onto the second leaf reads the three after it ahead
+		indexIter := bplus.GetIterator()
+		for range sizes[0] {
+			_, _, err := indexIter.Next()
+			assert.NoError(t, err)
+		}
+		assert.False(t, indexIter.IsEnd())
+		assert.Equal(t, chain[2:5], indexIter.ahead)
+		assert.Equal(t, 3, indexIter.prefetched)
+
+		// the next move extends the read-ahead by a leaf
+		for range sizes[1] + 1 {
+			_, _, err := indexIter.Next()
+			assert.NoError(t, err)
+		}
+		assert.Equal(t, chain[3:6], indexIter.ahead)
+		assert.Equal(t, 4, indexIter.prefetched)
+	})
+}
@@ -0,0 +1,226 @@
+package index
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jobala/petro/util"
+)
+
+// AddIndex registers a secondary index called name on primary. extract maps a
+// record to its secondary key and several records may share a secondary key.
+//
+// The index lives in its own tree on the primary's buffer pool with an entry
+// for each record, keyed by the record's secondary and primary keys, so that
+// keeping it in sync on Put and Delete touches a single entry. Registrations
+// aren't stored with the tree and writes made while an index isn't registered
+// don't reach it, so the index is rebuilt from the primary's records whenever
+// it is added.
+func AddIndex[K cmp.Ordered, V any, S cmp.Ordered](primary *bplusTree[K, V], name string, extract func(V) S) error {
+	primary.mu.Lock()
+	defer primary.mu.Unlock()
+
+	if err := primary.checkOpen(); err != nil {
+		return err
+	}
+
+	// the index's tree is named after the primary and the index, a name
+	// holding a slash could be read as part of the primary's name
+	if name == "" || strings.Contains(name, "/") {
+		return fmt.Errorf("%w: index names can't be empty or contain a slash: %q", util.ErrReservedName, name)
+	}
+
+	if _, ok := primary.indexes[name]; ok {
+		return fmt.Errorf("index already exists: %s", name)
+	}
+
+	tree, err := openBplusTree[string, K](RESERVED_PREFIX+"index/"+primary.indexName+"/"+name, primary.bpm)
+	if err != nil {
+		return fmt.Errorf("error creating index %s: %w", name, err)
+	}
+	tree.limits = indexLimits(primary.limits, primary.bpm.PageSize())
+
+	if err := tree.clear(); err != nil {
+		return fmt.Errorf("error clearing index %s: %w", name, err)
+	}
+
+	idx := &secondaryTree[K, V, S]{
+		tree:    tree,
+		extract: extract,
+	}
+
+	if !primary.isEmpty() {
+		indexIter := primary.GetIterator()
+		for !indexIter.IsEnd() {
+			key, val, err := indexIter.Next()
+			if err != nil {
+				return err
+			}
+
+			if err := addPosting(tree, extract(val), key); err != nil {
+				return fmt.Errorf("error building index %s: %w", name, err)
+			}
+		}
+	}
+
+	if primary.indexes == nil {
+		primary.indexes = map[string]secondaryIndex[K, V]{}
+	}
+	primary.indexes[name] = idx
+
+	return nil
+}
+
+// GetBy returns the records of primary whose secondary key in the index called
+// name equals key, in primary key order. key has to be of the type the index
+// was added with.
+func GetBy[K cmp.Ordered, V any, S cmp.Ordered](primary *bplusTree[K, V], name string, key S) ([]V, error) {
+	primary.mu.RLock()
+	defer primary.mu.RUnlock()
+
+	if err := primary.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	idx, ok := primary.indexes[name]
+	if !ok {
+		return nil, fmt.Errorf("index not found: %s", name)
+	}
+
+	tree, ok := idx.(*secondaryTree[K, V, S])
+	if !ok {
+		return nil, fmt.Errorf("index %s doesn't have keys of type %T", name, key)
+	}
+
+	keys, err := postings(tree.tree, key)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]V, 0, len(keys))
+	for _, k := range keys {
+		vals, err := primary.get(k)
+		if errors.Is(err, util.ErrKeyNotFound) {
+			// the record expired but has not been reclaimed yet
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading record %v: %w", k, err)
+		}
+		res = append(res, vals[0])
+	}
+
+	return res, nil
+}
+
+func (s *secondaryTree[K, V, S]) put(key K, old V, replaced bool, val V) error {
+	secKey := s.extract(val)
+
+	if replaced {
+		oldSecKey := s.extract(old)
+		if oldSecKey == secKey {
+			return nil
+		}
+
+		if err := removePosting(s.tree, oldSecKey, key); err != nil {
+			return err
+		}
+	}
+
+	return addPosting(s.tree, secKey, key)
+}
+
+func (s *secondaryTree[K, V, S]) remove(key K, old V) error {
+	return removePosting(s.tree, s.extract(old), key)
+}
+
+// check fails when the entry of key and val is over the index's limits
+func (s *secondaryTree[K, V, S]) check(key K, val V) error {
+	_, err := s.tree.limits.check(postingKey(s.extract(val), key), key)
+	return err
+}
+
+func (s *secondaryTree[K, V, S]) setLimits(limits SizeLimits) error {
+	return s.tree.SetSizeLimits(limits)
+}
+
+// postingKey returns the composite key of the entry pairing secKey with key.
+// The entries of a secondary key are adjacent and ordered by primary key.
+func postingKey[K cmp.Ordered, S cmp.Ordered](secKey S, key K) string {
+	return string(appendKey(appendKey(nil, secKey), key))
+}
+
+// addPosting adds the entry pairing secKey with key
+func addPosting[K cmp.Ordered, S cmp.Ordered](tree *bplusTree[string, K], secKey S, key K) error {
+	_, err := tree.Put(postingKey(secKey, key), key)
+	return err
+}
+
+// removePosting removes the entry pairing secKey with key, if there is one
+func removePosting[K cmp.Ordered, S cmp.Ordered](tree *bplusTree[string, K], secKey S, key K) error {
+	if tree.isEmpty() {
+		return nil
+	}
+
+	_, err := tree.Delete(postingKey(secKey, key))
+	if errors.Is(err, util.ErrKeyNotFound) {
+		return nil
+	}
+
+	return err
+}
+
+// postings returns the primary keys paired with secKey in order
+func postings[K cmp.Ordered, S cmp.Ordered](tree *bplusTree[string, K], secKey S) ([]K, error) {
+	prefix := string(appendKey(nil, secKey))
+	return scanPostings(tree, prefix, func(entry string) bool {
+		return strings.HasPrefix(entry, prefix)
+	})
+}
+
+// scanPostings returns the primary keys of the entries from the composite key
+// start onwards, for as long as within holds
+func scanPostings[K cmp.Ordered](tree *bplusTree[string, K], start string, within func(string) bool) ([]K, error) {
+	tree.mu.RLock()
+	defer tree.mu.RUnlock()
+
+	keys := []K{}
+	if tree.isEmpty() {
+		return keys, nil
+	}
+
+	indexIter, err := tree.seek(start)
+	if err != nil {
+		return nil, err
+	}
+
+	for !indexIter.IsEnd() {
+		entry, key, err := indexIter.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		if !within(entry) {
+			break
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// secondaryIndex is the type erased view of a secondaryTree that the primary
+// tree uses to keep its indexes in sync.
+type secondaryIndex[K cmp.Ordered, V any] interface {
+	put(key K, old V, replaced bool, val V) error
+	remove(key K, old V) error
+	check(key K, val V) error
+	setLimits(limits SizeLimits) error
+}
+
+type secondaryTree[K cmp.Ordered, V any, S cmp.Ordered] struct {
+	tree    *bplusTree[string, K]
+	extract func(V) S
+}
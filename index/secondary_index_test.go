@@ -0,0 +1,251 @@
+package index
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/jobala/petro/util"
+	"github.com/stretchr/testify/assert"
+)
+
+type person struct {
+	Name string
+	City string
+	Age  int
+}
+
+func TestSecondaryIndex(t *testing.T) {
+	t.Run("returns records by secondary key", func(t *testing.T) {
+		people := newTestTree[string, person](t, "people")
+
+		err := AddIndex(people, "city", func(p person) string { return p.City })
+		assert.NoError(t, err)
+
+		for _, p := range []person{
+			{Name: "john", City: "nairobi", Age: 25},
+			{Name: "jane", City: "mombasa", Age: 40},
+			{Name: "doe", City: "nairobi", Age: 45},
+		} {
+			_, err := people.Put(p.Name, p)
+			assert.NoError(t, err)
+		}
+
+		res, err := GetBy(people, "city", "nairobi")
+		assert.NoError(t, err)
+		assert.Equal(t, []person{
+			{Name: "doe", City: "nairobi", Age: 45},
+			{Name: "john", City: "nairobi", Age: 25},
+		}, res)
+
+		res, err = GetBy(people, "city", "kisumu")
+		assert.NoError(t, err)
+		assert.Empty(t, res)
+	})
+
+	t.Run("follows updates and deletes", func(t *testing.T) {
+		people := newTestTree[string, person](t, "people")
+
+		err := AddIndex(people, "age", func(p person) int { return p.Age })
+		assert.NoError(t, err)
+
+		_, err = people.Put("john", person{Name: "john", Age: 25})
+		assert.NoError(t, err)
+		_, err = people.Put("jane", person{Name: "jane", Age: 25})
+		assert.NoError(t, err)
+
+		// john moves to a different secondary key
+		_, err = people.Put("john", person{Name: "john", Age: 26})
+		assert.NoError(t, err)
+
+		res, err := GetBy(people, "age", 25)
+		assert.NoError(t, err)
+		assert.Equal(t, []person{{Name: "jane", Age: 25}}, res)
+
+		res, err = GetBy(people, "age", 26)
+		assert.NoError(t, err)
+		assert.Equal(t, []person{{Name: "john", Age: 26}}, res)
+
+		_, err = people.Delete("jane")
+		assert.NoError(t, err)
+
+		res, err = GetBy(people, "age", 25)
+		assert.NoError(t, err)
+		assert.Empty(t, res)
+	})
+
+	t.Run("builds an index over existing records", func(t *testing.T) {
+		people := newTestTree[int, person](t, "people")
+
+		for i := range 300 {
+			_, err := people.Put(i, person{Name: fmt.Sprint(i), Age: i % 150})
+			assert.NoError(t, err)
+		}
+
+		err := AddIndex(people, "age", func(p person) int { return p.Age })
+		assert.NoError(t, err)
+
+		for age := range 150 {
+			res, err := GetBy(people, "age", age)
+			assert.NoError(t, err)
+			assert.Equal(t, []person{
+				{Name: fmt.Sprint(age), Age: age},
+				{Name: fmt.Sprint(age + 150), Age: age},
+			}, res)
+		}
+	})
+
+	t.Run("keeps records sharing a secondary key apart", func(t *testing.T) {
+		people := newTestTree[int, person](t, "people")
+
+		err := AddIndex(people, "city", func(p person) string { return p.City })
+		assert.NoError(t, err)
+
+		// cities that are prefixes of each other
+		for i := range 400 {
+			city := []string{"nai", "nairobi"}[i%2]
+			_, err := people.Put(i, person{Name: fmt.Sprint(i), City: city})
+			assert.NoError(t, err)
+		}
+
+		for i := 0; i < 400; i += 4 {
+			_, err := people.Delete(i)
+			assert.NoError(t, err)
+		}
+
+		res, err := GetBy(people, "city", "nai")
+		assert.NoError(t, err)
+		assert.Equal(t, 100, len(res))
+		for i, p := range res {
+			assert.Equal(t, person{Name: fmt.Sprint(i*4 + 2), City: "nai"}, p)
+		}
+
+		res, err = GetBy(people, "city", "nairobi")
+		assert.NoError(t, err)
+		assert.Equal(t, 200, len(res))
+	})
+
+	t.Run("rebuilds an index that missed writes", func(t *testing.T) {
+		people := newTestTree[string, person](t, "people")
+		bpm := people.bpm
+
+		err := AddIndex(people, "city", func(p person) string { return p.City })
+		assert.NoError(t, err)
+
+		_, err = people.Put("john", person{Name: "john", City: "nairobi"})
+		assert.NoError(t, err)
+
+		// the tree is reopened and written to before the index is added again
+		reopened, err := NewBplusTree[string, person]("people", bpm)
+		assert.NoError(t, err)
+
+		_, err = reopened.Put("john", person{Name: "john", City: "mombasa"})
+		assert.NoError(t, err)
+		_, err = reopened.Put("jane", person{Name: "jane", City: "nairobi"})
+		assert.NoError(t, err)
+
+		err = AddIndex(reopened, "city", func(p person) string { return p.City })
+		assert.NoError(t, err)
+
+		res, err := GetBy(reopened, "city", "nairobi")
+		assert.NoError(t, err)
+		assert.Equal(t, []person{{Name: "jane", City: "nairobi"}}, res)
+
+		res, err = GetBy(reopened, "city", "mombasa")
+		assert.NoError(t, err)
+		assert.Equal(t, []person{{Name: "john", City: "mombasa"}}, res)
+	})
+
+	t.Run("rejects unknown indexes and mismatched key types", func(t *testing.T) {
+		people := newTestTree[string, person](t, "people")
+
+		err := AddIndex(people, "age", func(p person) int { return p.Age })
+		assert.NoError(t, err)
+
+		err = AddIndex(people, "age", func(p person) int { return p.Age })
+		assert.Error(t, err)
+
+		_, err = GetBy(people, "city", "nairobi")
+		assert.Error(t, err)
+
+		_, err = GetBy(people, "age", "25")
+		assert.Error(t, err)
+	})
+
+	t.Run("keeps index trees apart from user trees", func(t *testing.T) {
+		people := newTestTree[string, person](t, "people")
+		bpm := people.bpm
+
+		err := AddIndex(people, "city", func(p person) string { return p.City })
+		assert.NoError(t, err)
+		_, err = people.Put("john", person{Name: "john", City: "nairobi"})
+		assert.NoError(t, err)
+
+		// a user tree named like the index doesn't share its pages
+		other, err := NewBplusTree[string, int]("people/city", bpm)
+		assert.NoError(t, err)
+		_, err = other.Put("nairobi", 1)
+		assert.NoError(t, err)
+
+		res, err := GetBy(people, "city", "nairobi")
+		assert.NoError(t, err)
+		assert.Equal(t, []person{{Name: "john", City: "nairobi"}}, res)
+
+		err = AddIndex(people, "by/city", func(p person) string { return p.City })
+		assert.ErrorIs(t, err, util.ErrReservedName)
+
+		_, err = NewBplusTree[string, int](RESERVED_PREFIX+"index/people/city", bpm)
+		assert.ErrorIs(t, err, util.ErrReservedName)
+
+		_, err = NewExtendibleHash[string, int](RESERVED_PREFIX+"sessions", bpm)
+		assert.ErrorIs(t, err, util.ErrReservedName)
+	})
+
+	t.Run("a put the index refuses changes nothing", func(t *testing.T) {
+		people := newTestTree[string, person](t, "people")
+
+		err := AddIndex(people, "city", func(p person) string { return p.City })
+		assert.NoError(t, err)
+
+		_, err = people.Put("john", person{Name: "john", City: "nairobi"})
+		assert.NoError(t, err)
+
+		// the index entry pairs the city with the name, it's over the
+		// largest key a tree takes
+		city := strings.Repeat("c", MAX_KEY_SIZE)
+		_, err = people.Put("jane", person{Name: "jane", City: city})
+		assert.ErrorIs(t, err, util.ErrKeyTooLarge)
+		_, err = people.Put("john", person{Name: "john", City: city})
+		assert.ErrorIs(t, err, util.ErrKeyTooLarge)
+
+		_, err = people.Get("jane")
+		assert.ErrorIs(t, err, util.ErrKeyNotFound)
+		res, err := people.Get("john")
+		assert.NoError(t, err)
+		assert.Equal(t, "nairobi", res[0].City)
+
+		res, err = GetBy(people, "city", city)
+		assert.NoError(t, err)
+		assert.Empty(t, res)
+		res, err = GetBy(people, "city", "nairobi")
+		assert.NoError(t, err)
+		assert.Len(t, res, 1)
+	})
+
+	t.Run("follows the primary's key limit", func(t *testing.T) {
+		people := newTestTree[string, person](t, "people")
+
+		err := AddIndex(people, "age", func(p person) int { return p.Age })
+		assert.NoError(t, err)
+		assert.NoError(t, people.SetSizeLimits(SizeLimits{MaxKeySize: 400, MaxValueSize: DEFAULT_MAX_VALUE_SIZE}))
+
+		// the name is over the default key limit the index started with
+		name := strings.Repeat("n", 300)
+		_, err = people.Put(name, person{Name: name, Age: 30})
+		assert.NoError(t, err)
+
+		res, err := GetBy(people, "age", 30)
+		assert.NoError(t, err)
+		assert.Len(t, res, 1)
+	})
+}
@@ -0,0 +1,175 @@
+package index
+
+import (
+	"fmt"
+
+	"github.com/jobala/petro/buffer"
+	"github.com/jobala/petro/storage/disk"
+	"github.com/jobala/petro/util"
+)
+
+const (
+	// MAX_ENTRY_SIZE and MAX_KEY_SIZE are MaxEntrySize and MaxKeySize for
+	// pages of disk.PAGE_SIZE
+	MAX_ENTRY_SIZE = disk.PAGE_SIZE / 4
+	MAX_KEY_SIZE   = MAX_ENTRY_SIZE / 2
+
+	DEFAULT_MAX_KEY_SIZE   = 256
+	DEFAULT_MAX_VALUE_SIZE = 1 << 20
+)
+
+// SizeLimits caps the size of keys and values, measured as the length of
+// their gob encoding on its own. Values that don't fit next to a key of
+// MaxKeySize in a leaf are stored in overflow pages.
+type SizeLimits struct {
+	MaxKeySize   int
+	MaxValueSize int
+}
+
+// MaxEntrySize bounds a key and the value stored next to it in a leaf of
+// pageSize bytes. A leaf that overflows with entries this large still splits
+// into two halves that each fit in a page.
+func MaxEntrySize(pageSize int) int {
+	return pageSize / 4
+}
+
+// MaxKeySize is the largest key a tree with pages of pageSize bytes takes
+func MaxKeySize(pageSize int) int {
+	return MaxEntrySize(pageSize) / 2
+}
+
+func DefaultSizeLimits() SizeLimits {
+	return SizeLimits{
+		MaxKeySize:   DEFAULT_MAX_KEY_SIZE,
+		MaxValueSize: DEFAULT_MAX_VALUE_SIZE,
+	}
+}
+
+// SetSizeLimits changes the limits Put, PutWithTTL and Merge enforce. Entries
+// stored under earlier limits are kept.
+func (b *bplusTree[K, V]) SetSizeLimits(limits SizeLimits) error {
+	if limits.MaxKeySize <= 0 || limits.MaxValueSize <= 0 {
+		return fmt.Errorf("size limits must be positive, got %+v", limits)
+	}
+	if maxKey := MaxKeySize(b.bpm.PageSize()); limits.MaxKeySize > maxKey {
+		return fmt.Errorf("keys can take at most %d bytes, got %d", maxKey, limits.MaxKeySize)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.limits = limits
+	for name, idx := range b.indexes {
+		if err := idx.setLimits(indexLimits(limits, b.bpm.PageSize())); err != nil {
+			return fmt.Errorf("error setting the limits of index %s: %w", name, err)
+		}
+	}
+	if b.expiry != nil {
+		if err := b.expiry.SetSizeLimits(indexLimits(limits, b.bpm.PageSize())); err != nil {
+			return fmt.Errorf("error setting the limits of the expiry index: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// indexLimits are the limits of the trees indexing a tree with limits and
+// pages of pageSize bytes. Their keys pair another key with one of the tree's
+// keys and their values are the tree's keys.
+func indexLimits(limits SizeLimits, pageSize int) SizeLimits {
+	return SizeLimits{MaxKeySize: MaxKeySize(pageSize), MaxValueSize: limits.MaxKeySize}
+}
+
+// inlineLimit is the size of the largest value stored in a leaf
+func (b *bplusTree[K, V]) inlineLimit() int {
+	return MaxEntrySize(b.bpm.PageSize()) - b.limits.MaxKeySize
+}
+
+// checkSize checks an entry against the tree's limits
+func (b *bplusTree[K, V]) checkSize(key K, value V) ([]byte, error) {
+	return b.limits.check(key, value)
+}
+
+// checkIndexed checks the entries a Put of key and value adds to the secondary
+// and expiry indexes against their limits, so that an entry an index would
+// refuse fails the Put before the tree is changed
+func (b *bplusTree[K, V]) checkIndexed(key K, value V, meta slotMeta) error {
+	for name, idx := range b.indexes {
+		if err := idx.check(key, value); err != nil {
+			return fmt.Errorf("error indexing %v in %s: %w", key, name, err)
+		}
+	}
+
+	if meta.ExpiresAt != 0 {
+		if _, err := indexLimits(b.limits, b.bpm.PageSize()).check(postingKey(meta.ExpiresAt, key), key); err != nil {
+			return fmt.Errorf("error tracking the expiry of %v: %w", key, err)
+		}
+	}
+
+	return nil
+}
+
+// check fails with ErrKeyTooLarge or ErrValueTooLarge when an entry is over
+// the limits, it returns the value's encoding
+func (l SizeLimits) check(key, value any) ([]byte, error) {
+	keySize, err := encodedSize(key)
+	if err != nil {
+		return nil, err
+	}
+	if keySize > l.MaxKeySize {
+		return nil, fmt.Errorf("%w: %d bytes, the limit is %d", util.ErrKeyTooLarge, keySize, l.MaxKeySize)
+	}
+
+	data, err := buffer.ToByteSlice(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > l.MaxValueSize {
+		return nil, fmt.Errorf("%w: %d bytes, the limit is %d", util.ErrValueTooLarge, len(data), l.MaxValueSize)
+	}
+
+	return data, nil
+}
+
+func entrySize[K, V any](key K, value V) (int, error) {
+	keySize, err := encodedSize(key)
+	if err != nil {
+		return 0, err
+	}
+
+	valueSize, err := encodedSize(value)
+	if err != nil {
+		return 0, err
+	}
+
+	return keySize + valueSize, nil
+}
+
+// balancedSplit returns the index that splits n entries into two halves of
+// about the same size, neither of them empty
+func balancedSplit(n int, size func(int) (int, error)) (int, error) {
+	if n < 2 {
+		return 0, fmt.Errorf("%w: a single entry does not fit in a page", util.ErrPageOverflow)
+	}
+
+	sizes := make([]int, n)
+	total := 0
+	for i := range n {
+		s, err := size(i)
+		if err != nil {
+			return 0, err
+		}
+		sizes[i] = s
+		total += s
+	}
+
+	prefix := 0
+	for i := range n - 1 {
+		prefix += sizes[i]
+		if prefix*2 >= total {
+			return i + 1, nil
+		}
+	}
+
+	return n - 1, nil
+}
@@ -0,0 +1,223 @@
+package index
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jobala/petro/storage/disk"
+	"github.com/jobala/petro/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSizeLimits(t *testing.T) {
+	t.Run("rejects keys and values over the limits", func(t *testing.T) {
+		bplus := newTestTree[string, string](t, "test")
+		bplus.SetMergeOperator(func(existing string, _ bool, operand string) string {
+			return existing + operand
+		})
+
+		assert.NoError(t, bplus.SetSizeLimits(SizeLimits{MaxKeySize: DEFAULT_MAX_KEY_SIZE, MaxValueSize: 4096}))
+
+		_, err := bplus.Put(strings.Repeat("k", DEFAULT_MAX_KEY_SIZE), "value")
+		assert.ErrorIs(t, err, util.ErrKeyTooLarge)
+
+		_, err = bplus.Put("john", strings.Repeat("v", 4096))
+		assert.ErrorIs(t, err, util.ErrValueTooLarge)
+
+		_, err = bplus.PutWithTTL("john", strings.Repeat("v", 4096), time.Minute)
+		assert.ErrorIs(t, err, util.ErrValueTooLarge)
+
+		_, err = bplus.Put("john", strings.Repeat("v", 2048))
+		assert.NoError(t, err)
+
+		// the merged value is checked, the stored one is kept
+		_, err = bplus.Merge("john", strings.Repeat("v", 2048))
+		assert.ErrorIs(t, err, util.ErrValueTooLarge)
+
+		val, err := bplus.Get("john")
+		assert.NoError(t, err)
+		assert.Equal(t, strings.Repeat("v", 2048), val[0])
+	})
+
+	t.Run("limits can be changed", func(t *testing.T) {
+		bplus := newTestTree[string, string](t, "test")
+
+		assert.NoError(t, bplus.SetSizeLimits(SizeLimits{MaxKeySize: 16, MaxValueSize: 16}))
+
+		_, err := bplus.Put("john", "doe")
+		assert.NoError(t, err)
+		_, err = bplus.Put("john", strings.Repeat("v", 16))
+		assert.ErrorIs(t, err, util.ErrValueTooLarge)
+		_, err = bplus.Put(strings.Repeat("k", 16), "doe")
+		assert.ErrorIs(t, err, util.ErrKeyTooLarge)
+
+		assert.Error(t, bplus.SetSizeLimits(SizeLimits{MaxKeySize: 0, MaxValueSize: 16}))
+		assert.Error(t, bplus.SetSizeLimits(SizeLimits{MaxKeySize: MAX_KEY_SIZE + 1, MaxValueSize: 16}))
+	})
+
+	t.Run("large entries split pages by size", func(t *testing.T) {
+		bplus := newTestTree[string, string](t, "test")
+
+		// keys this long overflow pages after a handful of entries
+		key := func(i int) string {
+			return fmt.Sprintf("%04d%s", i, strings.Repeat("k", DEFAULT_MAX_KEY_SIZE-16))
+		}
+		value := func(i, size int) string {
+			return fmt.Sprintf("%04d%s", i, strings.Repeat("v", size))
+		}
+
+		keys := rand.Perm(500)
+		for _, i := range keys {
+			_, err := bplus.Put(key(i), value(i, 10))
+			assert.NoError(t, err)
+		}
+
+		// growing values split leaves that were not full
+		for _, i := range keys {
+			_, err := bplus.Put(key(i), value(i, MAX_ENTRY_SIZE-DEFAULT_MAX_KEY_SIZE-16))
+			assert.NoError(t, err)
+		}
+
+		assertTree := func(expected []int) {
+			t.Helper()
+
+			dump, err := bplus.Dump()
+			assert.NoError(t, err)
+			assert.Equal(t, "internal", dump.Pages[0].Type)
+
+			indexIter := bplus.GetIterator()
+			res := []int{}
+			for !indexIter.IsEnd() {
+				k, v, err := indexIter.Next()
+				assert.NoError(t, err)
+				assert.Equal(t, k[:4], v[:4])
+
+				var i int
+				_, _ = fmt.Sscanf(k[:4], "%d", &i)
+				res = append(res, i)
+			}
+			assert.Equal(t, expected, res)
+
+			for _, i := range expected {
+				val, err := bplus.Get(key(i))
+				assert.NoError(t, err)
+				assert.Equal(t, value(i, MAX_ENTRY_SIZE-DEFAULT_MAX_KEY_SIZE-16), val[0])
+			}
+		}
+
+		expected := []int{}
+		for i := range 500 {
+			expected = append(expected, i)
+		}
+		assertTree(expected)
+
+		// deletes borrow and merge without overflowing pages
+		for _, i := range keys[:400] {
+			_, err := bplus.Delete(key(i))
+			assert.NoError(t, err)
+		}
+
+		expected = []int{}
+		for i := range 500 {
+			if !slices.Contains(keys[:400], i) {
+				expected = append(expected, i)
+			}
+		}
+		assertTree(expected)
+	})
+
+	t.Run("pages are written without their unused slots", func(t *testing.T) {
+		file := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(file.Name())
+		})
+
+		bpm := createBpm(file)
+		bplus, err := NewBplusTree[int, [64]byte]("test", bpm)
+		assert.NoError(t, err)
+
+		// a page padded to all of its slots with values of 64 bytes would overflow
+		for i := range 300 {
+			_, err := bplus.Put(i, [64]byte{byte(i)})
+			assert.NoError(t, err)
+		}
+		assert.NoError(t, bplus.Flush())
+
+		reopened, err := NewBplusTree[int, [64]byte]("test", createBpm(file))
+		assert.NoError(t, err)
+		for i := range 300 {
+			val, err := reopened.Get(i)
+			assert.NoError(t, err)
+			assert.Equal(t, [64]byte{byte(i)}, val[0])
+		}
+	})
+}
+
+func TestPageOverflow(t *testing.T) {
+	large := strings.Repeat("x", disk.PAGE_SIZE)
+
+	t.Run("leaf pages", func(t *testing.T) {
+		var page bplusLeafPage[string, string]
+		page.init(1, disk.INVALID_PAGE_ID, disk.PAGE_SIZE)
+		page.setKeyAt(0, "john")
+		page.setValAt(0, large)
+		page.Size = 1
+
+		_, err := page.encode()
+		assert.ErrorIs(t, err, util.ErrPageOverflow)
+	})
+
+	t.Run("internal pages", func(t *testing.T) {
+		var page bplusInternalPage[string]
+		page.init(1, disk.INVALID_PAGE_ID, disk.PAGE_SIZE)
+		page.setKeyAt(1, large)
+		page.Size = 2
+
+		_, err := page.encode()
+		assert.ErrorIs(t, err, util.ErrPageOverflow)
+	})
+
+	t.Run("the catalog", func(t *testing.T) {
+		file := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(file.Name())
+		})
+
+		bpm := createBpm(file)
+		err := updateCatalog(bpm, func(catalog *catalogPage) error {
+			catalog.HashIndexes = map[string]int64{large: 1}
+			return nil
+		})
+		assert.ErrorIs(t, err, util.ErrPageOverflow)
+
+		// the catalog on the page is left as it was
+		catalog, err := readCatalog(bpm)
+		assert.NoError(t, err)
+		assert.Empty(t, catalog.HashIndexes)
+	})
+
+	t.Run("hash pages", func(t *testing.T) {
+		file := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(file.Name())
+		})
+
+		bpm := createBpm(file)
+		guard, err := bpm.WritePage(bpm.NewPageId())
+		assert.NoError(t, err)
+		defer guard.Drop()
+
+		err = writeHashPage(guard, hashBucketPage[string, string]{Keys: []string{"john"}, Values: []string{large}})
+		assert.ErrorIs(t, err, util.ErrPageOverflow)
+	})
+
+	t.Run("bloom pages", func(t *testing.T) {
+		_, err := encodePage(bloomPage{Bits: []byte(large)}, disk.PAGE_SIZE)
+		assert.ErrorIs(t, err, util.ErrPageOverflow)
+	})
+}
@@ -0,0 +1,228 @@
+package index
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/jobala/petro/buffer"
+	"github.com/jobala/petro/storage/disk"
+	"github.com/jobala/petro/util"
+)
+
+// DumpFile dumps the tree called name in file without writing to the file. It
+// only reads the catalog and the tree's pages, the Bloom filter and value log
+// aren't opened and nothing is flushed or synced, so a file that wasn't closed
+// cleanly is dumped as it is. opts are the same as New's, the codec and keys
+// have to match the file's. file is closed before DumpFile returns, a name the
+// file has no tree for fails with util.ErrTreeNotFound.
+func DumpFile[K cmp.Ordered, V any](name string, file *os.File, opts ...Options) (*TreeDump[K], error) {
+	o, err := resolveOptions(opts)
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	o.SyncMode, o.SyncInterval = disk.SYNC_NONE, 0
+
+	// the pool is never flushed, only the scheduler is closed
+	diskScheduler := newDiskScheduler(file, o)
+	bpm := buffer.NewPartitionedBufferpoolManager(o.PoolFrames, o.Partitions, o.K, diskScheduler)
+
+	dump, err := dumpStored[K, V](name, bpm)
+	return dump, errors.Join(err, diskScheduler.Close())
+}
+
+func dumpStored[K cmp.Ordered, V any](name string, bpm *buffer.BufferpoolManager) (*TreeDump[K], error) {
+	catalog, err := readCatalog(bpm)
+	if err != nil {
+		return nil, err
+	}
+
+	header, ok := catalog.header(name)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", util.ErrTreeNotFound, name)
+	}
+
+	tree := &bplusTree[K, V]{indexName: name, bpm: bpm, header: header}
+	return tree.Dump()
+}
+
+// Dump walks the tree from the root page and returns a snapshot of every
+// reachable page. It is meant for debugging splits and merges.
+func (b *bplusTree[K, V]) Dump() (*TreeDump[K], error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if err := b.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	dump := &TreeDump[K]{
+		Name:       b.indexName,
+		RootPageId: b.header.RootPageId,
+		Pages:      []PageDump[K]{},
+	}
+
+	if b.isEmpty() {
+		return dump, nil
+	}
+
+	visited := map[int64]bool{}
+	queue := []int64{b.header.RootPageId}
+
+	for len(queue) > 0 {
+		pageId := queue[0]
+		queue = queue[1:]
+
+		// a broken tree can point back at a page we've already seen
+		if visited[pageId] {
+			continue
+		}
+		visited[pageId] = true
+
+		page, err := b.dumpPage(pageId)
+		if err != nil {
+			return nil, err
+		}
+
+		dump.Pages = append(dump.Pages, page)
+		queue = append(queue, page.Children...)
+	}
+
+	return dump, nil
+}
+
+func (b *bplusTree[K, V]) dumpPage(pageId int64) (PageDump[K], error) {
+	guard, err := b.bpm.ReadPage(pageId)
+	if err != nil {
+		return PageDump[K]{}, fmt.Errorf("error reading page %d: %w", pageId, err)
+	}
+	defer guard.Drop()
+
+	meta, err := readPageMeta(guard.GetData())
+	if err != nil {
+		return PageDump[K]{}, fmt.Errorf("error casting page %d: %v", pageId, err)
+	}
+
+	if meta.PageType == LEAF_PAGE {
+		leafPage, err := decodeLeaf[K, V](guard.GetData())
+		if err != nil {
+			return PageDump[K]{}, fmt.Errorf("error casting page %d: %v", pageId, err)
+		}
+
+		return PageDump[K]{
+			PageId: pageId,
+			Type:   "leaf",
+			Parent: leafPage.Parent,
+			Keys:   slotsOf(leafPage.Keys, leafPage.getSize()),
+			Next:   leafPage.Next,
+			Prev:   leafPage.Prev,
+		}, nil
+	}
+
+	internalPage, err := decodeInternal[K](guard.GetData())
+	if err != nil {
+		return PageDump[K]{}, fmt.Errorf("error casting page %d: %v", pageId, err)
+	}
+
+	// the first key of an internal page is unused
+	keys := []K{}
+	if internalPage.getSize() > 1 {
+		keys = slotsOf(internalPage.Keys, internalPage.getSize())[1:]
+	}
+
+	return PageDump[K]{
+		PageId:   pageId,
+		Type:     "internal",
+		Parent:   internalPage.Parent,
+		Keys:     keys,
+		Children: slotsOf(internalPage.Values, internalPage.getSize()),
+		Next:     internalPage.Next,
+		Prev:     internalPage.Prev,
+	}, nil
+}
+
+// WriteJSON writes the tree dump as an indented JSON document.
+func (d *TreeDump[K]) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(d)
+}
+
+// WriteDot writes the tree dump as a graphviz digraph. Child pointers are
+// solid edges and sibling links are dashed edges.
+func (d *TreeDump[K]) WriteDot(w io.Writer) error {
+	var sb strings.Builder
+
+	fmt.Fprintf(&sb, "digraph %s {\n", dotQuote(d.Name))
+	sb.WriteString("  node [shape=record];\n")
+
+	for _, page := range d.Pages {
+		keys := make([]string, len(page.Keys))
+		for i, key := range page.Keys {
+			keys[i] = dotEscape(fmt.Sprint(key))
+		}
+
+		label := fmt.Sprintf("{%s %d|%s}", page.Type, page.PageId, strings.Join(keys, "|"))
+		fmt.Fprintf(&sb, "  page%d [label=\"%s\"];\n", page.PageId, label)
+	}
+
+	for _, page := range d.Pages {
+		for _, child := range page.Children {
+			fmt.Fprintf(&sb, "  page%d -> page%d;\n", page.PageId, child)
+		}
+
+		if page.Type == "leaf" && page.Next != 0 {
+			fmt.Fprintf(&sb, "  page%d -> page%d [style=dashed, constraint=false];\n", page.PageId, page.Next)
+		}
+	}
+
+	sb.WriteString("}\n")
+
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func slotsOf[T any](arr []T, size int) []T {
+	res := make([]T, min(size, len(arr)))
+	copy(res, arr)
+	return res
+}
+
+func dotQuote(s string) string {
+	return "\"" + strings.ReplaceAll(s, "\"", "\\\"") + "\""
+}
+
+func dotEscape(s string) string {
+	replacer := strings.NewReplacer(
+		"\\", "\\\\",
+		"\"", "\\\"",
+		"{", "\\{",
+		"}", "\\}",
+		"|", "\\|",
+		"<", "\\<",
+		">", "\\>",
+		"\n", "\\n",
+	)
+	return replacer.Replace(s)
+}
+
+type TreeDump[K cmp.Ordered] struct {
+	Name       string        `json:"name"`
+	RootPageId int64         `json:"root_page_id"`
+	Pages      []PageDump[K] `json:"pages"`
+}
+
+type PageDump[K cmp.Ordered] struct {
+	PageId   int64   `json:"page_id"`
+	Type     string  `json:"type"`
+	Parent   int64   `json:"parent"`
+	Keys     []K     `json:"keys"`
+	Children []int64 `json:"children,omitempty"`
+	Next     int64   `json:"next"`
+	Prev     int64   `json:"prev"`
+}
@@ -0,0 +1,166 @@
+package index
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/jobala/petro/storage/disk"
+	"github.com/jobala/petro/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTreeDump(t *testing.T) {
+	t.Run("dumps every page reachable from the root", func(t *testing.T) {
+		bplus := newTestTree[int, int](t, "test")
+
+		for i := 2000; i >= 0; i-- {
+			_, err := bplus.Put(i, i)
+			assert.NoError(t, err)
+		}
+
+		dump, err := bplus.Dump()
+		assert.NoError(t, err)
+		assert.Equal(t, bplus.header.RootPageId, dump.RootPageId)
+		assert.Equal(t, dump.RootPageId, dump.Pages[0].PageId)
+		assert.Equal(t, "internal", dump.Pages[0].Type)
+
+		keys := []int{}
+		for _, page := range dump.Pages {
+			if page.Type == "leaf" {
+				keys = append(keys, page.Keys...)
+			}
+		}
+
+		expected := []int{}
+		for i := range 2001 {
+			expected = append(expected, i)
+		}
+		assert.Equal(t, expected, keys)
+	})
+
+	t.Run("children point back at their parent after internal splits", func(t *testing.T) {
+		bplus := newTestTree[string, int](t, "test")
+
+		// keys come in fours that only differ in their last byte, so leaves
+		// mostly split inside a group and the long separators keep internal
+		// pages to a few entries
+		for i := range 2000 {
+			_, err := bplus.Put(fmt.Sprintf("%05d%s%d", i/4, strings.Repeat("k", 200), i%4), i)
+			assert.NoError(t, err)
+		}
+
+		dump, err := bplus.Dump()
+		assert.NoError(t, err)
+
+		internal := 0
+		parents := map[int64]int64{}
+		for _, page := range dump.Pages {
+			if page.Type == "internal" {
+				internal++
+			}
+			for _, child := range page.Children {
+				parents[child] = page.PageId
+			}
+		}
+
+		assert.Greater(t, internal, 1)
+
+		for _, page := range dump.Pages[1:] {
+			assert.Equal(t, parents[page.PageId], page.Parent, "page %d", page.PageId)
+		}
+	})
+
+	t.Run("dumps an empty tree", func(t *testing.T) {
+		bplus := newTestTree[int, int](t, "test")
+
+		dump, err := bplus.Dump()
+		assert.NoError(t, err)
+		assert.Empty(t, dump.Pages)
+	})
+
+	t.Run("writes json and dot", func(t *testing.T) {
+		bplus := newTestTree[string, string](t, "test")
+
+		// the values spread the keys over a few leaves
+		for i := range 150 {
+			_, err := bplus.Put(fmt.Sprintf("key|%03d", i), strings.Repeat("v", 100))
+			assert.NoError(t, err)
+		}
+
+		dump, err := bplus.Dump()
+		assert.NoError(t, err)
+
+		var jsonOut bytes.Buffer
+		assert.NoError(t, dump.WriteJSON(&jsonOut))
+
+		decoded := TreeDump[string]{}
+		assert.NoError(t, json.Unmarshal(jsonOut.Bytes(), &decoded))
+		assert.Equal(t, *dump, decoded)
+
+		var dotOut bytes.Buffer
+		assert.NoError(t, dump.WriteDot(&dotOut))
+
+		dot := dotOut.String()
+		assert.True(t, strings.HasPrefix(dot, "digraph \"test\" {"))
+		assert.Contains(t, dot, "key\\|000")
+		assert.Contains(t, dot, "style=dashed")
+		for _, child := range dump.Pages[0].Children {
+			assert.Contains(t, dot, fmt.Sprintf("page%d -> page%d;", dump.RootPageId, child))
+		}
+	})
+
+	t.Run("dumps a file without writing to it", func(t *testing.T) {
+		file := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(file.Name())
+		})
+
+		keys := disk.StaticKeys{Current: 1, Keys: map[uint32][]byte{1: bytes.Repeat([]byte{1}, 32)}}
+		opts := Options{Keys: keys}
+
+		bplus, err := New[int, int]("test", file, opts)
+		assert.NoError(t, err)
+		assert.NoError(t, bplus.EnableBloomFilter(1000, 0.01))
+		for i := range 300 {
+			_, err := bplus.Put(i, i)
+			assert.NoError(t, err)
+		}
+
+		// the tree isn't closed, opening it again would rebuild the filter
+		assert.NoError(t, bplus.Flush())
+		before, err := os.ReadFile(file.Name())
+		assert.NoError(t, err)
+
+		open := func() *os.File {
+			file, err := os.Open(file.Name())
+			assert.NoError(t, err)
+			return file
+		}
+
+		dump, err := DumpFile[int, int]("test", open(), opts)
+		assert.NoError(t, err)
+		dumped := []int{}
+		for _, page := range dump.Pages {
+			if page.Type == "leaf" {
+				dumped = append(dumped, page.Keys...)
+			}
+		}
+		assert.Len(t, dumped, 300)
+
+		after, err := os.ReadFile(file.Name())
+		assert.NoError(t, err)
+		assert.Equal(t, before, after)
+
+		_, err = DumpFile[int, int]("missing", open(), opts)
+		assert.ErrorIs(t, err, util.ErrTreeNotFound)
+
+		_, err = DumpFile[int, int]("test", open())
+		assert.ErrorIs(t, err, util.ErrFormatMismatch)
+
+		assert.NoError(t, bplus.Close())
+	})
+}
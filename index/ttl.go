@@ -0,0 +1,255 @@
+package index
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jobala/petro/util"
+)
+
+// PutWithTTL inserts key or replaces its value like Put, the entry expires
+// once ttl has passed.
+//
+// Expired entries are invisible to Get, iterators and range scans. Readers
+// note the expired keys they come across and the next write reclaims them,
+// the rest are reclaimed by SweepExpired.
+func (b *bplusTree[K, V]) PutWithTTL(key K, value V, ttl time.Duration) (bool, error) {
+	if ttl <= 0 {
+		return false, fmt.Errorf("ttl must be positive, got %v", ttl)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.checkOpen(); err != nil {
+		return false, err
+	}
+
+	if err := b.reclaimExpired(); err != nil {
+		return false, err
+	}
+
+	meta := slotMeta{ExpiresAt: b.now().Add(ttl).UnixNano()}
+	if _, err := b.store(key, setTo(value, meta)); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// SweepExpired removes every expired entry and returns how many were removed.
+// The expiry index is ordered by expiry time, so only expired entries are
+// visited.
+func (b *bplusTree[K, V]) SweepExpired() (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.checkOpen(); err != nil {
+		return 0, err
+	}
+
+	expiry, err := b.expiryIndex()
+	if err != nil {
+		return 0, err
+	}
+
+	now := b.now().UnixNano()
+
+	// entries expiring by now sort before the first one expiring after it
+	bound := string(appendKey(nil, now+1))
+	keys, err := scanPostings(expiry, "", func(entry string) bool {
+		return entry < bound
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	swept := 0
+	for _, key := range keys {
+		ok, err := b.expire(key, now)
+		if err != nil {
+			return swept, err
+		}
+		if ok {
+			swept++
+		}
+	}
+
+	return swept, nil
+}
+
+// StartExpirySweeper runs SweepExpired every interval until
+// StopExpirySweeper is called. Starting a running sweeper restarts it.
+func (b *bplusTree[K, V]) StartExpirySweeper(interval time.Duration) {
+	b.StopExpirySweeper()
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	b.sweeperMu.Lock()
+	b.sweeperStop, b.sweeperDone = stop, done
+	b.sweeperMu.Unlock()
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				// a failed sweep leaves the keys in place for the next one
+				_, _ = b.SweepExpired()
+			}
+		}
+	}()
+}
+
+// StopExpirySweeper stops the sweeper and waits for it to exit
+func (b *bplusTree[K, V]) StopExpirySweeper() {
+	b.sweeperMu.Lock()
+	stop, done := b.sweeperStop, b.sweeperDone
+	b.sweeperStop, b.sweeperDone = nil, nil
+	b.sweeperMu.Unlock()
+
+	if stop == nil {
+		return
+	}
+
+	close(stop)
+	<-done
+}
+
+// noteExpired records an expired key seen by a reader. Readers only hold the
+// read lock, so the key is removed by the next writer.
+func (b *bplusTree[K, V]) noteExpired(key K) {
+	b.expiredMu.Lock()
+	defer b.expiredMu.Unlock()
+
+	if b.expired == nil {
+		b.expired = map[K]struct{}{}
+	}
+	b.expired[key] = struct{}{}
+}
+
+// reclaimExpired removes the expired keys noted by readers, callers must hold
+// the write lock
+func (b *bplusTree[K, V]) reclaimExpired() error {
+	b.expiredMu.Lock()
+	noted := b.expired
+	b.expired = nil
+	b.expiredMu.Unlock()
+
+	now := b.now().UnixNano()
+	for key := range noted {
+		if _, err := b.expire(key, now); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// expire removes key if it has expired by now
+func (b *bplusTree[K, V]) expire(key K, now int64) (bool, error) {
+	if b.isEmpty() {
+		return false, nil
+	}
+
+	meta, err := b.metaOf(key)
+	if errors.Is(err, util.ErrKeyNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	// the key may have been put again since it was noted
+	if !meta.expired(now) {
+		return false, nil
+	}
+
+	_, ok, err := b.erase(key)
+	return ok, err
+}
+
+// metaOf returns the slot metadata stored with key, expired or not
+func (b *bplusTree[K, V]) metaOf(key K) (slotMeta, error) {
+	leafPageId, err := b.findLeafPageId(b.header.RootPageId, key)
+	if err != nil {
+		return slotMeta{}, err
+	}
+
+	guard, err := b.bpm.ReadPage(leafPageId)
+	if err != nil {
+		return slotMeta{}, err
+	}
+	defer guard.Drop()
+
+	leafPage, err := decodeLeaf[K, V](guard.GetData())
+	if err != nil {
+		return slotMeta{}, err
+	}
+
+	idx := leafPage.getInsertIdx(key)
+	if idx >= leafPage.getSize() || leafPage.keyAt(idx) != key {
+		return slotMeta{}, fmt.Errorf("%w: %v", util.ErrKeyNotFound, key)
+	}
+
+	return leafPage.metaAt(idx), nil
+}
+
+// hideExpired makes indexIter skip the entries that have expired and note
+// them for reclamation
+func (b *bplusTree[K, V]) hideExpired(indexIter *indexIterator[K, V]) *indexIterator[K, V] {
+	indexIter.now = b.now().UnixNano()
+	indexIter.onExpired = b.noteExpired
+	return indexIter
+}
+
+// trackExpiry moves key between expiry times in the expiry index
+func (b *bplusTree[K, V]) trackExpiry(key K, from, to slotMeta) error {
+	if from.ExpiresAt == to.ExpiresAt {
+		return nil
+	}
+
+	expiry, err := b.expiryIndex()
+	if err != nil {
+		return err
+	}
+
+	if from.ExpiresAt != 0 {
+		if err := removePosting(expiry, from.ExpiresAt, key); err != nil {
+			return err
+		}
+	}
+
+	if to.ExpiresAt != 0 {
+		if err := addPosting(expiry, to.ExpiresAt, key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// expiryIndex returns the tree pairing expiry times with the keys expiring at
+// that time. It is opened on first use.
+func (b *bplusTree[K, V]) expiryIndex() (*bplusTree[string, K], error) {
+	if b.expiry != nil {
+		return b.expiry, nil
+	}
+
+	expiry, err := openBplusTree[string, K](RESERVED_PREFIX+"ttl/"+b.indexName, b.bpm)
+	if err != nil {
+		return nil, fmt.Errorf("error opening expiry index: %w", err)
+	}
+	expiry.limits = indexLimits(b.limits, b.bpm.PageSize())
+	b.expiry = expiry
+
+	return expiry, nil
+}
@@ -0,0 +1,191 @@
+package index
+
+import (
+	"cmp"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jobala/petro/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTTL(t *testing.T) {
+	t.Run("expired keys are invisible", func(t *testing.T) {
+		bplus := newTestTree[int, int](t, "test")
+		clock := fakeClock(bplus)
+
+		for i := range 300 {
+			var err error
+			if i%2 == 0 {
+				_, err = bplus.PutWithTTL(i, i, time.Minute)
+			} else {
+				_, err = bplus.Put(i, i)
+			}
+			assert.NoError(t, err)
+		}
+
+		val, err := bplus.Get(0)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, val[0])
+
+		*clock = clock.Add(time.Minute)
+
+		_, err = bplus.Get(0)
+		assert.ErrorIs(t, err, util.ErrKeyNotFound)
+
+		expected := []int{}
+		for i := 1; i < 300; i += 2 {
+			expected = append(expected, i)
+		}
+
+		indexIter := bplus.GetIterator()
+		res := []int{}
+		for !indexIter.IsEnd() {
+			_, val, err := indexIter.Next()
+			assert.NoError(t, err)
+			res = append(res, val)
+		}
+		assert.Equal(t, expected, res)
+
+		res, err = bplus.GetKeyRange(0, 299)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, res)
+
+		page, err := bplus.Page(0, 5)
+		assert.NoError(t, err)
+		assert.Equal(t, []int{1, 3, 5, 7, 9}, page.Keys)
+	})
+
+	t.Run("writes reclaim expired keys seen by readers", func(t *testing.T) {
+		bplus := newTestTree[string, int](t, "test")
+		clock := fakeClock(bplus)
+
+		_, err := bplus.PutWithTTL("session", 1, time.Second)
+		assert.NoError(t, err)
+		_, err = bplus.Put("user", 2)
+		assert.NoError(t, err)
+
+		*clock = clock.Add(time.Second)
+
+		_, err = bplus.Get("session")
+		assert.ErrorIs(t, err, util.ErrKeyNotFound)
+
+		_, err = bplus.Put("other", 3)
+		assert.NoError(t, err)
+
+		_, err = bplus.metaOf("session")
+		assert.ErrorIs(t, err, util.ErrKeyNotFound)
+
+		swept, err := bplus.SweepExpired()
+		assert.NoError(t, err)
+		assert.Equal(t, 0, swept)
+	})
+
+	t.Run("putting a key again replaces its ttl", func(t *testing.T) {
+		bplus := newTestTree[string, int](t, "test")
+		clock := fakeClock(bplus)
+
+		_, err := bplus.PutWithTTL("extended", 1, time.Second)
+		assert.NoError(t, err)
+		_, err = bplus.PutWithTTL("extended", 1, time.Hour)
+		assert.NoError(t, err)
+
+		_, err = bplus.PutWithTTL("persisted", 2, time.Second)
+		assert.NoError(t, err)
+		_, err = bplus.Put("persisted", 2)
+		assert.NoError(t, err)
+
+		*clock = clock.Add(time.Minute)
+
+		swept, err := bplus.SweepExpired()
+		assert.NoError(t, err)
+		assert.Equal(t, 0, swept)
+
+		for _, key := range []string{"extended", "persisted"} {
+			_, err := bplus.Get(key)
+			assert.NoError(t, err)
+		}
+	})
+
+	t.Run("sweeper removes expired keys and their index entries", func(t *testing.T) {
+		people := newTestTree[int, person](t, "people")
+		clock := fakeClock(people)
+
+		err := AddIndex(people, "city", func(p person) string { return p.City })
+		assert.NoError(t, err)
+
+		for i := range 300 {
+			p := person{Name: fmt.Sprint(i), City: "nairobi"}
+			_, err := people.PutWithTTL(i, p, time.Duration(i+1)*time.Second)
+			assert.NoError(t, err)
+		}
+
+		*clock = clock.Add(100 * time.Second)
+
+		res, err := GetBy(people, "city", "nairobi")
+		assert.NoError(t, err)
+		assert.Equal(t, 200, len(res))
+
+		swept, err := people.SweepExpired()
+		assert.NoError(t, err)
+		assert.Equal(t, 100, swept)
+
+		city := people.indexes["city"].(*secondaryTree[int, person, string])
+		keys, err := postings(city.tree, "nairobi")
+		assert.NoError(t, err)
+		assert.Equal(t, 200, len(keys))
+		assert.Equal(t, 100, keys[0])
+
+		*clock = clock.Add(time.Hour)
+		people.StartExpirySweeper(time.Millisecond)
+		t.Cleanup(people.StopExpirySweeper)
+
+		assert.Eventually(t, func() bool {
+			people.mu.RLock()
+			defer people.mu.RUnlock()
+			return people.isEmpty()
+		}, 10*time.Second, time.Millisecond)
+
+		people.StopExpirySweeper()
+
+		res, err = GetBy(people, "city", "nairobi")
+		assert.NoError(t, err)
+		assert.Empty(t, res)
+	})
+
+	t.Run("a ttl the expiry index refuses changes nothing", func(t *testing.T) {
+		bplus := newTestTree[string, int](t, "test")
+		clock := fakeClock(bplus)
+		assert.NoError(t, bplus.SetSizeLimits(SizeLimits{MaxKeySize: MAX_KEY_SIZE, MaxValueSize: DEFAULT_MAX_VALUE_SIZE}))
+
+		_, err := bplus.Put("a", 1)
+		assert.NoError(t, err)
+
+		// the expiry entry pairs the expiry time with the key, it's over the
+		// largest key a tree takes
+		long := strings.Repeat("k", MAX_KEY_SIZE-8)
+		_, err = bplus.PutWithTTL(long, 1, time.Minute)
+		assert.ErrorIs(t, err, util.ErrKeyTooLarge)
+		_, err = bplus.Get(long)
+		assert.ErrorIs(t, err, util.ErrKeyNotFound)
+
+		// keys over the default key limit are tracked and swept
+		key := strings.Repeat("k", 300)
+		_, err = bplus.PutWithTTL(key, 1, time.Minute)
+		assert.NoError(t, err)
+
+		*clock = clock.Add(time.Minute)
+		swept, err := bplus.SweepExpired()
+		assert.NoError(t, err)
+		assert.Equal(t, 1, swept)
+	})
+}
+
+// fakeClock replaces the tree's clock with one the test moves by hand
+func fakeClock[K cmp.Ordered, V any](tree *bplusTree[K, V]) *time.Time {
+	clock := time.Unix(1_700_000_000, 0)
+	tree.now = func() time.Time { return clock }
+	return &clock
+}
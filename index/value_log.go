@@ -0,0 +1,489 @@
+package index
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jobala/petro/util"
+)
+
+const (
+	DEFAULT_VALUE_LOG_THRESHOLD    = 1024
+	DEFAULT_VALUE_LOG_SEGMENT_SIZE = 64 << 20
+
+	// a record is a crc32 of its key and value followed by their lengths,
+	// the key and the value
+	VALUE_LOG_HEADER_SIZE = 12
+)
+
+type ValueLogOptions struct {
+	// Threshold is the encoded size above which a value goes to the log, it
+	// defaults to DEFAULT_VALUE_LOG_THRESHOLD
+	Threshold int
+
+	// SegmentSize is the size at which the log moves on to a new segment
+	// file, it defaults to DEFAULT_VALUE_LOG_SEGMENT_SIZE
+	SegmentSize int64
+}
+
+// EnableValueLog separates large values from the tree. Values whose encoding
+// is larger than the threshold are appended to a log of segment files in dir
+// and the leaves keep a pointer to them, so splits and merges move pointers
+// instead of payloads.
+//
+// The log is reopened with the tree. Overwritten and deleted values stay in
+// the log until GCValueLog reclaims their segment. Values stored before the
+// log was enabled are left where they are.
+func (b *bplusTree[K, V]) EnableValueLog(dir string, opts ValueLogOptions) error {
+	if opts.Threshold < 0 || opts.SegmentSize < 0 {
+		return fmt.Errorf("value log options must not be negative, got %+v", opts)
+	}
+	if opts.Threshold == 0 {
+		opts.Threshold = DEFAULT_VALUE_LOG_THRESHOLD
+	}
+	if opts.SegmentSize == 0 {
+		opts.SegmentSize = DEFAULT_VALUE_LOG_SEGMENT_SIZE
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.checkOpen(); err != nil {
+		return err
+	}
+
+	if b.vlog != nil && b.vlog.dir != dir {
+		return fmt.Errorf("value log already enabled in %s", b.vlog.dir)
+	}
+
+	b.header.ValueLog = valueLogConfig{Dir: dir, Threshold: opts.Threshold, SegmentSize: opts.SegmentSize}
+	if b.vlog != nil {
+		b.vlog.threshold = opts.Threshold
+		b.vlog.segmentSize = opts.SegmentSize
+		return b.saveHeader()
+	}
+
+	if err := b.openValueLog(); err != nil {
+		return err
+	}
+
+	return b.saveHeader()
+}
+
+// GCValueLog reclaims the oldest segment of the value log. Its live values are
+// appended to the head of the log and the tree is pointed at the new copies.
+// The segment is only removed once the copies and then the tree have been
+// synced, so a crash leaves the tree pointing at one of them. A disk manager
+// in disk.SYNC_NONE doesn't sync the tree, a crash can then leave it pointing
+// at the removed segment. The active segment is sealed first when it is the
+// only one. It returns the number of bytes held by dead values.
+func (b *bplusTree[K, V]) GCValueLog() (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.checkOpen(); err != nil {
+		return 0, err
+	}
+
+	if b.vlog == nil {
+		return 0, fmt.Errorf("value log is not enabled on %s", b.indexName)
+	}
+
+	segment, ok, err := b.vlog.oldestSealed()
+	if err != nil || !ok {
+		return 0, err
+	}
+
+	reclaimed := int64(0)
+	err = b.vlog.scan(segment, func(ptr valuePointer, keyData []byte) error {
+		key, err := decodeValue[K](keyData)
+		if err != nil {
+			return err
+		}
+
+		live := false
+		if !b.isEmpty() {
+			meta, err := b.metaOf(key)
+			if err != nil && !errors.Is(err, util.ErrKeyNotFound) {
+				return err
+			}
+			live = err == nil && meta.Log == ptr
+		}
+
+		if !live {
+			reclaimed += ptr.Length
+			return nil
+		}
+
+		// putting the value back appends it to the head of the log
+		_, err = b.put(key, func(old V, oldMeta slotMeta, _ bool) (V, slotMeta) {
+			return old, oldMeta
+		})
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error collecting value log segment %d: %w", segment, err)
+	}
+
+	if err := b.vlog.sync(); err != nil {
+		return 0, fmt.Errorf("error syncing value log: %w", err)
+	}
+	if err := b.bpm.FlushAll(); err != nil {
+		return 0, fmt.Errorf("error flushing %s: %w", b.indexName, err)
+	}
+
+	return reclaimed, b.vlog.remove(segment)
+}
+
+func (b *bplusTree[K, V]) openValueLog() error {
+	vlog, err := openValueLog(b.header.ValueLog)
+	if err != nil {
+		return fmt.Errorf("error opening value log: %v", err)
+	}
+
+	b.vlog = vlog
+	return nil
+}
+
+// readLogged reads the value ptr points at
+func readLogged[V any](vlog *valueLog, ptr valuePointer) (V, error) {
+	var val V
+	if vlog == nil {
+		return val, fmt.Errorf("value log is not open")
+	}
+
+	_, data, err := vlog.read(ptr)
+	if err != nil {
+		return val, err
+	}
+
+	return decodeValue[V](data)
+}
+
+// decodeValue decodes data, unlike buffer.ToStruct it reports a failure
+func decodeValue[T any](data []byte) (T, error) {
+	var res T
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&res); err != nil {
+		return res, fmt.Errorf("error decoding value: %v", err)
+	}
+
+	return res, nil
+}
+
+func openValueLog(config valueLogConfig) (*valueLog, error) {
+	if err := os.MkdirAll(config.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	names, err := filepath.Glob(filepath.Join(config.Dir, "*.vlog"))
+	if err != nil {
+		return nil, err
+	}
+
+	vlog := &valueLog{
+		dir:         config.Dir,
+		threshold:   config.Threshold,
+		segmentSize: config.SegmentSize,
+		segments:    map[int64]*os.File{},
+	}
+
+	for _, name := range names {
+		segment, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(name), ".vlog"), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		file, err := os.OpenFile(name, os.O_RDWR, 0644)
+		if err != nil {
+			vlog.close()
+			return nil, err
+		}
+		vlog.segments[segment] = file
+		vlog.active = max(vlog.active, segment)
+	}
+
+	if vlog.active == 0 {
+		if err := vlog.rotate(); err != nil {
+			return nil, err
+		}
+		return vlog, nil
+	}
+
+	// an append torn by a crash leaves a partial record at the end of the
+	// active segment, it's cut off so that appends follow the last whole one
+	active := vlog.segments[vlog.active]
+	size, err := recordsLength(active)
+	if err != nil {
+		vlog.close()
+		return nil, err
+	}
+	if err := active.Truncate(size); err != nil {
+		vlog.close()
+		return nil, fmt.Errorf("error truncating value log segment %d: %v", vlog.active, err)
+	}
+	vlog.size = size
+
+	return vlog, nil
+}
+
+// recordsLength returns the length of the whole records at the start of
+// file, up to the first one that is cut short or fails its checksum
+func recordsLength(file *os.File) (int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	reader := bufio.NewReader(io.NewSectionReader(file, 0, info.Size()))
+
+	header := make([]byte, VALUE_LOG_HEADER_SIZE)
+	offset := int64(0)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return offset, nil
+		}
+
+		length := VALUE_LOG_HEADER_SIZE + int64(binary.LittleEndian.Uint32(header[4:])) + int64(binary.LittleEndian.Uint32(header[8:]))
+		if offset+length > info.Size() {
+			return offset, nil
+		}
+
+		record := make([]byte, length)
+		copy(record, header)
+		if _, err := io.ReadFull(reader, record[VALUE_LOG_HEADER_SIZE:]); err != nil {
+			return offset, nil
+		}
+		if crc32.ChecksumIEEE(record[4:]) != binary.LittleEndian.Uint32(record) {
+			return offset, nil
+		}
+
+		offset += length
+	}
+}
+
+// append writes a record to the active segment and returns its pointer
+func (l *valueLog) append(key, value []byte) (valuePointer, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	length := int64(VALUE_LOG_HEADER_SIZE + len(key) + len(value))
+	if l.size > 0 && l.size+length > l.segmentSize {
+		if err := l.rotateLocked(); err != nil {
+			return valuePointer{}, err
+		}
+	}
+
+	record := make([]byte, VALUE_LOG_HEADER_SIZE, length)
+	binary.LittleEndian.PutUint32(record[4:], uint32(len(key)))
+	binary.LittleEndian.PutUint32(record[8:], uint32(len(value)))
+	record = append(record, key...)
+	record = append(record, value...)
+	binary.LittleEndian.PutUint32(record, crc32.ChecksumIEEE(record[4:]))
+
+	if _, err := l.segments[l.active].WriteAt(record, l.size); err != nil {
+		return valuePointer{}, fmt.Errorf("error appending to value log: %v", err)
+	}
+
+	ptr := valuePointer{Segment: l.active, Offset: l.size, Length: length}
+	l.size += length
+
+	return ptr, nil
+}
+
+// read returns the key and value of the record ptr points at
+func (l *valueLog) read(ptr valuePointer) ([]byte, []byte, error) {
+	l.mu.RLock()
+	file, ok := l.segments[ptr.Segment]
+	l.mu.RUnlock()
+	if !ok {
+		return nil, nil, fmt.Errorf("value log segment %d does not exist", ptr.Segment)
+	}
+
+	record := make([]byte, ptr.Length)
+	if _, err := file.ReadAt(record, ptr.Offset); err != nil {
+		return nil, nil, fmt.Errorf("error reading value log: %v", err)
+	}
+
+	return parseRecord(record, ptr)
+}
+
+// scan calls fn with the pointer and key of every record in segment, reading
+// one record at a time
+func (l *valueLog) scan(segment int64, fn func(ptr valuePointer, key []byte) error) error {
+	l.mu.RLock()
+	file := l.segments[segment]
+	l.mu.RUnlock()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(io.NewSectionReader(file, 0, info.Size()))
+
+	header := make([]byte, VALUE_LOG_HEADER_SIZE)
+	for offset := int64(0); offset < info.Size(); {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return fmt.Errorf("truncated record at %d: %v", offset, err)
+		}
+
+		keyLen := int64(binary.LittleEndian.Uint32(header[4:]))
+		valLen := int64(binary.LittleEndian.Uint32(header[8:]))
+		ptr := valuePointer{Segment: segment, Offset: offset, Length: VALUE_LOG_HEADER_SIZE + keyLen + valLen}
+		if ptr.Offset+ptr.Length > info.Size() {
+			return fmt.Errorf("truncated record at %d", offset)
+		}
+
+		record := make([]byte, ptr.Length)
+		copy(record, header)
+		if _, err := io.ReadFull(reader, record[VALUE_LOG_HEADER_SIZE:]); err != nil {
+			return fmt.Errorf("truncated record at %d: %v", offset, err)
+		}
+
+		key, _, err := parseRecord(record, ptr)
+		if err != nil {
+			return err
+		}
+		if err := fn(ptr, key); err != nil {
+			return err
+		}
+
+		offset += ptr.Length
+	}
+
+	return nil
+}
+
+func parseRecord(record []byte, ptr valuePointer) ([]byte, []byte, error) {
+	if len(record) < VALUE_LOG_HEADER_SIZE || crc32.ChecksumIEEE(record[4:]) != binary.LittleEndian.Uint32(record) {
+		return nil, nil, fmt.Errorf("corrupt value log record %d:%d", ptr.Segment, ptr.Offset)
+	}
+
+	keyLen := binary.LittleEndian.Uint32(record[4:])
+	if VALUE_LOG_HEADER_SIZE+int(keyLen) > len(record) {
+		return nil, nil, fmt.Errorf("corrupt value log record %d:%d", ptr.Segment, ptr.Offset)
+	}
+
+	return record[VALUE_LOG_HEADER_SIZE : VALUE_LOG_HEADER_SIZE+keyLen], record[VALUE_LOG_HEADER_SIZE+keyLen:], nil
+}
+
+// oldestSealed returns the oldest segment that is no longer appended to. The
+// active segment is sealed when it's the only one and holds records.
+func (l *valueLog) oldestSealed() (int64, bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.segments) == 1 {
+		if l.size == 0 {
+			return 0, false, nil
+		}
+		if err := l.rotateLocked(); err != nil {
+			return 0, false, err
+		}
+	}
+
+	segments := []int64{}
+	for segment := range l.segments {
+		segments = append(segments, segment)
+	}
+
+	return slices.Min(segments), true, nil
+}
+
+func (l *valueLog) rotate() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.rotateLocked()
+}
+
+// rotateLocked syncs the active segment, sealing it, and starts a new one.
+// Callers must hold mu.
+func (l *valueLog) rotateLocked() error {
+	if active, ok := l.segments[l.active]; ok {
+		if err := active.Sync(); err != nil {
+			return fmt.Errorf("error syncing value log segment %d: %v", l.active, err)
+		}
+	}
+
+	segment := l.active + 1
+	file, err := os.OpenFile(l.segmentPath(segment), os.O_CREATE|os.O_RDWR|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("error creating value log segment: %v", err)
+	}
+
+	l.segments[segment] = file
+	l.active = segment
+	l.size = 0
+
+	return nil
+}
+
+// remove deletes a sealed segment
+func (l *valueLog) remove(segment int64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	file := l.segments[segment]
+	delete(l.segments, segment)
+	_ = file.Close()
+
+	return os.Remove(file.Name())
+}
+
+func (l *valueLog) sync() error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.segments[l.active].Sync()
+}
+
+func (l *valueLog) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, file := range l.segments {
+		_ = file.Close()
+	}
+}
+
+func (l *valueLog) segmentPath(segment int64) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%06d.vlog", segment))
+}
+
+type valueLog struct {
+	dir         string
+	threshold   int
+	segmentSize int64
+
+	mu       sync.RWMutex
+	segments map[int64]*os.File
+	active   int64
+
+	// size is the length of the active segment
+	size int64
+}
+
+type valueLogConfig struct {
+	Dir         string
+	Threshold   int
+	SegmentSize int64
+}
+
+// valuePointer locates a record in the value log, a zero Length means the
+// value is not in the log
+type valuePointer struct {
+	Segment int64
+	Offset  int64
+	Length  int64
+}
@@ -0,0 +1,205 @@
+package index
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jobala/petro/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValueLog(t *testing.T) {
+	t.Run("stores values over the threshold in the log", func(t *testing.T) {
+		file := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(file.Name())
+		})
+		dir := t.TempDir()
+
+		bpm := createBpm(file)
+		bplus, err := NewBplusTree[int, []byte]("test", bpm)
+		assert.NoError(t, err)
+		assert.NoError(t, bplus.EnableValueLog(dir, ValueLogOptions{Threshold: 100}))
+
+		blob := func(i int) []byte {
+			return bytes.Repeat([]byte{byte(i)}, 200+i)
+		}
+
+		for i := range 300 {
+			_, err := bplus.Put(i, blob(i))
+			assert.NoError(t, err)
+		}
+		_, err = bplus.Put(300, []byte("small"))
+		assert.NoError(t, err)
+
+		meta, err := bplus.metaOf(10)
+		assert.NoError(t, err)
+		assert.NotZero(t, meta.Log.Length)
+		meta, err = bplus.metaOf(300)
+		assert.NoError(t, err)
+		assert.Zero(t, meta.Log.Length)
+
+		indexIter := bplus.GetIterator()
+		for i := range 300 {
+			key, val, err := indexIter.Next()
+			assert.NoError(t, err)
+			assert.Equal(t, i, key)
+			assert.Equal(t, blob(i), val)
+		}
+		assert.NoError(t, bplus.Flush())
+
+		// the log is reopened with the tree
+		reopened, err := NewBplusTree[int, []byte]("test", createBpm(file))
+		assert.NoError(t, err)
+		for i := range 300 {
+			val, err := reopened.Get(i)
+			assert.NoError(t, err)
+			assert.Equal(t, blob(i), val[0])
+		}
+	})
+
+	t.Run("rotates segments", func(t *testing.T) {
+		file := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(file.Name())
+		})
+		dir := t.TempDir()
+
+		bpm := createBpm(file)
+		bplus, err := NewBplusTree[int, []byte]("test", bpm)
+		assert.NoError(t, err)
+		assert.NoError(t, bplus.EnableValueLog(dir, ValueLogOptions{Threshold: 100, SegmentSize: 10_000}))
+
+		for i := range 100 {
+			_, err := bplus.Put(i, bytes.Repeat([]byte{1}, 1000))
+			assert.NoError(t, err)
+		}
+
+		segments, err := filepath.Glob(filepath.Join(dir, "*.vlog"))
+		assert.NoError(t, err)
+		assert.Greater(t, len(segments), 10)
+	})
+
+	t.Run("garbage collection keeps live values", func(t *testing.T) {
+		file := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(file.Name())
+		})
+		dir := t.TempDir()
+
+		bpm := createBpm(file)
+		bplus, err := NewBplusTree[string, []byte]("test", bpm)
+		assert.NoError(t, err)
+		assert.NoError(t, bplus.EnableValueLog(dir, ValueLogOptions{Threshold: 100}))
+
+		blob := bytes.Repeat([]byte{1}, 1000)
+		for _, key := range []string{"john", "jane", "mary"} {
+			_, err := bplus.Put(key, blob)
+			assert.NoError(t, err)
+		}
+		_, err = bplus.Put("john", append(blob, 2))
+		assert.NoError(t, err)
+		_, err = bplus.Delete("jane")
+		assert.NoError(t, err)
+
+		// the first john and jane are dead
+		before, err := bplus.metaOf("mary")
+		assert.NoError(t, err)
+		reclaimed, err := bplus.GCValueLog()
+		assert.NoError(t, err)
+		assert.Equal(t, 2*before.Log.Length, reclaimed)
+
+		after, err := bplus.metaOf("mary")
+		assert.NoError(t, err)
+		assert.NotEqual(t, before.Log, after.Log)
+
+		val, err := bplus.Get("john")
+		assert.NoError(t, err)
+		assert.Equal(t, append(blob, 2), val[0])
+		val, err = bplus.Get("mary")
+		assert.NoError(t, err)
+		assert.Equal(t, blob, val[0])
+		_, err = bplus.Get("jane")
+		assert.ErrorIs(t, err, util.ErrKeyNotFound)
+
+		segments, err := filepath.Glob(filepath.Join(dir, "*.vlog"))
+		assert.NoError(t, err)
+		assert.Equal(t, []string{filepath.Join(dir, "000002.vlog")}, segments)
+
+		// the live values were moved, a second pass has nothing to reclaim
+		reclaimed, err = bplus.GCValueLog()
+		assert.NoError(t, err)
+		assert.Zero(t, reclaimed)
+	})
+
+	t.Run("garbage collection writes the tree before removing a segment", func(t *testing.T) {
+		file := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(file.Name())
+		})
+		dir := t.TempDir()
+
+		bpm := createBpm(file)
+		bplus, err := NewBplusTree[int, []byte]("test", bpm)
+		assert.NoError(t, err)
+		assert.NoError(t, bplus.EnableValueLog(dir, ValueLogOptions{Threshold: 100, SegmentSize: 4096}))
+
+		blob := bytes.Repeat([]byte{1}, 1000)
+		for i := range 20 {
+			_, err := bplus.Put(i, blob)
+			assert.NoError(t, err)
+		}
+
+		_, err = bplus.GCValueLog()
+		assert.NoError(t, err)
+
+		// a tree read back from the file without a flush finds every value
+		reopened, err := NewBplusTree[int, []byte]("test", createBpm(file))
+		assert.NoError(t, err)
+		for i := range 20 {
+			val, err := reopened.Get(i)
+			assert.NoError(t, err)
+			assert.Equal(t, blob, val[0])
+		}
+	})
+
+	t.Run("drops a record cut short by a crash", func(t *testing.T) {
+		bplus := newTestTree[string, []byte](t, "test")
+		dir := t.TempDir()
+		assert.NoError(t, bplus.EnableValueLog(dir, ValueLogOptions{Threshold: 100}))
+
+		blob := bytes.Repeat([]byte{1}, 1000)
+		_, err := bplus.Put("john", blob)
+		assert.NoError(t, err)
+		assert.NoError(t, bplus.Close())
+
+		// half of a record was appended before the crash
+		segment := filepath.Join(dir, "000001.vlog")
+		info, err := os.Stat(segment)
+		assert.NoError(t, err)
+		log, err := os.OpenFile(segment, os.O_WRONLY|os.O_APPEND, 0644)
+		assert.NoError(t, err)
+		_, err = log.Write(bytes.Repeat([]byte{7}, 500))
+		assert.NoError(t, err)
+		assert.NoError(t, log.Close())
+
+		reopened, err := NewBplusTree[string, []byte]("test", bplus.bpm)
+		assert.NoError(t, err)
+		after, err := os.Stat(segment)
+		assert.NoError(t, err)
+		assert.Equal(t, info.Size(), after.Size())
+
+		_, err = reopened.Put("jane", blob)
+		assert.NoError(t, err)
+		_, err = reopened.GCValueLog()
+		assert.NoError(t, err)
+
+		for _, key := range []string{"john", "jane"} {
+			val, err := reopened.Get(key)
+			assert.NoError(t, err)
+			assert.Equal(t, blob, val[0])
+		}
+	})
+}
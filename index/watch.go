@@ -0,0 +1,146 @@
+package index
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+)
+
+const DEFAULT_WATCH_BUFFER = 64
+
+type EventType int
+
+const (
+	EventPut EventType = iota
+	EventDelete
+)
+
+// Event describes a change to a single key
+type Event[K cmp.Ordered, V any] struct {
+	Type EventType
+	Key  K
+
+	// Old is the value the key held before the change, it is only set when
+	// HadOld is true
+	Old    V
+	HadOld bool
+
+	// New is the value put under the key, it is not set for deletes
+	New V
+}
+
+// SlowConsumerPolicy decides what happens when a watcher's buffer is full.
+// Events are delivered while the tree's write lock is held, so writers never
+// wait for a watcher.
+type SlowConsumerPolicy int
+
+const (
+	// DropEvents discards the events that don't fit in the buffer
+	DropEvents SlowConsumerPolicy = iota
+
+	// CloseWatch closes the channel, a consumer that sees it close before its
+	// context is done has missed events and should reload and watch again
+	CloseWatch
+)
+
+type WatchOptions struct {
+	// BufferSize is the number of events buffered for the consumer, it
+	// defaults to DEFAULT_WATCH_BUFFER
+	BufferSize int
+	Policy     SlowConsumerPolicy
+}
+
+// Watch returns a channel of the changes made to key. The channel is closed
+// once ctx is done.
+func (b *bplusTree[K, V]) Watch(ctx context.Context, key K, opts WatchOptions) (<-chan Event[K, V], error) {
+	return b.WatchRange(ctx, key, key, opts)
+}
+
+// WatchRange returns a channel of the changes made to keys between start and
+// stop, both inclusive. Events are sent after a mutation succeeds, in the
+// order the mutations were made. Expired keys are reported as deletes without
+// an old value when they are reclaimed, as are deletes of keys that had
+// expired. The channel is closed once ctx is done.
+func (b *bplusTree[K, V]) WatchRange(ctx context.Context, start, stop K, opts WatchOptions) (<-chan Event[K, V], error) {
+	if start > stop {
+		return nil, fmt.Errorf("invalid range: %v > %v", start, stop)
+	}
+	if opts.BufferSize < 0 {
+		return nil, fmt.Errorf("buffer size must not be negative, got %d", opts.BufferSize)
+	}
+	if opts.BufferSize == 0 {
+		opts.BufferSize = DEFAULT_WATCH_BUFFER
+	}
+
+	w := &watcher[K, V]{
+		start:  start,
+		stop:   stop,
+		policy: opts.Policy,
+		events: make(chan Event[K, V], opts.BufferSize),
+	}
+
+	// Close marks the tree closed under watchMu, so a watcher registered
+	// here is either refused or closed by it
+	b.watchMu.Lock()
+	defer b.watchMu.Unlock()
+
+	if err := b.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	if b.watchers == nil {
+		b.watchers = map[*watcher[K, V]]struct{}{}
+	}
+	b.watchers[w] = struct{}{}
+
+	w.release = context.AfterFunc(ctx, func() {
+		b.watchMu.Lock()
+		defer b.watchMu.Unlock()
+		b.unwatch(w)
+	})
+
+	return w.events, nil
+}
+
+// notify sends ev to the watchers of its key
+func (b *bplusTree[K, V]) notify(ev Event[K, V]) {
+	b.watchMu.Lock()
+	defer b.watchMu.Unlock()
+
+	for w := range b.watchers {
+		if ev.Key < w.start || ev.Key > w.stop {
+			continue
+		}
+
+		select {
+		case w.events <- ev:
+		default:
+			if w.policy == CloseWatch {
+				b.unwatch(w)
+			}
+		}
+	}
+}
+
+// unwatch removes w, closes its channel and releases its context, callers
+// must hold watchMu
+func (b *bplusTree[K, V]) unwatch(w *watcher[K, V]) {
+	if _, ok := b.watchers[w]; !ok {
+		return
+	}
+
+	delete(b.watchers, w)
+	close(w.events)
+	w.release()
+}
+
+type watcher[K cmp.Ordered, V any] struct {
+	start  K
+	stop   K
+	policy SlowConsumerPolicy
+	events chan Event[K, V]
+
+	// release unregisters the function that unwatches w once its context
+	// is done
+	release func() bool
+}
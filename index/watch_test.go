@@ -0,0 +1,219 @@
+package index
+
+import (
+	"cmp"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jobala/petro/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatch(t *testing.T) {
+	t.Run("reports puts and deletes of a key", func(t *testing.T) {
+		bplus := newTestTree[string, int](t, "test")
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		events, err := bplus.Watch(ctx, "john", WatchOptions{})
+		assert.NoError(t, err)
+
+		_, err = bplus.Put("john", 25)
+		assert.NoError(t, err)
+		_, err = bplus.Put("jane", 40)
+		assert.NoError(t, err)
+		_, err = bplus.Put("john", 26)
+		assert.NoError(t, err)
+		_, err = bplus.Delete("john")
+		assert.NoError(t, err)
+
+		assert.Equal(t, []Event[string, int]{
+			{Type: EventPut, Key: "john", New: 25},
+			{Type: EventPut, Key: "john", Old: 25, HadOld: true, New: 26},
+			{Type: EventDelete, Key: "john", Old: 26, HadOld: true},
+		}, receive(t, events, 3))
+	})
+
+	t.Run("reports changes within a range", func(t *testing.T) {
+		bplus := newTestTree[int, int](t, "test")
+		bplus.SetMergeOperator(AddOperator[int]())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		events, err := bplus.WatchRange(ctx, 100, 199, WatchOptions{BufferSize: 200})
+		assert.NoError(t, err)
+
+		for i := range 300 {
+			_, err := bplus.Put(i, i)
+			assert.NoError(t, err)
+		}
+		_, err = bplus.Merge(150, 1)
+		assert.NoError(t, err)
+
+		received := receive(t, events, 101)
+		for i, ev := range received[:100] {
+			assert.Equal(t, EventPut, ev.Type)
+			assert.Equal(t, i+100, ev.Key)
+		}
+		assert.Equal(t, Event[int, int]{Type: EventPut, Key: 150, Old: 150, HadOld: true, New: 151}, received[100])
+	})
+
+	t.Run("closes the channel when the context is done", func(t *testing.T) {
+		bplus := newTestTree[string, int](t, "test")
+
+		ctx, cancel := context.WithCancel(context.Background())
+		events, err := bplus.Watch(ctx, "john", WatchOptions{})
+		assert.NoError(t, err)
+
+		cancel()
+		for range events {
+		}
+
+		_, err = bplus.Put("john", 25)
+		assert.NoError(t, err)
+		assert.Empty(t, bplus.watchers)
+	})
+
+	t.Run("applies the slow consumer policy", func(t *testing.T) {
+		bplus := newTestTree[int, int](t, "test")
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		dropped, err := bplus.WatchRange(ctx, 0, 10, WatchOptions{BufferSize: 2})
+		assert.NoError(t, err)
+		closed, err := bplus.WatchRange(ctx, 0, 10, WatchOptions{BufferSize: 2, Policy: CloseWatch})
+		assert.NoError(t, err)
+
+		for i := range 5 {
+			_, err := bplus.Put(i, i)
+			assert.NoError(t, err)
+		}
+
+		assert.Equal(t, []int{0, 1}, keysOf(receive(t, dropped, 2)))
+		assert.Equal(t, []int{0, 1}, keysOf(receive(t, closed, 2)))
+
+		// dropped keeps receiving after the overflow, closed does not
+		_, err = bplus.Put(6, 6)
+		assert.NoError(t, err)
+		assert.Equal(t, []int{6}, keysOf(receive(t, dropped, 1)))
+
+		_, ok := <-closed
+		assert.False(t, ok)
+	})
+
+	t.Run("reports reclaimed expired keys as deletes", func(t *testing.T) {
+		bplus := newTestTree[string, int](t, "test")
+		clock := fakeClock(bplus)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		_, err := bplus.PutWithTTL("session", 1, time.Second)
+		assert.NoError(t, err)
+
+		events, err := bplus.Watch(ctx, "session", WatchOptions{})
+		assert.NoError(t, err)
+
+		*clock = clock.Add(time.Minute)
+		_, err = bplus.SweepExpired()
+		assert.NoError(t, err)
+
+		// the key was already absent to readers
+		assert.Equal(t, []Event[string, int]{
+			{Type: EventDelete, Key: "session"},
+		}, receive(t, events, 1))
+	})
+
+	t.Run("reports expired keys as absent when they are deleted or replaced", func(t *testing.T) {
+		bplus := newTestTree[string, int](t, "test")
+		clock := fakeClock(bplus)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		_, err := bplus.PutWithTTL("a", 1, time.Second)
+		assert.NoError(t, err)
+		_, err = bplus.PutWithTTL("b", 2, time.Second)
+		assert.NoError(t, err)
+
+		events, err := bplus.WatchRange(ctx, "a", "b", WatchOptions{})
+		assert.NoError(t, err)
+
+		*clock = clock.Add(time.Minute)
+		_, err = bplus.Delete("a")
+		assert.Error(t, err)
+		_, err = bplus.Put("b", 3)
+		assert.NoError(t, err)
+
+		assert.Equal(t, []Event[string, int]{
+			{Type: EventDelete, Key: "a"},
+			{Type: EventPut, Key: "b", New: 3},
+		}, receive(t, events, 2))
+	})
+
+	t.Run("rejects invalid ranges", func(t *testing.T) {
+		bplus := newTestTree[int, int](t, "test")
+
+		_, err := bplus.WatchRange(context.Background(), 10, 0, WatchOptions{})
+		assert.Error(t, err)
+	})
+
+	t.Run("watches racing close are refused or closed", func(t *testing.T) {
+		for range 50 {
+			bplus := newTestTree[int, int](t, "test")
+
+			var wg sync.WaitGroup
+			channels := make(chan (<-chan Event[int, int]), 10)
+			for range 10 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					events, err := bplus.Watch(context.Background(), 1, WatchOptions{})
+					if err == nil {
+						channels <- events
+					} else {
+						assert.ErrorIs(t, err, util.ErrClosed)
+					}
+				}()
+			}
+			assert.NoError(t, bplus.Close())
+			wg.Wait()
+			close(channels)
+
+			for events := range channels {
+				_, open := <-events
+				assert.False(t, open)
+			}
+		}
+	})
+}
+
+func receive[K cmp.Ordered, V any](t *testing.T, events <-chan Event[K, V], n int) []Event[K, V] {
+	t.Helper()
+
+	res := []Event[K, V]{}
+	for range n {
+		select {
+		case ev := <-events:
+			res = append(res, ev)
+		case <-time.After(time.Second):
+			t.Fatalf("received %d of %d events", len(res), n)
+		}
+	}
+
+	return res
+}
+
+func keysOf[K cmp.Ordered, V any](events []Event[K, V]) []K {
+	keys := []K{}
+	for _, ev := range events {
+		keys = append(keys, ev.Key)
+	}
+
+	return keys
+}
@@ -1,7 +1,180 @@
 package main
 
-import "fmt"
+import (
+	"cmp"
+	"compress/flate"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/jobala/petro/index"
+	"github.com/jobala/petro/storage/disk"
+)
 
 func main() {
-	fmt.Println("hello, world")
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "dump":
+		err = runDump(os.Args[2:], os.Stdout)
+	case "rotate-key":
+		err = runRotateKey(os.Args[2:], os.Stdout)
+	default:
+		usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: petro <command> [flags]")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "commands:")
+	fmt.Fprintln(os.Stderr, "  dump        print the b+tree structure as dot or json")
+	fmt.Fprintln(os.Stderr, "  rotate-key  re-encrypt every page of a database with a new key")
+}
+
+func runDump(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	dbFile := fs.String("file", "", "path to the database file")
+	name := fs.String("name", "index", "name of the index")
+	format := fs.String("format", "dot", "output format, dot or json")
+	keyType := fs.String("key", "string", "key type, string or int")
+	valType := fs.String("value", "string", "value type, string or int")
+	compressed := fs.Bool("compressed", false, "the database was written with flate compression")
+	keyFile := fs.String("key-file", "", "file holding the hex encoded key the pages are encrypted with")
+	keyId := fs.Uint("key-id", 1, "id of the key in -key-file")
+	pageSize := fs.Int("page-size", disk.PAGE_SIZE, "size of the database's pages")
+	_ = fs.Parse(args)
+
+	if *dbFile == "" {
+		return fmt.Errorf("-file is required")
+	}
+	if *format != "dot" && *format != "json" {
+		return fmt.Errorf("unsupported format: %s", *format)
+	}
+
+	opts := index.Options{PageSize: *pageSize}
+	if *compressed {
+		opts.Codec = disk.NewFlateCodec(flate.DefaultCompression)
+	}
+	if *keyFile != "" {
+		if *keyId == 0 {
+			return fmt.Errorf("key ids must be non zero")
+		}
+
+		key, err := readKey(*keyFile)
+		if err != nil {
+			return err
+		}
+		opts.Keys = disk.StaticKeys{Current: uint32(*keyId), Keys: map[uint32][]byte{uint32(*keyId): key}}
+	}
+
+	// the dump only reads the file
+	file, err := os.Open(*dbFile)
+	if err != nil {
+		return fmt.Errorf("error opening db file: %v", err)
+	}
+
+	switch {
+	case *keyType == "string" && *valType == "string":
+		return dumpTree[string, string](*name, file, opts, *format, out)
+	case *keyType == "string" && *valType == "int":
+		return dumpTree[string, int](*name, file, opts, *format, out)
+	case *keyType == "int" && *valType == "string":
+		return dumpTree[int, string](*name, file, opts, *format, out)
+	case *keyType == "int" && *valType == "int":
+		return dumpTree[int, int](*name, file, opts, *format, out)
+	default:
+		_ = file.Close()
+		return fmt.Errorf("unsupported key/value types: %s/%s", *keyType, *valType)
+	}
+}
+
+func dumpTree[K cmp.Ordered, V any](name string, file *os.File, opts index.Options, format string, out io.Writer) error {
+	dump, err := index.DumpFile[K, V](name, file, opts)
+	if err != nil {
+		return err
+	}
+
+	if format == "json" {
+		return dump.WriteJSON(out)
+	}
+	return dump.WriteDot(out)
+}
+
+func runRotateKey(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("rotate-key", flag.ExitOnError)
+	dbFile := fs.String("file", "", "path to the database file")
+	oldKeyFile := fs.String("old-key", "", "file holding the hex encoded key the pages are encrypted with")
+	oldId := fs.Uint("old-id", 1, "id of the old key")
+	newKeyFile := fs.String("new-key", "", "file holding the hex encoded key to encrypt the pages with")
+	newId := fs.Uint("new-id", 2, "id of the new key")
+	compressed := fs.Bool("compressed", false, "the database was written with flate compression")
+	pageSize := fs.Int("page-size", disk.PAGE_SIZE, "size of the database's pages")
+	_ = fs.Parse(args)
+
+	if *dbFile == "" || *oldKeyFile == "" || *newKeyFile == "" {
+		return fmt.Errorf("-file, -old-key and -new-key are required")
+	}
+	if *oldId == 0 || *newId == 0 || *oldId == *newId {
+		return fmt.Errorf("key ids must be distinct and non zero")
+	}
+
+	oldKey, err := readKey(*oldKeyFile)
+	if err != nil {
+		return err
+	}
+	newKey, err := readKey(*newKeyFile)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(*dbFile, os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening db file: %v", err)
+	}
+	defer file.Close()
+
+	opts := []disk.Option{disk.WithPageSize(*pageSize)}
+	if *compressed {
+		opts = append(opts, disk.WithCodec(disk.NewFlateCodec(flate.DefaultCompression)))
+	}
+
+	keys := disk.StaticKeys{
+		Current: uint32(*newId),
+		Keys:    map[uint32][]byte{uint32(*oldId): oldKey, uint32(*newId): newKey},
+	}
+	count, err := disk.RotateKeys(file, keys, opts...)
+	if err != nil {
+		return fmt.Errorf("error rotating keys after %d pages: %v", count, err)
+	}
+
+	fmt.Fprintf(out, "re-encrypted %d pages with key %d\n", count, *newId)
+	return nil
+}
+
+func readKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading key: %v", err)
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding key %s: %v", path, err)
+	}
+
+	return key, nil
 }
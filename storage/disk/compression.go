@@ -0,0 +1,94 @@
+package disk
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+)
+
+// Codec compresses page payloads before they are written and restores them
+// when they are read
+type Codec interface {
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+// Option configures a disk manager
+type Option func(*diskManager)
+
+// WithCodec compresses every page written with codec. Compressed pages no
+// longer fit the fixed 4 KiB slots of the db file, a map kept next to it
+// records where each page is and how large it is. The codec has to be chosen
+// when the db file is created.
+func WithCodec(codec Codec) Option {
+	return func(dm *diskManager) {
+		dm.codec = codec
+	}
+}
+
+// NewFlateCodec returns a codec using DEFLATE at level, see compress/flate
+func NewFlateCodec(level int) Codec {
+	return flateCodec{level: level}
+}
+
+func (c flateCodec) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	w, err := flate.NewWriter(&buf, c.level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (c flateCodec) Decompress(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+// Stats reports how well pages compress. It's empty when no codec is used.
+func (dm *diskManager) Stats() CompressionStats {
+	if dm.pages == nil {
+		return CompressionStats{}
+	}
+
+	return dm.pages.stats()
+}
+
+// Ratio is the size of the pages over the bytes they take on disk
+func (s CompressionStats) Ratio() float64 {
+	if s.StoredBytes == 0 {
+		return 0
+	}
+
+	return float64(s.RawBytes) / float64(s.StoredBytes)
+}
+
+func (s CompressionStats) String() string {
+	return fmt.Sprintf("%d pages, %d bytes stored in %d (%.2fx)", s.Pages, s.RawBytes, s.StoredBytes, s.Ratio())
+}
+
+type flateCodec struct {
+	level int
+}
+
+type CompressionStats struct {
+	// Pages is the number of pages written
+	Pages int64
+
+	// RawBytes is the size of those pages before compression
+	RawBytes int64
+
+	// StoredBytes is the size of their compressed payloads
+	StoredBytes int64
+}
@@ -0,0 +1,238 @@
+package disk
+
+import (
+	"bytes"
+	"compress/flate"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/jobala/petro/util/errs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompression(t *testing.T) {
+	page := func(text string) []byte {
+		buf := make([]byte, PAGE_SIZE)
+		copy(buf, bytes.Repeat([]byte(text), 10))
+		return buf
+	}
+
+	random := func(seed int64) []byte {
+		buf := make([]byte, PAGE_SIZE)
+		rand.New(rand.NewSource(seed)).Read(buf)
+		return buf
+	}
+
+	t.Run("reads back compressed pages", func(t *testing.T) {
+		dbFile := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(dbFile.Name())
+			_ = os.Remove(dbFile.Name() + ".map")
+		})
+
+		dm := NewManager(dbFile, WithCodec(NewFlateCodec(flate.DefaultCompression)))
+
+		for i := 1; i <= 10; i++ {
+			assert.NoError(t, dm.writePage(i, page("hello world")))
+		}
+
+		for i := 1; i <= 10; i++ {
+			res, err := dm.readPage(i)
+			assert.NoError(t, err)
+			assert.Equal(t, page("hello world"), res)
+		}
+
+		// pages that were never written are empty
+		res, err := dm.readPage(20)
+		assert.NoError(t, err)
+		assert.Equal(t, make([]byte, PAGE_SIZE), res)
+
+		stats := dm.Stats()
+		assert.Equal(t, int64(10), stats.Pages)
+		assert.Equal(t, int64(10*PAGE_SIZE), stats.RawBytes)
+		assert.Greater(t, stats.Ratio(), 10.0)
+
+		info, err := dbFile.Stat()
+		assert.NoError(t, err)
+		assert.Less(t, info.Size(), int64(4*PAGE_SIZE))
+	})
+
+	t.Run("stores incompressible pages raw", func(t *testing.T) {
+		dbFile := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(dbFile.Name())
+			_ = os.Remove(dbFile.Name() + ".map")
+		})
+
+		dm := NewManager(dbFile, WithCodec(NewFlateCodec(flate.DefaultCompression)))
+
+		assert.NoError(t, dm.writePage(1, random(1)))
+
+		res, err := dm.readPage(1)
+		assert.NoError(t, err)
+		assert.Equal(t, random(1), res)
+		assert.Equal(t, int64(PAGE_SIZE), dm.Stats().StoredBytes)
+	})
+
+	t.Run("reuses the space of pages that moved", func(t *testing.T) {
+		dbFile := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(dbFile.Name())
+			_ = os.Remove(dbFile.Name() + ".map")
+		})
+
+		dm := NewManager(dbFile, WithCodec(NewFlateCodec(flate.DefaultCompression)))
+
+		// the map on disk never pointed at page 1's first extent, page 2
+		// takes it
+		assert.NoError(t, dm.writePage(1, page("hello world")))
+		assert.NoError(t, dm.writePage(1, random(1)))
+
+		info, err := dbFile.Stat()
+		assert.NoError(t, err)
+		size := info.Size()
+
+		assert.NoError(t, dm.writePage(2, page("hello world")))
+
+		info, err = dbFile.Stat()
+		assert.NoError(t, err)
+		assert.Equal(t, size, info.Size())
+
+		// the map on disk points at page 1's extent until it's synced
+		assert.NoError(t, dm.Sync())
+		assert.NoError(t, dm.writePage(1, random(2)))
+
+		info, err = dbFile.Stat()
+		assert.NoError(t, err)
+		size = info.Size()
+
+		assert.NoError(t, dm.writePage(4, random(4)))
+
+		info, err = dbFile.Stat()
+		assert.NoError(t, err)
+		assert.Greater(t, info.Size(), size)
+		size = info.Size()
+
+		// page 3 takes the extent page 1 moved out of
+		assert.NoError(t, dm.Sync())
+		assert.NoError(t, dm.writePage(3, page("hello world")))
+
+		info, err = dbFile.Stat()
+		assert.NoError(t, err)
+		assert.Equal(t, size, info.Size())
+
+		res, err := dm.readPage(1)
+		assert.NoError(t, err)
+		assert.Equal(t, random(2), res)
+
+		res, err = dm.readPage(2)
+		assert.NoError(t, err)
+		assert.Equal(t, page("hello world"), res)
+
+		res, err = dm.readPage(3)
+		assert.NoError(t, err)
+		assert.Equal(t, page("hello world"), res)
+
+		res, err = dm.readPage(4)
+		assert.NoError(t, err)
+		assert.Equal(t, random(4), res)
+	})
+
+	t.Run("pages survive a reopen", func(t *testing.T) {
+		dbFile := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(dbFile.Name())
+			_ = os.Remove(dbFile.Name() + ".map")
+		})
+
+		dm := NewManager(dbFile, WithCodec(NewFlateCodec(flate.DefaultCompression)))
+		assert.NoError(t, dm.writePage(1, page("hello world")))
+		assert.NoError(t, dm.writePage(3, random(3)))
+		assert.NoError(t, dm.Sync())
+		stats := dm.Stats()
+
+		dm = NewManager(dbFile, WithCodec(NewFlateCodec(flate.DefaultCompression)))
+
+		count, err := dm.pageCount()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(4), count)
+		assert.Equal(t, stats, dm.Stats())
+
+		res, err := dm.readPage(1)
+		assert.NoError(t, err)
+		assert.Equal(t, page("hello world"), res)
+
+		res, err = dm.readPage(3)
+		assert.NoError(t, err)
+		assert.Equal(t, random(3), res)
+	})
+
+	t.Run("the map on disk points at the pages of the last sync", func(t *testing.T) {
+		dbFile := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(dbFile.Name())
+			_ = os.Remove(dbFile.Name() + ".map")
+		})
+
+		dm := NewManager(dbFile, WithCodec(NewFlateCodec(flate.DefaultCompression)))
+		assert.NoError(t, dm.writePage(1, page("hello world")))
+		assert.NoError(t, dm.writePage(2, random(2)))
+		assert.NoError(t, dm.Sync())
+
+		// neither page is written over, and page 3 isn't in the map yet
+		assert.NoError(t, dm.writePage(1, page("goodbye")))
+		assert.NoError(t, dm.writePage(2, page("hello world")))
+		assert.NoError(t, dm.writePage(3, page("hello world")))
+
+		crashed := NewManager(dbFile, WithCodec(NewFlateCodec(flate.DefaultCompression)))
+
+		res, err := crashed.readPage(1)
+		assert.NoError(t, err)
+		assert.Equal(t, page("hello world"), res)
+
+		res, err = crashed.readPage(2)
+		assert.NoError(t, err)
+		assert.Equal(t, random(2), res)
+
+		res, err = crashed.readPage(3)
+		assert.NoError(t, err)
+		assert.Equal(t, make([]byte, PAGE_SIZE), res)
+
+		assert.NoError(t, dm.Sync())
+		reopened := NewManager(dbFile, WithCodec(NewFlateCodec(flate.DefaultCompression)))
+
+		res, err = reopened.readPage(1)
+		assert.NoError(t, err)
+		assert.Equal(t, page("goodbye"), res)
+
+		res, err = reopened.readPage(3)
+		assert.NoError(t, err)
+		assert.Equal(t, page("hello world"), res)
+	})
+
+	t.Run("refuses files written with another format", func(t *testing.T) {
+		plainFile := CreateDbFile(t)
+		compressedFile := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(plainFile.Name())
+			_ = os.Remove(plainFile.Name() + ".map")
+			_ = os.Remove(compressedFile.Name())
+			_ = os.Remove(compressedFile.Name() + ".map")
+		})
+
+		dm := NewManager(plainFile)
+		assert.NoError(t, dm.writePage(1, page("hello world")))
+
+		dm = NewManager(plainFile, WithCodec(NewFlateCodec(flate.DefaultCompression)))
+		_, err := dm.readPage(1)
+		assert.ErrorIs(t, err, errs.ErrFormatMismatch)
+
+		dm = NewManager(compressedFile, WithCodec(NewFlateCodec(flate.DefaultCompression)))
+		assert.NoError(t, dm.writePage(1, page("hello world")))
+
+		dm = NewManager(compressedFile)
+		_, err = dm.readPage(1)
+		assert.ErrorIs(t, err, errs.ErrFormatMismatch)
+	})
+}
@@ -1,4 +1,9 @@
 package disk
 
+// PAGE_SIZE is the size of a page unless WithPageSize sets another
 const PAGE_SIZE = 4096
+
+// MAX_PAGE_SIZE is the largest page WithPageSize takes
+const MAX_PAGE_SIZE = 64 * 1024
+
 const INVALID_PAGE_ID = 0
@@ -1,37 +1,371 @@
 package disk
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jobala/petro/util/errs"
 )
 
-func NewManager(file *os.File) *diskManager {
-	return &diskManager{
-		dbFile: file,
+func NewManager(file *os.File, opts ...Option) *diskManager {
+	dm := &diskManager{
+		dbFile:       file,
+		pageSize:     PAGE_SIZE,
+		syncInterval: DEFAULT_SYNC_INTERVAL,
+		stop:         make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(dm)
+	}
+
+	// a page size that isn't supported or a map that fails to open fails
+	// every read and write instead
+	if dm.pageSize < SECTOR_SIZE || dm.pageSize > MAX_PAGE_SIZE || dm.pageSize%SECTOR_SIZE != 0 {
+		dm.err = fmt.Errorf("pages take a multiple of %d bytes up to %d, got %d", SECTOR_SIZE, MAX_PAGE_SIZE, dm.pageSize)
+	} else if dm.codec != nil {
+		dm.pages, dm.err = openPageMap(file, dm.headerSize(), dm.pageSize, dm.syncMode != SYNC_NONE)
+	} else if info, err := os.Stat(pageMapPath(file)); err == nil && info.Size() > 0 {
+		dm.err = fmt.Errorf("%w: %s was written with a codec", errs.ErrFormatMismatch, file.Name())
+	}
+	if dm.err == nil {
+		dm.err = checkHeader(file, dm.cipher != nil, dm.pageSize)
+	}
+
+	if dm.err == nil && dm.syncMode == SYNC_PERIODIC {
+		go dm.syncPeriodically(dm.syncInterval, dm.stop)
+	}
+
+	return dm
+}
+
+// WithPageSize sets the size of a page, a multiple of SECTOR_SIZE up to
+// MAX_PAGE_SIZE. It defaults to PAGE_SIZE. Like the codec it has to be chosen
+// when the db file is created, a file opened with another page size is
+// refused with errs.ErrFormatMismatch.
+func WithPageSize(size int) Option {
+	return func(dm *diskManager) {
+		dm.pageSize = size
 	}
 }
 
 func (dm *diskManager) writePage(pageId int, data []byte) error {
-	offset := int64(pageId * PAGE_SIZE)
+	if err := dm.check(); err != nil {
+		return err
+	}
+
+	payload, flags, err := dm.encode(pageId, data)
+	if err != nil {
+		return err
+	}
 
-	if _, err := dm.dbFile.WriteAt(data, offset); err != nil {
-		return fmt.Errorf("error writing at offset %d: %v", offset, err)
+	if err := dm.writeStored(pageId, payload, flags); err != nil {
+		return err
+	}
+
+	if dm.syncMode == SYNC_ALWAYS {
+		return dm.sync()
 	}
 
 	return nil
 }
 
 func (dm *diskManager) readPage(pageId int) ([]byte, error) {
-	offset := int64(pageId * PAGE_SIZE)
+	if err := dm.check(); err != nil {
+		return nil, err
+	}
+
+	payload, flags, err := dm.readStored(pageId)
+	if err != nil {
+		return nil, err
+	}
+
+	return dm.decode(pageId, payload, flags)
+}
 
-	buf := make([]byte, PAGE_SIZE)
-	if _, err := dm.dbFile.ReadAt(buf, offset); err != nil {
-		return nil, fmt.Errorf("error reading from offset %d: %v", offset, err)
+// writePages writes pages to consecutive page ids starting at pageId. Without
+// a page map the pages take consecutive slots and are written with a single
+// write.
+func (dm *diskManager) writePages(pageId int, pages [][]byte) error {
+	if err := dm.check(); err != nil {
+		return err
 	}
 
+	if dm.pages != nil {
+		for i, data := range pages {
+			payload, flags, err := dm.encode(pageId+i, data)
+			if err != nil {
+				return err
+			}
+			if err := dm.pages.write(pageId+i, payload, flags); err != nil {
+				return err
+			}
+		}
+	} else {
+		slotSize := int(dm.slotSize())
+		buf := make([]byte, len(pages)*slotSize)
+
+		for i, data := range pages {
+			payload, _, err := dm.encode(pageId+i, data)
+			if err != nil {
+				return err
+			}
+			copy(buf[i*slotSize:], payload)
+		}
+
+		offset := dm.slotOffset(pageId)
+		if _, err := dm.dbFile.WriteAt(buf, offset); err != nil {
+			return fmt.Errorf("error writing %d pages at offset %d: %w", len(pages), offset, err)
+		}
+	}
+
+	if dm.syncMode == SYNC_ALWAYS {
+		return dm.sync()
+	}
+
+	return nil
+}
+
+// readPages reads count pages starting at pageId, see writePages
+func (dm *diskManager) readPages(pageId, count int) ([][]byte, error) {
+	if err := dm.check(); err != nil {
+		return nil, err
+	}
+
+	pages := make([][]byte, count)
+	if dm.pages != nil {
+		for i := range pages {
+			payload, flags, err := dm.pages.read(pageId + i)
+			if err != nil {
+				return nil, err
+			}
+			if pages[i], err = dm.decode(pageId+i, payload, flags); err != nil {
+				return nil, err
+			}
+		}
+
+		return pages, nil
+	}
+
+	slotSize := int(dm.slotSize())
+	buf := make([]byte, count*slotSize)
+
+	offset := dm.slotOffset(pageId)
+	_, err := dm.dbFile.ReadAt(buf, offset)
+	if errors.Is(err, io.EOF) {
+		err = nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading %d pages from offset %d: %w", count, offset, err)
+	}
+
+	for i := range pages {
+		payload := buf[i*slotSize : (i+1)*slotSize]
+		if dm.cipher != nil && !written(payload) {
+			payload = nil
+		}
+
+		if pages[i], err = dm.decode(pageId+i, payload, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	return pages, nil
+}
+
+// encode turns a page into the payload kept on disk
+func (dm *diskManager) encode(pageId int, data []byte) ([]byte, uint32, error) {
+	payload, flags := data, uint32(0)
+	if dm.codec != nil {
+		compressed, err := dm.codec.Compress(data)
+		if err != nil {
+			return nil, 0, fmt.Errorf("error compressing page %d: %w", pageId, err)
+		}
+
+		if len(compressed) < len(data) {
+			payload = compressed
+		} else {
+			flags |= extentRaw
+		}
+	}
+
+	if dm.cipher != nil {
+		// a slot is authenticated as a whole, short pages fill it
+		if dm.pages == nil && len(payload) < dm.pageSize {
+			payload = append(payload, make([]byte, dm.pageSize-len(payload))...)
+		}
+
+		sealed, err := dm.cipher.seal(pageId, payload)
+		if err != nil {
+			return nil, 0, err
+		}
+		payload = sealed
+	}
+
+	return payload, flags, nil
+}
+
+// decode turns a payload read from disk back into a page
+func (dm *diskManager) decode(pageId int, payload []byte, flags uint32) ([]byte, error) {
+	// pages that were never written read as zeros
+	buf := make([]byte, dm.pageSize)
+	if payload == nil {
+		return buf, nil
+	}
+
+	var err error
+	if dm.cipher != nil {
+		if payload, err = dm.cipher.open(pageId, payload); err != nil {
+			return nil, err
+		}
+	}
+
+	if dm.codec != nil && flags&extentRaw == 0 {
+		if payload, err = dm.codec.Decompress(payload); err != nil {
+			return nil, fmt.Errorf("error decompressing page %d: %w", pageId, err)
+		}
+	}
+
+	copy(buf, payload)
 	return buf, nil
 }
 
+// Close syncs the db file and closes it, later calls return errs.ErrClosed
+func (dm *diskManager) Close() error {
+	if dm.closed.Swap(true) {
+		return nil
+	}
+	close(dm.stop)
+
+	errs := []error{}
+	if dm.err == nil && dm.syncMode != SYNC_NONE {
+		errs = append(errs, dm.sync())
+	}
+	if dm.pages != nil {
+		errs = append(errs, dm.pages.file.Close())
+	}
+	errs = append(errs, dm.dbFile.Close())
+
+	return errors.Join(errs...)
+}
+
+// check returns why the disk manager can't be used
+func (dm *diskManager) check() error {
+	if dm.closed.Load() {
+		return errs.ErrClosed
+	}
+
+	return dm.err
+}
+
+// writeStored writes the payload of a page as it's kept on disk
+func (dm *diskManager) writeStored(pageId int, payload []byte, flags uint32) error {
+	if dm.pages != nil {
+		return dm.pages.write(pageId, payload, flags)
+	}
+
+	offset := dm.slotOffset(pageId)
+
+	if _, err := dm.dbFile.WriteAt(payload, offset); err != nil {
+		return fmt.Errorf("error writing at offset %d: %w", offset, err)
+	}
+
+	return nil
+}
+
+// readStored reads the payload of a page as it's kept on disk, it's nil when
+// an encrypted page was never written
+func (dm *diskManager) readStored(pageId int) ([]byte, uint32, error) {
+	if dm.pages != nil {
+		return dm.pages.read(pageId)
+	}
+
+	offset := dm.slotOffset(pageId)
+
+	buf := make([]byte, dm.slotSize())
+	_, err := dm.dbFile.ReadAt(buf, offset)
+	if errors.Is(err, io.EOF) {
+		// slots past the end of the file were never written, they read as
+		// zeros
+		err = nil
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("error reading from offset %d: %w", offset, err)
+	}
+
+	if dm.cipher != nil && !written(buf) {
+		return nil, 0, nil
+	}
+
+	return buf, 0, nil
+}
+
+// slotSize is the space a page takes in a db file without a page map
+func (dm *diskManager) slotSize() int64 {
+	if dm.cipher != nil {
+		return int64(dm.pageSize) + ENCRYPTION_OVERHEAD
+	}
+
+	return int64(dm.pageSize)
+}
+
+// slotOffset is where the slot of pageId starts in a db file without a page
+// map
+func (dm *diskManager) slotOffset(pageId int) int64 {
+	return dm.headerSize() + int64(pageId)*dm.slotSize()
+}
+
+// headerSize is the space at the start of the db file that doesn't hold
+// pages
+func (dm *diskManager) headerSize() int64 {
+	if dm.cipher != nil || dm.pageSize != PAGE_SIZE {
+		return FILE_HEADER_SIZE
+	}
+
+	return 0
+}
+
+// pageCount returns the number of pages in the db file
+func (dm *diskManager) pageCount() (int64, error) {
+	if err := dm.check(); err != nil {
+		return 0, err
+	}
+	if dm.pages != nil {
+		return dm.pages.pageCount(), nil
+	}
+
+	info, err := dm.dbFile.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("error reading file info: %w", err)
+	}
+
+	size := max(info.Size()-dm.headerSize(), 0)
+	return (size + dm.slotSize() - 1) / dm.slotSize(), nil
+}
+
 type diskManager struct {
-	dbFile *os.File
+	dbFile   *os.File
+	pageSize int
+
+	// pages is set when pages are compressed with codec
+	codec Codec
+	pages *pageMap
+
+	// cipher is set when pages are encrypted
+	cipher *pageCipher
+
+	syncMode     SyncMode
+	syncInterval time.Duration
+	syncErr      atomic.Pointer[error]
+	stop         chan struct{}
+
+	// syncMu keeps syncs from saving page map entries out of order
+	syncMu sync.Mutex
+
+	err    error
+	closed atomic.Bool
 }
@@ -1,11 +1,13 @@
 package disk
 
 import (
+	"compress/flate"
 	"fmt"
 	"os"
 	"path"
 	"testing"
 
+	"github.com/jobala/petro/util/errs"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -29,6 +31,145 @@ func TestDiskManager(t *testing.T) {
 
 		assert.Equal(t, res, buf)
 	})
+
+	t.Run("counts the pages in the file", func(t *testing.T) {
+		dbFile := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(dbFile.Name())
+		})
+
+		dm := NewManager(dbFile)
+
+		count, err := dm.pageCount()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), count)
+
+		err = dm.writePage(4, make([]byte, PAGE_SIZE))
+		assert.NoError(t, err)
+
+		count, err = dm.pageCount()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(5), count)
+	})
+
+	t.Run("reads and writes runs of pages", func(t *testing.T) {
+		keys := StaticKeys{Current: 1, Keys: map[uint32][]byte{1: make([]byte, 32)}}
+		opts := map[string][]Option{
+			"plain":      nil,
+			"encrypted":  {WithEncryption(keys)},
+			"compressed": {WithCodec(NewFlateCodec(flate.BestSpeed))},
+		}
+
+		for name, opts := range opts {
+			t.Run(name, func(t *testing.T) {
+				dbFile := CreateDbFile(t)
+				t.Cleanup(func() {
+					_ = os.Remove(dbFile.Name())
+				})
+
+				dm := NewManager(dbFile, opts...)
+
+				pages := [][]byte{}
+				for i := range 4 {
+					buf := make([]byte, PAGE_SIZE)
+					copy(buf, fmt.Sprintf("page %d", i+2))
+					pages = append(pages, buf)
+				}
+				assert.NoError(t, dm.writePages(2, pages))
+
+				res, err := dm.readPage(3)
+				assert.NoError(t, err)
+				assert.Equal(t, pages[1], res)
+
+				// the run reaches past the pages written
+				res2, err := dm.readPages(1, 6)
+				assert.NoError(t, err)
+				assert.Equal(t, make([]byte, PAGE_SIZE), res2[0])
+				assert.Equal(t, pages, res2[1:5])
+				assert.Equal(t, make([]byte, PAGE_SIZE), res2[5])
+			})
+		}
+	})
+
+	t.Run("pages take the size the file was created with", func(t *testing.T) {
+		keys := StaticKeys{Current: 1, Keys: map[uint32][]byte{1: make([]byte, 32)}}
+		opts := map[string][]Option{
+			"plain":      nil,
+			"encrypted":  {WithEncryption(keys)},
+			"compressed": {WithCodec(NewFlateCodec(flate.BestSpeed))},
+		}
+
+		for name, opts := range opts {
+			t.Run(name, func(t *testing.T) {
+				dbFile := CreateDbFile(t)
+				t.Cleanup(func() {
+					_ = os.Remove(dbFile.Name())
+					_ = os.Remove(dbFile.Name() + ".map")
+				})
+
+				large := append(opts, WithPageSize(4*PAGE_SIZE))
+				dm := NewManager(dbFile, large...)
+
+				pages := [][]byte{}
+				for i := range 3 {
+					buf := make([]byte, 4*PAGE_SIZE)
+					copy(buf[3*PAGE_SIZE:], fmt.Sprintf("page %d", i+1))
+					pages = append(pages, buf)
+				}
+				assert.NoError(t, dm.writePages(1, pages))
+				assert.NoError(t, dm.Sync())
+
+				count, err := dm.pageCount()
+				assert.NoError(t, err)
+				assert.Equal(t, int64(4), count)
+
+				_, err = NewManager(dbFile, opts...).readPage(1)
+				assert.ErrorIs(t, err, errs.ErrFormatMismatch)
+
+				_, err = NewManager(dbFile, append(opts, WithPageSize(2*PAGE_SIZE))...).readPage(1)
+				assert.ErrorIs(t, err, errs.ErrFormatMismatch)
+
+				res, err := NewManager(dbFile, large...).readPages(1, 3)
+				assert.NoError(t, err)
+				assert.Equal(t, pages, res)
+			})
+		}
+	})
+
+	t.Run("refuses files written with the default page size", func(t *testing.T) {
+		dbFile := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(dbFile.Name())
+		})
+
+		buf := make([]byte, PAGE_SIZE)
+		copy(buf, "hello world")
+		assert.NoError(t, NewManager(dbFile).writePage(1, buf))
+
+		_, err := NewManager(dbFile, WithPageSize(2*PAGE_SIZE)).readPage(1)
+		assert.ErrorIs(t, err, errs.ErrFormatMismatch)
+	})
+
+	t.Run("refuses page sizes that aren't whole sectors", func(t *testing.T) {
+		dbFile := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(dbFile.Name())
+		})
+
+		for _, size := range []int{0, 1000, 2 * MAX_PAGE_SIZE} {
+			_, err := NewManager(dbFile, WithPageSize(size)).readPage(1)
+			assert.Error(t, err)
+		}
+
+		// the file isn't given a header for a page size that was refused
+		buf := make([]byte, PAGE_SIZE)
+		copy(buf, "hello world")
+		assert.NoError(t, NewManager(dbFile).writePage(1, buf))
+
+		res, err := NewManager(dbFile).readPage(1)
+		assert.NoError(t, err)
+		assert.Equal(t, buf, res)
+	})
 }
 
 func CreateDbFile(t *testing.T) *os.File {
@@ -2,23 +2,66 @@ package disk
 
 import (
 	"sync"
+
+	"github.com/jobala/petro/util/errs"
+)
+
+const (
+	DEFAULT_IO_WORKERS  = 4
+	DEFAULT_QUEUE_DEPTH = 100
+
+	// MAX_COALESCED_PAGES is the most pages served with a single read or write
+	MAX_COALESCED_PAGES = 32
 )
 
-func NewScheduler(diskManager *diskManager) *DiskScheduler {
+// SchedulerOption configures a disk scheduler
+type SchedulerOption func(*DiskScheduler)
+
+// WithWorkers sets the number of requests served at once, it defaults to
+// DEFAULT_IO_WORKERS
+func WithWorkers(workers int) SchedulerOption {
+	return func(ds *DiskScheduler) {
+		ds.workerCount = max(workers, 1)
+	}
+}
+
+// WithQueueDepth sets the number of requests waiting to be served, Schedule
+// blocks while the queue is full. It defaults to DEFAULT_QUEUE_DEPTH.
+func WithQueueDepth(depth int) SchedulerOption {
+	return func(ds *DiskScheduler) {
+		ds.queueDepth = max(depth, 1)
+	}
+}
+
+// NewScheduler serves requests with a fixed pool of workers. Requests for a
+// page are served one at a time in the order they were scheduled, and pages
+// are picked in elevator order, sweeping up the file from the last page served
+// and starting over from the lowest page, so that the disk is read in order.
+// Reads or writes queued for adjacent pages are coalesced into one.
+func NewScheduler(diskManager *diskManager, opts ...SchedulerOption) *DiskScheduler {
 	ds := &DiskScheduler{
-		reqCh:       make(chan DiskReq, 100),
-		pageQueue:   make(map[int]chan DiskReq),
-		pageQueueMu: sync.Mutex{},
 		diskManager: diskManager,
-		mu:          sync.Mutex{},
+		workerCount: DEFAULT_IO_WORKERS,
+		queueDepth:  DEFAULT_QUEUE_DEPTH,
+		pending:     map[int][]DiskReq{},
+		busy:        map[int]bool{},
+	}
+	ds.cond = sync.NewCond(&ds.mu)
+
+	for _, opt := range opts {
+		opt(ds)
+	}
+
+	for range ds.workerCount {
+		ds.workers.Add(1)
+		go ds.worker()
 	}
 
-	go ds.handleDiskReq()
 	return ds
 }
 
 func NewRequest(pageId int64, data []byte, isWrite bool) DiskReq {
-	respCh := make(chan DiskResp)
+	respCh := make(chan DiskResp, 1)
 	return DiskReq{
 		PageId: int(pageId),
 		Data:   data,
@@ -27,67 +70,274 @@ func NewRequest(pageId int64, data []byte, isWrite bool) DiskReq {
 	}
 }
 
+// Schedule queues req and returns the channel its response is sent on. It
+// blocks while the queue is full.
 func (ds *DiskScheduler) Schedule(req DiskReq) <-chan DiskResp {
-	ds.reqCh <- req
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	for ds.queued >= ds.queueDepth && !ds.closed {
+		ds.cond.Wait()
+	}
+
+	if ds.closed {
+		// the caller receives from RespCh after Schedule returns
+		go func() {
+			req.RespCh <- DiskResp{Success: false, Err: errs.ErrClosed}
+		}()
+		return req.RespCh
+	}
+
+	ds.pending[req.PageId] = append(ds.pending[req.PageId], req)
+	ds.queued++
+	ds.cond.Broadcast()
+
 	return req.RespCh
 }
 
-func (ds *DiskScheduler) handleDiskReq() {
-	for req := range ds.reqCh {
-		ds.pageQueueMu.Lock()
-		_, ok := ds.pageQueue[req.PageId]
-		if !ok {
-			ds.pageQueue[req.PageId] = make(chan DiskReq, 10)
+// ScheduleBatch queues reqs together so that the ones for adjacent pages are
+// coalesced, it returns their response channels in order. It blocks while the
+// queue is full, the batch may then take the queue past its depth.
+func (ds *DiskScheduler) ScheduleBatch(reqs []DiskReq) []<-chan DiskResp {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	for ds.queued >= ds.queueDepth && !ds.closed {
+		ds.cond.Wait()
+	}
+
+	respChs := make([]<-chan DiskResp, len(reqs))
+	for i, req := range reqs {
+		respChs[i] = req.RespCh
+
+		if ds.closed {
+			go func() {
+				req.RespCh <- DiskResp{Success: false, Err: errs.ErrClosed}
+			}()
+			continue
 		}
-		ds.pageQueueMu.Unlock()
 
-		ds.pageQueue[req.PageId] <- req
+		ds.pending[req.PageId] = append(ds.pending[req.PageId], req)
+		ds.queued++
+	}
+	ds.cond.Broadcast()
+
+	return respChs
+}
+
+// Close waits for the scheduled requests to be served, stops the workers and
+// closes the disk manager. Requests scheduled afterwards fail with
+// errs.ErrClosed.
+func (ds *DiskScheduler) Close() error {
+	ds.mu.Lock()
+	if ds.closed {
+		ds.mu.Unlock()
+		return nil
+	}
+	ds.closed = true
+	ds.cond.Broadcast()
+	ds.mu.Unlock()
+
+	ds.workers.Wait()
+
+	return ds.diskManager.Close()
+}
+
+// PageCount returns the number of pages on disk
+func (ds *DiskScheduler) PageCount() (int64, error) {
+	return ds.diskManager.pageCount()
+}
+
+// PageSize returns the size of a page, see WithPageSize
+func (ds *DiskScheduler) PageSize() int {
+	return ds.diskManager.pageSize
+}
+
+// Sync flushes the pages written so far to stable storage, see
+// diskManager.Sync
+func (ds *DiskScheduler) Sync() error {
+	return ds.diskManager.Sync()
+}
 
-		// !ok means we created a new page queue, therefore we should start a
-		// new worker to handle the queue's page requests
+// Stats reports how well pages compress on disk
+func (ds *DiskScheduler) Stats() CompressionStats {
+	return ds.diskManager.Stats()
+}
+
+func (ds *DiskScheduler) worker() {
+	defer ds.workers.Done()
+
+	for {
+		run, ok := ds.next()
 		if !ok {
-			go ds.pageWorker(req.PageId, ds.pageQueue[req.PageId])
+			return
 		}
+
+		ds.serve(run)
+
+		ds.mu.Lock()
+		for _, req := range run {
+			delete(ds.busy, req.PageId)
+		}
+		ds.cond.Broadcast()
+		ds.mu.Unlock()
 	}
 }
 
-func (ds *DiskScheduler) pageWorker(pageId int, reqQueue chan DiskReq) {
+// next waits for a request whose page isn't being served and takes it off
+// the queue along with the requests of the same kind at the head of the
+// following pages' queues. It returns false once the scheduler is closed and
+// drained.
+func (ds *DiskScheduler) next() ([]DiskReq, bool) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
 	for {
-		select {
-		case req := <-reqQueue:
-			if req.Write {
-				if err := ds.diskManager.writePage(req.PageId, req.Data); err != nil {
-					req.RespCh <- DiskResp{Success: false}
-				} else {
-					req.RespCh <- DiskResp{Success: true}
-				}
-			} else {
-				if data, err := ds.diskManager.readPage(req.PageId); err != nil {
-					req.RespCh <- DiskResp{Success: false}
-				} else {
-					req.RespCh <- DiskResp{Success: true, Data: data}
+		ready := []int{}
+		for pageId := range ds.pending {
+			if !ds.busy[pageId] {
+				ready = append(ready, pageId)
+			}
+		}
+
+		if len(ready) > 0 {
+			pageId := elevatorPick(ready, ds.head)
+			run := []DiskReq{ds.take(pageId)}
+
+			for len(run) < MAX_COALESCED_PAGES {
+				pageId++
+				queue := ds.pending[pageId]
+				if len(queue) == 0 || ds.busy[pageId] || queue[0].Write != run[0].Write {
+					break
 				}
+				run = append(run, ds.take(pageId))
 			}
+			ds.head = pageId
+
+			// slots opened up in the queue
+			ds.cond.Broadcast()
+			return run, true
+		}
+
+		if ds.closed && ds.queued == 0 {
+			return nil, false
+		}
+
+		ds.cond.Wait()
+	}
+}
+
+// take removes the request at the head of pageId's queue and marks the page
+// busy, callers must hold mu
+func (ds *DiskScheduler) take(pageId int) DiskReq {
+	req := ds.pending[pageId][0]
+
+	ds.pending[pageId] = ds.pending[pageId][1:]
+	if len(ds.pending[pageId]) == 0 {
+		delete(ds.pending, pageId)
+	}
+	ds.queued--
+	ds.busy[pageId] = true
+
+	return req
+}
+
+// serve reads or writes the pages of run with a single request, a run that
+// fails is served a page at a time so that each request gets its own error
+func (ds *DiskScheduler) serve(run []DiskReq) {
+	if len(run) == 1 {
+		ds.serveOne(run[0])
+		return
+	}
+
+	startId := run[0].PageId
+	if run[0].Write {
+		pages := make([][]byte, len(run))
+		for i, req := range run {
+			pages[i] = req.Data
+		}
 
-		default:
-			// done handling request for this page, can remove it from queue
-			ds.pageQueueMu.Lock()
-			delete(ds.pageQueue, pageId)
-			ds.pageQueueMu.Unlock()
+		if err := ds.diskManager.writePages(startId, pages); err == nil {
+			for _, req := range run {
+				respond(req, DiskResp{Success: true})
+			}
 			return
 		}
+	} else if pages, err := ds.diskManager.readPages(startId, len(run)); err == nil {
+		for i, req := range run {
+			respond(req, DiskResp{Success: true, Data: pages[i]})
+		}
+		return
+	}
+
+	for _, req := range run {
+		ds.serveOne(req)
+	}
+}
+
+// respond sends resp without holding up the worker, the caller may be
+// receiving the responses of a run in another order or not at all
+func respond(req DiskReq, resp DiskResp) {
+	select {
+	case req.RespCh <- resp:
+	default:
+		go func() {
+			req.RespCh <- resp
+		}()
+	}
+}
+
+func (ds *DiskScheduler) serveOne(req DiskReq) {
+	if req.Write {
+		if err := ds.diskManager.writePage(req.PageId, req.Data); err != nil {
+			respond(req, DiskResp{Success: false, Err: err})
+		} else {
+			respond(req, DiskResp{Success: true})
+		}
+		return
+	}
 
+	if data, err := ds.diskManager.readPage(req.PageId); err != nil {
+		respond(req, DiskResp{Success: false, Err: err})
+	} else {
+		respond(req, DiskResp{Success: true, Data: data})
 	}
+}
 
+// elevatorPick returns the lowest page at or after head, or the lowest page
+// when the sweep has passed all of them
+func elevatorPick(pageIds []int, head int) int {
+	next, lowest := -1, pageIds[0]
+	for _, pageId := range pageIds {
+		lowest = min(lowest, pageId)
+		if pageId >= head && (next == -1 || pageId < next) {
+			next = pageId
+		}
+	}
+
+	if next == -1 {
+		return lowest
+	}
+	return next
 }
 
 type DiskScheduler struct {
-	reqCh       chan DiskReq
 	diskManager *diskManager
+	workerCount int
+	queueDepth  int
 
-	pageQueue   map[int]chan DiskReq
-	pageQueueMu sync.Mutex
-	mu          sync.Mutex
+	// cond is signalled when requests are queued or served and on close
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	// pending holds the queued requests of each page in order, busy the pages
+	// a worker is serving
+	pending map[int][]DiskReq
+	busy    map[int]bool
+	queued  int
+	head    int
+	closed  bool
+	workers sync.WaitGroup
 }
 
 type DiskReq struct {
@@ -100,4 +350,7 @@ type DiskReq struct {
 type DiskResp struct {
 	Success bool
 	Data    []byte
+
+	// Err is why the request failed
+	Err error
 }
@@ -1,10 +1,12 @@
 package disk
 
 import (
+	"fmt"
 	"os"
 	"testing"
 	"time"
 
+	"github.com/jobala/petro/util/errs"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -73,4 +75,196 @@ func TestDiskScheduler(t *testing.T) {
 		time.Sleep(5 * time.Second)
 	})
 
+	t.Run("failed requests carry their error", func(t *testing.T) {
+		file := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(file.Name())
+		})
+
+		ds := NewScheduler(NewManager(file))
+		_ = file.Close()
+
+		res := <-ds.Schedule(NewRequest(1, make([]byte, PAGE_SIZE), true))
+		assert.False(t, res.Success)
+		assert.ErrorIs(t, res.Err, os.ErrClosed)
+
+		res = <-ds.Schedule(NewRequest(1, nil, false))
+		assert.False(t, res.Success)
+		assert.ErrorIs(t, res.Err, os.ErrClosed)
+	})
+
+	t.Run("close serves pending requests and stops", func(t *testing.T) {
+		file := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(file.Name())
+		})
+
+		ds := NewScheduler(NewManager(file))
+
+		data := make([]byte, PAGE_SIZE)
+		copy(data, []byte("hello world"))
+
+		respChs := []<-chan DiskResp{}
+		for pageId := range 5 {
+			respChs = append(respChs, ds.Schedule(NewRequest(int64(pageId+1), data, true)))
+		}
+
+		done := make(chan error)
+		go func() {
+			done <- ds.Close()
+		}()
+
+		for _, respCh := range respChs {
+			assert.NoError(t, (<-respCh).Err)
+		}
+		assert.NoError(t, <-done)
+		assert.NoError(t, ds.Close())
+
+		res := <-ds.Schedule(NewRequest(1, nil, false))
+		assert.ErrorIs(t, res.Err, errs.ErrClosed)
+		assert.ErrorIs(t, ds.Sync(), errs.ErrClosed)
+
+		// the db file is released
+		_, err := file.Stat()
+		assert.ErrorIs(t, err, os.ErrClosed)
+	})
+	t.Run("requests for a page are served in order", func(t *testing.T) {
+		file := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(file.Name())
+		})
+
+		ds := NewScheduler(NewManager(file), WithWorkers(8))
+
+		respChs := []<-chan DiskResp{}
+		for i := range 50 {
+			data := make([]byte, PAGE_SIZE)
+			data[0] = byte(i)
+			respChs = append(respChs, ds.Schedule(NewRequest(1, data, true)))
+		}
+		readCh := ds.Schedule(NewRequest(1, nil, false))
+
+		for _, respCh := range respChs {
+			assert.NoError(t, (<-respCh).Err)
+		}
+		assert.Equal(t, byte(49), (<-readCh).Data[0])
+		assert.NoError(t, ds.Close())
+	})
+
+	t.Run("batches of adjacent pages are coalesced", func(t *testing.T) {
+		file := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(file.Name())
+		})
+
+		ds := NewScheduler(NewManager(file), WithWorkers(1))
+
+		pages := [][]byte{}
+		writes := []DiskReq{}
+		for pageId := range 10 {
+			data := make([]byte, PAGE_SIZE)
+			copy(data, fmt.Sprintf("page %d", pageId))
+			pages = append(pages, data)
+			writes = append(writes, NewRequest(int64(pageId), data, true))
+		}
+
+		// responses can be received in any order
+		respChs := ds.ScheduleBatch(writes)
+		for i := len(respChs) - 1; i >= 0; i-- {
+			assert.NoError(t, (<-respChs[i]).Err)
+		}
+
+		reads := []DiskReq{}
+		for pageId := range 10 {
+			reads = append(reads, NewRequest(int64(pageId), nil, false))
+		}
+		for i, respCh := range ds.ScheduleBatch(reads) {
+			assert.Equal(t, pages[i], (<-respCh).Data)
+		}
+		assert.NoError(t, ds.Close())
+	})
+
+	t.Run("a failed run reports each page's error", func(t *testing.T) {
+		file := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(file.Name())
+		})
+
+		keys := StaticKeys{Current: 1, Keys: map[uint32][]byte{1: make([]byte, 32)}}
+		dm := NewManager(file, WithEncryption(keys))
+		for pageId := range 3 {
+			assert.NoError(t, dm.writePage(pageId, make([]byte, PAGE_SIZE)))
+		}
+
+		// flip a byte of the middle page
+		offset := dm.slotOffset(1) + ENCRYPTION_OVERHEAD
+		_, err := file.WriteAt([]byte{0xff}, offset)
+		assert.NoError(t, err)
+
+		ds := NewScheduler(dm, WithWorkers(1))
+		reads := []DiskReq{}
+		for pageId := range 3 {
+			reads = append(reads, NewRequest(int64(pageId), nil, false))
+		}
+
+		respChs := ds.ScheduleBatch(reads)
+		assert.NoError(t, (<-respChs[0]).Err)
+		assert.ErrorIs(t, (<-respChs[1]).Err, errs.ErrCorruptPage)
+		assert.NoError(t, (<-respChs[2]).Err)
+		assert.NoError(t, ds.Close())
+	})
+
+	t.Run("pages are served in elevator order", func(t *testing.T) {
+		assert.Equal(t, 60, elevatorPick([]int{30, 10, 60, 40, 20}, 50))
+		assert.Equal(t, 30, elevatorPick([]int{30, 10, 60, 40, 20}, 30))
+		assert.Equal(t, 10, elevatorPick([]int{30, 10, 40, 20}, 50))
+	})
+
+	t.Run("schedule blocks while the queue is full", func(t *testing.T) {
+		file := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(file.Name())
+		})
+
+		// the worker is held up compressing the first page and the second
+		// one fills the queue
+		codec := &gatedCodec{gate: make(chan struct{})}
+		ds := NewScheduler(NewManager(file, WithCodec(codec)), WithWorkers(1), WithQueueDepth(1))
+		data := make([]byte, PAGE_SIZE)
+
+		first := ds.Schedule(NewRequest(1, data, true))
+		second := ds.Schedule(NewRequest(2, data, true))
+
+		scheduled := make(chan (<-chan DiskResp))
+		go func() {
+			scheduled <- ds.Schedule(NewRequest(3, data, true))
+		}()
+
+		select {
+		case <-scheduled:
+			t.Fatal("schedule didn't wait for room in the queue")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		close(codec.gate)
+		assert.NoError(t, (<-first).Err)
+		third := <-scheduled
+		assert.NoError(t, (<-second).Err)
+		assert.NoError(t, (<-third).Err)
+		assert.NoError(t, ds.Close())
+	})
+}
+
+// gatedCodec stores pages as they are once gate is closed
+type gatedCodec struct {
+	gate chan struct{}
+}
+
+func (c *gatedCodec) Compress(data []byte) ([]byte, error) {
+	<-c.gate
+	return data, nil
+}
+
+func (c *gatedCodec) Decompress(data []byte) ([]byte, error) {
+	return data, nil
 }
@@ -0,0 +1,243 @@
+package disk
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"sync"
+
+	"github.com/jobala/petro/util/errs"
+)
+
+const (
+	// an encrypted page starts with the id of its key, the salt its key was
+	// derived with and its version
+	ENCRYPTION_SALT_SIZE   = 16
+	ENCRYPTION_HEADER_SIZE = 4 + ENCRYPTION_SALT_SIZE + 4
+	ENCRYPTION_OVERHEAD    = ENCRYPTION_HEADER_SIZE + 16
+)
+
+// KeyProvider supplies the AES keys pages are encrypted with. Keys are 16, 24
+// or 32 bytes long and are identified by a non zero id that's stored with
+// every page, so pages written with an older key can still be read.
+type KeyProvider interface {
+	// CurrentKey returns the key new pages are written with
+	CurrentKey() (uint32, []byte, error)
+
+	// Key returns the key with id
+	Key(id uint32) ([]byte, error)
+}
+
+// WithEncryption encrypts every page with AES-GCM. The nonce of a page is
+// its id and a version that grows with every write. Versions restart when
+// the file is opened, so pages are sealed with a key derived from the
+// provider's key and a random salt drawn for each run, and a new salt once
+// the versions run out. A nonce isn't repeated when writes are lost in a
+// crash or a file is copied. The page's id is authenticated with it and pages
+// that fail to authenticate are reported as errs.ErrCorruptPage.
+// Encryption has to be chosen when the db file is created, a file opened
+// with the wrong choice is refused with errs.ErrFormatMismatch.
+func WithEncryption(keys KeyProvider) Option {
+	return func(dm *diskManager) {
+		dm.cipher = &pageCipher{
+			keys:  keys,
+			aeads: map[string]cipher.AEAD{},
+		}
+	}
+}
+
+// RotateKeys re-encrypts every page of the db file that isn't encrypted with
+// the current key of keys, which must also supply the keys the pages were
+// written with. It has to run while the db file isn't in use, opts are the
+// options the file was written with. The file is synced and closed before
+// it returns the number of pages rewritten.
+func RotateKeys(file *os.File, keys KeyProvider, opts ...Option) (int64, error) {
+	dm := NewManager(file, append(opts, WithEncryption(keys))...)
+	defer dm.Close()
+
+	current, _, err := keys.CurrentKey()
+	if err != nil {
+		return 0, err
+	}
+
+	count, err := dm.pageCount()
+	if err != nil {
+		return 0, err
+	}
+
+	rewritten := int64(0)
+	for pageId := range int(count) {
+		stored, _, err := dm.readStored(pageId)
+		if err != nil {
+			return rewritten, err
+		}
+		if stored == nil || binary.LittleEndian.Uint32(stored) == current {
+			continue
+		}
+
+		data, err := dm.readPage(pageId)
+		if err != nil {
+			return rewritten, err
+		}
+		if err := dm.writePage(pageId, data); err != nil {
+			return rewritten, err
+		}
+		rewritten++
+	}
+
+	return rewritten, dm.sync()
+}
+
+// seal encrypts the payload of pageId under the next version
+func (c *pageCipher) seal(pageId int, payload []byte) ([]byte, error) {
+	keyId, key, err := c.keys.CurrentKey()
+	if err != nil {
+		return nil, fmt.Errorf("error getting encryption key: %v", err)
+	}
+
+	salt, version, err := c.nextVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, ENCRYPTION_HEADER_SIZE, ENCRYPTION_OVERHEAD+len(payload))
+	binary.LittleEndian.PutUint32(header, keyId)
+	copy(header[4:], salt[:])
+	binary.LittleEndian.PutUint32(header[4+ENCRYPTION_SALT_SIZE:], version)
+
+	aead, err := c.aead(keyId, key, header[4:4+ENCRYPTION_SALT_SIZE])
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(header, nonce(pageId, version), payload, additionalData(pageId, header)), nil
+}
+
+// open authenticates and decrypts the stored payload of pageId
+func (c *pageCipher) open(pageId int, stored []byte) ([]byte, error) {
+	if len(stored) < ENCRYPTION_OVERHEAD {
+		return nil, fmt.Errorf("%w: page %d is truncated", errs.ErrCorruptPage, pageId)
+	}
+
+	keyId := binary.LittleEndian.Uint32(stored)
+	key, err := c.keys.Key(keyId)
+	if err != nil {
+		return nil, fmt.Errorf("error getting encryption key %d: %v", keyId, err)
+	}
+	aead, err := c.aead(keyId, key, stored[4:4+ENCRYPTION_SALT_SIZE])
+	if err != nil {
+		return nil, err
+	}
+
+	header := stored[:ENCRYPTION_HEADER_SIZE]
+	version := binary.LittleEndian.Uint32(header[4+ENCRYPTION_SALT_SIZE:])
+	data, err := aead.Open(nil, nonce(pageId, version), stored[ENCRYPTION_HEADER_SIZE:], additionalData(pageId, header))
+	if err != nil {
+		return nil, fmt.Errorf("%w: page %d failed authentication", errs.ErrCorruptPage, pageId)
+	}
+
+	return data, nil
+}
+
+// nextVersion returns the salt and version of the next page sealed, a salt
+// is drawn on the first write and once its versions run out
+func (c *pageCipher) nextVersion() ([ENCRYPTION_SALT_SIZE]byte, uint32, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.version == 0 {
+		if _, err := rand.Read(c.salt[:]); err != nil {
+			return c.salt, 0, fmt.Errorf("error generating salt: %v", err)
+		}
+	}
+
+	c.version++
+	version := c.version
+	if c.version == math.MaxUint32 {
+		c.version = 0
+	}
+
+	return c.salt, version, nil
+}
+
+// aead returns the cipher of the key derived from key and salt
+func (c *pageCipher) aead(keyId uint32, key []byte, salt []byte) (cipher.AEAD, error) {
+	id := binary.LittleEndian.AppendUint32(slices.Clone(salt), keyId)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if aead, ok := c.aeads[string(id)]; ok {
+		return aead, nil
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(salt)
+
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, fmt.Errorf("error creating cipher for key %d: %v", keyId, err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("error creating cipher for key %d: %v", keyId, err)
+	}
+	c.aeads[string(id)] = aead
+
+	return aead, nil
+}
+
+// nonce is the page's id followed by its version
+func nonce(pageId int, version uint32) []byte {
+	nonce := binary.LittleEndian.AppendUint64(nil, uint64(pageId))
+	return binary.LittleEndian.AppendUint32(nonce, version)
+}
+
+// additionalData authenticates the page's header and id, so a page copied
+// over another fails to open
+func additionalData(pageId int, header []byte) []byte {
+	return binary.LittleEndian.AppendUint64(slices.Clone(header), uint64(pageId))
+}
+
+// written reports whether a slot holds an encrypted page, key ids start at 1
+func written(slot []byte) bool {
+	return len(slot) >= ENCRYPTION_HEADER_SIZE && binary.LittleEndian.Uint32(slot) != 0
+}
+
+func (k StaticKeys) CurrentKey() (uint32, []byte, error) {
+	key, err := k.Key(k.Current)
+	return k.Current, key, err
+}
+
+func (k StaticKeys) Key(id uint32) ([]byte, error) {
+	key, ok := k.Keys[id]
+	if !ok || id == 0 {
+		return nil, fmt.Errorf("unknown key %d", id)
+	}
+
+	return key, nil
+}
+
+// StaticKeys is a KeyProvider over keys held in memory
+type StaticKeys struct {
+	Current uint32
+	Keys    map[uint32][]byte
+}
+
+type pageCipher struct {
+	keys KeyProvider
+
+	// aeads holds the ciphers by salt and key id, salt and version are
+	// those of the last page sealed
+	mu      sync.Mutex
+	aeads   map[string]cipher.AEAD
+	salt    [ENCRYPTION_SALT_SIZE]byte
+	version uint32
+}
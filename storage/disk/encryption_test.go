@@ -0,0 +1,233 @@
+package disk
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/jobala/petro/util/errs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncryption(t *testing.T) {
+	keys := StaticKeys{
+		Current: 1,
+		Keys: map[uint32][]byte{
+			1: bytes.Repeat([]byte{1}, 32),
+			2: bytes.Repeat([]byte{2}, 32),
+		},
+	}
+
+	page := func(text string) []byte {
+		buf := make([]byte, PAGE_SIZE)
+		copy(buf, text)
+		return buf
+	}
+
+	slot := func(t *testing.T, file *os.File, pageId int) []byte {
+		buf := make([]byte, PAGE_SIZE+ENCRYPTION_OVERHEAD)
+		_, err := file.ReadAt(buf, FILE_HEADER_SIZE+int64(pageId)*int64(len(buf)))
+		assert.NoError(t, err)
+		return buf
+	}
+
+	t.Run("reads back encrypted pages", func(t *testing.T) {
+		dbFile := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(dbFile.Name())
+		})
+
+		dm := NewManager(dbFile, WithEncryption(keys))
+		assert.NoError(t, dm.writePage(1, page("hello world")))
+
+		res, err := dm.readPage(1)
+		assert.NoError(t, err)
+		assert.Equal(t, page("hello world"), res)
+
+		// the header page was never written
+		res, err = dm.readPage(0)
+		assert.NoError(t, err)
+		assert.Equal(t, make([]byte, PAGE_SIZE), res)
+
+		data, err := os.ReadFile(dbFile.Name())
+		assert.NoError(t, err)
+		assert.NotContains(t, string(data), "hello world")
+	})
+
+	t.Run("tampered pages are corrupt", func(t *testing.T) {
+		dbFile := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(dbFile.Name())
+		})
+
+		dm := NewManager(dbFile, WithEncryption(keys))
+		assert.NoError(t, dm.writePage(1, page("hello world")))
+		assert.NoError(t, dm.writePage(2, page("goodbye world")))
+
+		// a page copied over another doesn't authenticate under its id
+		_, err := dbFile.WriteAt(slot(t, dbFile, 1), FILE_HEADER_SIZE+2*(PAGE_SIZE+ENCRYPTION_OVERHEAD))
+		assert.NoError(t, err)
+		_, err = dm.readPage(2)
+		assert.ErrorIs(t, err, errs.ErrCorruptPage)
+
+		_, err = dbFile.WriteAt([]byte{0xff}, FILE_HEADER_SIZE+PAGE_SIZE+ENCRYPTION_OVERHEAD+100)
+		assert.NoError(t, err)
+		_, err = dm.readPage(1)
+		assert.ErrorIs(t, err, errs.ErrCorruptPage)
+	})
+
+	t.Run("pages are unreadable with another key", func(t *testing.T) {
+		dbFile := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(dbFile.Name())
+		})
+
+		dm := NewManager(dbFile, WithEncryption(keys))
+		assert.NoError(t, dm.writePage(1, page("hello world")))
+
+		other := StaticKeys{Current: 1, Keys: map[uint32][]byte{1: bytes.Repeat([]byte{3}, 32)}}
+		dm = NewManager(dbFile, WithEncryption(other))
+		_, err := dm.readPage(1)
+		assert.ErrorIs(t, err, errs.ErrCorruptPage)
+	})
+
+	t.Run("every write uses a new nonce", func(t *testing.T) {
+		dbFile := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(dbFile.Name())
+		})
+
+		salt := func() []byte {
+			return slot(t, dbFile, 1)[4 : 4+ENCRYPTION_SALT_SIZE]
+		}
+		version := func() uint32 {
+			return binary.LittleEndian.Uint32(slot(t, dbFile, 1)[4+ENCRYPTION_SALT_SIZE:])
+		}
+
+		dm := NewManager(dbFile, WithEncryption(keys))
+		assert.NoError(t, dm.writePage(1, page("hello world")))
+		assert.NoError(t, dm.writePage(1, page("hello world")))
+		assert.Equal(t, uint32(2), version())
+		first := salt()
+
+		// a reopened file starts its versions over under a new salt
+		dm = NewManager(dbFile, WithEncryption(keys))
+		assert.NoError(t, dm.writePage(1, page("hello world")))
+		assert.Equal(t, uint32(1), version())
+		assert.NotEqual(t, first, salt())
+
+		// and so does a run whose versions ran out
+		second := salt()
+		dm.cipher.version = math.MaxUint32 - 1
+		assert.NoError(t, dm.writePage(1, page("hello world")))
+		assert.Equal(t, second, salt())
+		assert.NoError(t, dm.writePage(1, page("hello world")))
+		assert.Equal(t, uint32(1), version())
+		assert.NotEqual(t, second, salt())
+
+		res, err := dm.readPage(1)
+		assert.NoError(t, err)
+		assert.Equal(t, page("hello world"), res)
+	})
+
+	t.Run("refuses files opened with the wrong encryption choice", func(t *testing.T) {
+		encrypted := CreateDbFile(t)
+		plain := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(encrypted.Name())
+			_ = os.Remove(plain.Name())
+		})
+
+		dm := NewManager(encrypted, WithEncryption(keys))
+		assert.NoError(t, dm.writePage(1, page("hello world")))
+		dm = NewManager(plain)
+		assert.NoError(t, dm.writePage(1, page("hello world")))
+
+		_, err := NewManager(encrypted).readPage(1)
+		assert.ErrorIs(t, err, errs.ErrFormatMismatch)
+
+		_, err = NewManager(plain, WithEncryption(keys)).readPage(1)
+		assert.ErrorIs(t, err, errs.ErrFormatMismatch)
+	})
+
+	t.Run("a page copied over another fails to authenticate", func(t *testing.T) {
+		dbFile := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(dbFile.Name())
+		})
+
+		dm := NewManager(dbFile, WithEncryption(keys))
+		assert.NoError(t, dm.writePage(1, page("hello world")))
+		assert.NoError(t, dm.writePage(2, page("goodbye world")))
+
+		_, err := dbFile.WriteAt(slot(t, dbFile, 1), FILE_HEADER_SIZE+2*(PAGE_SIZE+ENCRYPTION_OVERHEAD))
+		assert.NoError(t, err)
+
+		_, err = dm.readPage(2)
+		assert.ErrorIs(t, err, errs.ErrCorruptPage)
+	})
+
+	t.Run("works with compression", func(t *testing.T) {
+		dbFile := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(dbFile.Name())
+			_ = os.Remove(dbFile.Name() + ".map")
+		})
+
+		opts := []Option{WithCodec(NewFlateCodec(flate.DefaultCompression)), WithEncryption(keys)}
+
+		dm := NewManager(dbFile, opts...)
+		for i := 1; i <= 5; i++ {
+			assert.NoError(t, dm.writePage(i, page("hello world")))
+		}
+		assert.Less(t, dm.Stats().StoredBytes, int64(5*PAGE_SIZE/10))
+		assert.NoError(t, dm.Sync())
+
+		dm = NewManager(dbFile, opts...)
+		for i := 1; i <= 5; i++ {
+			res, err := dm.readPage(i)
+			assert.NoError(t, err)
+			assert.Equal(t, page("hello world"), res)
+		}
+	})
+
+	t.Run("rotates keys", func(t *testing.T) {
+		dbFile := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(dbFile.Name())
+		})
+
+		dm := NewManager(dbFile, WithEncryption(keys))
+		for i := 1; i <= 5; i++ {
+			assert.NoError(t, dm.writePage(i, page("hello world")))
+		}
+
+		rotated := StaticKeys{Current: 2, Keys: keys.Keys}
+		count, err := RotateKeys(dbFile, rotated)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(5), count)
+
+		// rotating closes the file
+		dbFile, err = os.OpenFile(dbFile.Name(), os.O_RDWR, 0644)
+		assert.NoError(t, err)
+
+		// pages already on the current key are skipped
+		count, err = RotateKeys(dbFile, rotated)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(0), count)
+
+		dbFile, err = os.OpenFile(dbFile.Name(), os.O_RDWR, 0644)
+		assert.NoError(t, err)
+
+		// the old key is no longer needed
+		dm = NewManager(dbFile, WithEncryption(StaticKeys{Current: 2, Keys: map[uint32][]byte{2: keys.Keys[2]}}))
+		for i := 1; i <= 5; i++ {
+			res, err := dm.readPage(i)
+			assert.NoError(t, err)
+			assert.Equal(t, page("hello world"), res)
+		}
+	})
+}
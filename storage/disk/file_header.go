@@ -0,0 +1,81 @@
+package disk
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/jobala/petro/util/errs"
+)
+
+const (
+	// a db file that's encrypted or has pages of other than PAGE_SIZE bytes
+	// starts with FILE_MAGIC, its flags and its page size. Its pages follow
+	// the first FILE_HEADER_SIZE bytes.
+	FILE_MAGIC       = "PETROFMT"
+	FILE_HEADER_SIZE = SECTOR_SIZE
+)
+
+const (
+	// the file's pages are encrypted
+	fileEncrypted uint32 = 1 << iota
+)
+
+// checkHeader refuses a db file that wasn't created with the encryption
+// choice and page size it's opened with. A file that holds nothing but zeros
+// is new, it's given a header when it needs one.
+func checkHeader(file *os.File, encrypted bool, pageSize int) error {
+	buf := make([]byte, len(FILE_MAGIC)+8)
+	n, err := file.ReadAt(buf, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("error reading file header: %w", err)
+	}
+
+	if n == len(buf) && string(buf[:len(FILE_MAGIC)]) == FILE_MAGIC {
+		flags := binary.LittleEndian.Uint32(buf[len(FILE_MAGIC):])
+		size := int(binary.LittleEndian.Uint32(buf[len(FILE_MAGIC)+4:]))
+
+		return checkFormat(file, flags&fileEncrypted != 0, size, encrypted, pageSize)
+	}
+
+	written, err := hasData(file)
+	if err != nil {
+		return fmt.Errorf("error reading db file: %w", err)
+	}
+	if written {
+		// files without a header are plain and have pages of PAGE_SIZE
+		return checkFormat(file, false, PAGE_SIZE, encrypted, pageSize)
+	}
+	if !encrypted && pageSize == PAGE_SIZE {
+		return nil
+	}
+
+	flags := uint32(0)
+	if encrypted {
+		flags |= fileEncrypted
+	}
+	header := binary.LittleEndian.AppendUint32([]byte(FILE_MAGIC), flags)
+	header = binary.LittleEndian.AppendUint32(header, uint32(pageSize))
+
+	if _, err := file.WriteAt(header, 0); err != nil {
+		return fmt.Errorf("error writing file header: %w", err)
+	}
+
+	return nil
+}
+
+// checkFormat compares how a db file was created with how it's opened
+func checkFormat(file *os.File, wasEncrypted bool, wasPageSize int, encrypted bool, pageSize int) error {
+	switch {
+	case wasEncrypted && !encrypted:
+		return fmt.Errorf("%w: %s is encrypted", errs.ErrFormatMismatch, file.Name())
+	case !wasEncrypted && encrypted:
+		return fmt.Errorf("%w: %s isn't encrypted", errs.ErrFormatMismatch, file.Name())
+	case wasPageSize != pageSize:
+		return fmt.Errorf("%w: %s has pages of %d bytes, not %d", errs.ErrFormatMismatch, file.Name(), wasPageSize, pageSize)
+	}
+
+	return nil
+}
@@ -0,0 +1,386 @@
+package disk
+
+import (
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sync"
+
+	"github.com/jobala/petro/util/errs"
+)
+
+const (
+	// compressed pages are stored in extents of whole sectors
+	SECTOR_SIZE = 512
+
+	// a map entry is the extent's offset, the payload length, the extent's
+	// capacity and flags
+	PAGE_MAP_ENTRY_SIZE = 20
+
+	// the map starts with PAGE_MAP_MAGIC, which marks its db file as
+	// compressed
+	PAGE_MAP_HEADER_SIZE = 8
+	PAGE_MAP_MAGIC       = "PETROMAP"
+)
+
+const (
+	// the payload is stored raw because it didn't compress
+	extentRaw uint32 = 1 << iota
+)
+
+// openPageMap loads the map kept next to dbFile, it's created with dbFile.
+// A db file that was written without a map is refused with
+// errs.ErrFormatMismatch. Extents start at offset start of dbFile and hold at
+// most pageSize bytes. Unless
+// deferSave is false, map entries are only written by save after the db file
+// is synced, and pages the map on disk points at are written to a new extent.
+func openPageMap(dbFile *os.File, start int64, pageSize int, deferSave bool) (*pageMap, error) {
+	file, err := os.OpenFile(pageMapPath(dbFile), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening page map: %w", err)
+	}
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("error reading page map: %w", err)
+	}
+
+	info, err := dbFile.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("error reading file info: %w", err)
+	}
+
+	if len(data) == 0 {
+		written, err := hasData(dbFile)
+		if err != nil {
+			_ = file.Close()
+			return nil, fmt.Errorf("error reading db file: %w", err)
+		}
+		if written {
+			_ = file.Close()
+			return nil, fmt.Errorf("%w: %s was written without a codec", errs.ErrFormatMismatch, dbFile.Name())
+		}
+
+		data = []byte(PAGE_MAP_MAGIC)
+		if _, err := file.WriteAt(data, 0); err != nil {
+			_ = file.Close()
+			return nil, fmt.Errorf("error writing page map: %w", err)
+		}
+	}
+	if len(data) < PAGE_MAP_HEADER_SIZE || string(data[:PAGE_MAP_HEADER_SIZE]) != PAGE_MAP_MAGIC {
+		_ = file.Close()
+		return nil, fmt.Errorf("%w: %s is not a page map", errs.ErrFormatMismatch, file.Name())
+	}
+	data = data[PAGE_MAP_HEADER_SIZE:]
+
+	pm := &pageMap{
+		file:      file,
+		dbFile:    dbFile,
+		extents:   make([]pageExtent, len(data)/PAGE_MAP_ENTRY_SIZE),
+		free:      map[int64][]int64{},
+		staged:    map[int]pageExtent{},
+		fresh:     map[int]bool{},
+		deferSave: deferSave,
+		start:     start,
+		end:       max(roundUp(info.Size(), SECTOR_SIZE), start),
+		pageSize:  pageSize,
+	}
+
+	for i := range pm.extents {
+		entry := data[i*PAGE_MAP_ENTRY_SIZE:]
+		extent := pageExtent{
+			Offset:   int64(binary.LittleEndian.Uint64(entry)),
+			Length:   binary.LittleEndian.Uint32(entry[8:]),
+			Capacity: binary.LittleEndian.Uint32(entry[12:]),
+			Flags:    binary.LittleEndian.Uint32(entry[16:]),
+		}
+		pm.extents[i] = extent
+
+		if extent.Capacity > 0 {
+			pm.count(extent, 1)
+		}
+	}
+	pm.collectFree()
+
+	return pm, nil
+}
+
+// write stores the payload of pageId. The page moves to a new extent when it
+// outgrew its own or when the map on disk may point at its extent, which is
+// then left as it is until the map stops pointing at it.
+func (pm *pageMap) write(pageId int, payload []byte, flags uint32) error {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	for len(pm.extents) <= pageId {
+		pm.extents = append(pm.extents, pageExtent{})
+	}
+
+	old := pm.extents[pageId]
+	saved := pm.deferSave && !pm.fresh[pageId]
+
+	extent := old
+	if int(old.Capacity) < len(payload) || saved {
+		extent.Offset, extent.Capacity = pm.alloc(roundUp(int64(len(payload)), SECTOR_SIZE))
+	}
+	extent.Length = uint32(len(payload))
+	extent.Flags = flags
+
+	if _, err := pm.dbFile.WriteAt(payload, extent.Offset); err != nil {
+		if extent.Offset != old.Offset {
+			pm.release([]pageExtent{extent})
+		}
+		return fmt.Errorf("error writing at offset %d: %w", extent.Offset, err)
+	}
+
+	if pm.deferSave {
+		pm.staged[pageId] = extent
+		pm.fresh[pageId] = true
+	} else if err := pm.saveEntry(pageId, extent); err != nil {
+		return err
+	}
+
+	if old.Capacity > 0 {
+		pm.count(old, -1)
+		if old.Offset != extent.Offset && saved {
+			// the map on disk points at the old extent until it's saved
+			pm.freed = append(pm.freed, old)
+		} else if old.Offset != extent.Offset {
+			pm.release([]pageExtent{old})
+		}
+	}
+	pm.count(extent, 1)
+	pm.extents[pageId] = extent
+
+	return nil
+}
+
+// read returns the payload of pageId and its flags, the payload is nil when
+// the page was never written
+func (pm *pageMap) read(pageId int) ([]byte, uint32, error) {
+	pm.mu.Lock()
+	extent := pageExtent{}
+	if pageId < len(pm.extents) {
+		extent = pm.extents[pageId]
+	}
+	pm.mu.Unlock()
+
+	if extent.Capacity == 0 {
+		return nil, 0, nil
+	}
+
+	payload := make([]byte, extent.Length)
+	if _, err := pm.dbFile.ReadAt(payload, extent.Offset); err != nil {
+		return nil, 0, fmt.Errorf("error reading from offset %d: %w", extent.Offset, err)
+	}
+
+	return payload, extent.Flags, nil
+}
+
+func (pm *pageMap) pageCount() int64 {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	return max(int64(len(pm.extents)), 1)
+}
+
+func (pm *pageMap) stats() CompressionStats {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	return pm.totals
+}
+
+// alloc returns the offset and capacity of a free extent that holds at least
+// size bytes, growing the file when there is none
+func (pm *pageMap) alloc(size int64) (int64, uint32) {
+	for capacity := size; capacity <= int64(pm.pageSize); capacity += SECTOR_SIZE {
+		if offsets := pm.free[capacity]; len(offsets) > 0 {
+			pm.free[capacity] = offsets[:len(offsets)-1]
+			return offsets[len(offsets)-1], uint32(capacity)
+		}
+	}
+
+	offset := pm.end
+	pm.end += size
+
+	return offset, uint32(size)
+}
+
+// takeStaged returns the map entries written since the last call and the
+// extents pages moved out of meanwhile. From then on the map on disk may
+// point at the extents of the entries, so their pages move when written again.
+// The entries are passed to save once the db file is synced.
+func (pm *pageMap) takeStaged() (map[int]pageExtent, []pageExtent) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	staged, freed := pm.staged, pm.freed
+	pm.staged, pm.freed = map[int]pageExtent{}, nil
+	pm.fresh = map[int]bool{}
+
+	return staged, freed
+}
+
+// save writes staged to the map and syncs it, the freed extents are then
+// reused. When it fails the entries are staged again unless a page was
+// written since, and the extents kept back.
+func (pm *pageMap) save(staged map[int]pageExtent, freed []pageExtent) error {
+	err := func() error {
+		for pageId, extent := range staged {
+			if err := pm.saveEntry(pageId, extent); err != nil {
+				return err
+			}
+		}
+		if err := pm.file.Sync(); err != nil {
+			return fmt.Errorf("error syncing page map: %w", err)
+		}
+		return nil
+	}()
+
+	if err != nil {
+		pm.restage(staged, freed)
+		return err
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	pm.release(freed)
+	return nil
+}
+
+// restage puts back what takeStaged returned after a failed sync
+func (pm *pageMap) restage(staged map[int]pageExtent, freed []pageExtent) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	for pageId, extent := range staged {
+		if _, ok := pm.staged[pageId]; !ok {
+			pm.staged[pageId] = extent
+		}
+	}
+	pm.freed = append(pm.freed, freed...)
+}
+
+// release adds extents to the free space, callers must hold mu
+func (pm *pageMap) release(extents []pageExtent) {
+	for _, extent := range extents {
+		pm.free[int64(extent.Capacity)] = append(pm.free[int64(extent.Capacity)], extent.Offset)
+	}
+}
+
+// collectFree finds the space between the extents in use, it's split into
+// extents of at most a page
+func (pm *pageMap) collectFree() {
+	used := []pageExtent{}
+	for _, extent := range pm.extents {
+		if extent.Capacity > 0 {
+			used = append(used, extent)
+		}
+	}
+	if len(used) == 0 {
+		return
+	}
+
+	slices.SortFunc(used, func(a, b pageExtent) int {
+		return cmp.Compare(a.Offset, b.Offset)
+	})
+
+	offset := pm.start
+	for _, extent := range used {
+		for offset < extent.Offset {
+			capacity := min(extent.Offset-offset, int64(pm.pageSize))
+			pm.free[capacity] = append(pm.free[capacity], offset)
+			offset += capacity
+		}
+		offset = extent.Offset + int64(extent.Capacity)
+	}
+	pm.end = max(pm.end, offset)
+}
+
+// saveEntry writes the map entry of pageId
+func (pm *pageMap) saveEntry(pageId int, extent pageExtent) error {
+	entry := make([]byte, PAGE_MAP_ENTRY_SIZE)
+	binary.LittleEndian.PutUint64(entry, uint64(extent.Offset))
+	binary.LittleEndian.PutUint32(entry[8:], extent.Length)
+	binary.LittleEndian.PutUint32(entry[12:], extent.Capacity)
+	binary.LittleEndian.PutUint32(entry[16:], extent.Flags)
+
+	offset := int64(PAGE_MAP_HEADER_SIZE + pageId*PAGE_MAP_ENTRY_SIZE)
+	if _, err := pm.file.WriteAt(entry, offset); err != nil {
+		return fmt.Errorf("error writing page map at offset %d: %w", offset, err)
+	}
+
+	return nil
+}
+
+func (pm *pageMap) count(extent pageExtent, n int64) {
+	pm.totals.Pages += n
+	pm.totals.RawBytes += n * int64(pm.pageSize)
+	pm.totals.StoredBytes += n * int64(extent.Length)
+}
+
+// hasData reports whether file holds anything but zeros. A db file holding
+// data before its map exists was written without a codec.
+func hasData(file *os.File) (bool, error) {
+	buf := make([]byte, 64*PAGE_SIZE)
+	for offset := int64(0); ; offset += int64(len(buf)) {
+		n, err := file.ReadAt(buf, offset)
+		if slices.ContainsFunc(buf[:n], func(b byte) bool { return b != 0 }) {
+			return true, nil
+		}
+		if errors.Is(err, io.EOF) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+// pageMapPath is where the map of dbFile is kept
+func pageMapPath(dbFile *os.File) string {
+	return dbFile.Name() + ".map"
+}
+
+func roundUp(n, multiple int64) int64 {
+	return (n + multiple - 1) / multiple * multiple
+}
+
+// pageMap tracks where compressed pages are in the db file
+type pageMap struct {
+	file   *os.File
+	dbFile *os.File
+
+	mu       sync.Mutex
+	extents  []pageExtent
+	free     map[int64][]int64
+	start    int64
+	end      int64
+	pageSize int
+	totals   CompressionStats
+
+	// staged holds the map entries that aren't written yet, fresh the pages
+	// whose extent the map on disk can't point at and freed the extents pages
+	// moved out of that it may still point at
+	staged    map[int]pageExtent
+	fresh     map[int]bool
+	freed     []pageExtent
+	deferSave bool
+}
+
+// pageExtent is the part of the db file holding a page, a zero Capacity
+// means the page was never written
+type pageExtent struct {
+	Offset   int64
+	Length   uint32
+	Capacity uint32
+	Flags    uint32
+}
@@ -0,0 +1,99 @@
+package disk
+
+import (
+	"fmt"
+	"time"
+)
+
+type SyncMode int
+
+const (
+	// SYNC_ON_FLUSH syncs the db file when the buffer pool is flushed
+	SYNC_ON_FLUSH SyncMode = iota
+
+	// SYNC_NONE never syncs and leaves it to the OS to write pages back
+	SYNC_NONE
+
+	// SYNC_ALWAYS syncs after every page written
+	SYNC_ALWAYS
+
+	// SYNC_PERIODIC syncs on flush and in the background every interval
+	SYNC_PERIODIC
+)
+
+const DEFAULT_SYNC_INTERVAL = time.Second
+
+// WithSyncMode sets when the db file is synced to stable storage, it
+// defaults to SYNC_ON_FLUSH
+func WithSyncMode(mode SyncMode) Option {
+	return func(dm *diskManager) {
+		dm.syncMode = mode
+	}
+}
+
+// WithSyncInterval sets how often SYNC_PERIODIC syncs, it defaults to
+// DEFAULT_SYNC_INTERVAL
+func WithSyncInterval(interval time.Duration) Option {
+	return func(dm *diskManager) {
+		dm.syncInterval = interval
+	}
+}
+
+// Sync flushes the pages written so far to stable storage. It does nothing in
+// SYNC_NONE. A failed background sync is reported by the next call.
+func (dm *diskManager) Sync() error {
+	if err := dm.check(); err != nil {
+		return err
+	}
+	if dm.syncMode == SYNC_NONE {
+		return nil
+	}
+
+	if err := dm.syncErr.Swap(nil); err != nil {
+		return *err
+	}
+
+	return dm.sync()
+}
+
+// sync syncs the db file and then writes and syncs the page map entries
+// staged since the last sync. Pages the map on disk points at are never
+// written over, so after a crash it points at the pages of the last sync.
+// Extents pages moved out of are reused once the map stops pointing at them.
+func (dm *diskManager) sync() error {
+	if dm.pages == nil {
+		if err := dm.dbFile.Sync(); err != nil {
+			return fmt.Errorf("error syncing db file: %w", err)
+		}
+		return nil
+	}
+
+	dm.syncMu.Lock()
+	defer dm.syncMu.Unlock()
+
+	staged, freed := dm.pages.takeStaged()
+
+	if err := dm.dbFile.Sync(); err != nil {
+		dm.pages.restage(staged, freed)
+		return fmt.Errorf("error syncing db file: %w", err)
+	}
+
+	return dm.pages.save(staged, freed)
+}
+
+// syncPeriodically syncs every interval until stop is closed
+func (dm *diskManager) syncPeriodically(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := dm.sync(); err != nil {
+				dm.syncErr.Store(&err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package disk
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSync(t *testing.T) {
+	t.Run("syncs written pages", func(t *testing.T) {
+		for _, mode := range []SyncMode{SYNC_ON_FLUSH, SYNC_NONE, SYNC_ALWAYS, SYNC_PERIODIC} {
+			dbFile := CreateDbFile(t)
+			t.Cleanup(func() {
+				_ = os.Remove(dbFile.Name())
+			})
+
+			ds := NewScheduler(NewManager(dbFile, WithSyncMode(mode)))
+
+			req := NewRequest(1, make([]byte, PAGE_SIZE), true)
+			resp := <-ds.Schedule(req)
+			assert.True(t, resp.Success)
+			assert.NoError(t, ds.Sync())
+		}
+	})
+
+	t.Run("sync errors are reported", func(t *testing.T) {
+		dbFile := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(dbFile.Name())
+		})
+
+		dm := NewManager(dbFile)
+		unsynced := NewManager(dbFile, WithSyncMode(SYNC_NONE))
+		_ = dbFile.Close()
+		assert.Error(t, dm.Sync())
+
+		// unless syncing is turned off
+		assert.NoError(t, unsynced.Sync())
+	})
+
+	t.Run("reports failed background syncs", func(t *testing.T) {
+		dbFile := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(dbFile.Name())
+		})
+
+		dm := NewManager(dbFile, WithSyncMode(SYNC_PERIODIC), WithSyncInterval(time.Millisecond))
+		_ = dbFile.Close()
+
+		assert.Eventually(t, func() bool {
+			return dm.syncErr.Load() != nil
+		}, time.Second, time.Millisecond)
+		assert.Error(t, dm.Sync())
+	})
+
+	t.Run("syncs after every write", func(t *testing.T) {
+		dbFile := CreateDbFile(t)
+		t.Cleanup(func() {
+			_ = os.Remove(dbFile.Name())
+		})
+
+		dm := NewManager(dbFile, WithSyncMode(SYNC_ALWAYS))
+		assert.NoError(t, dm.writePage(1, make([]byte, PAGE_SIZE)))
+
+		res, err := dm.readPage(1)
+		assert.NoError(t, err)
+		assert.Equal(t, make([]byte, PAGE_SIZE), res)
+	})
+}
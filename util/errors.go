@@ -1,5 +1,11 @@
 package util
 
+import (
+	"fmt"
+
+	"github.com/jobala/petro/util/errs"
+)
+
 type PetroError struct {
 	Message string
 	Err     error
@@ -16,3 +22,43 @@ func (e *PetroError) Unwrap() error {
 type BufferpoolExhaustedError struct {
 	*PetroError
 }
+
+var ErrKeyNotFound = &PetroError{Message: "key not found"}
+var ErrKeyTooLarge = &PetroError{Message: "key too large"}
+var ErrValueTooLarge = &PetroError{Message: "value too large"}
+
+// ErrReservedName is returned for index names that could be mistaken for the
+// names of the trees an index keeps for itself
+var ErrReservedName = &PetroError{Message: "reserved name"}
+
+// ErrTreeNotFound is returned when a db file holds no tree by the name asked
+// for
+var ErrTreeNotFound = &PetroError{Message: "tree not found"}
+
+// ErrPageOverflow is returned instead of writing a page whose encoding would
+// be truncated to the page size
+var ErrPageOverflow = &PetroError{Message: "page overflow"}
+
+// ErrCorruptPage, ErrClosed and ErrFormatMismatch are defined by errs, so
+// that the disk package can return them without depending on util
+var (
+	ErrCorruptPage    = errs.ErrCorruptPage
+	ErrClosed         = errs.ErrClosed
+	ErrFormatMismatch = errs.ErrFormatMismatch
+)
+
+// IOError is returned when a page can't be read from or written to disk
+type IOError struct {
+	// Op is "read" or "write"
+	Op     string
+	PageId int64
+	Err    error
+}
+
+func (e *IOError) Error() string {
+	return fmt.Sprintf("%s of page %d failed: %v", e.Op, e.PageId, e.Err)
+}
+
+func (e *IOError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,17 @@
+// Package errs holds the errors shared by the storage packages and the
+// packages built on them. It imports nothing, so that any package can wrap
+// them.
+package errs
+
+import "errors"
+
+// ErrCorruptPage is returned when a page read from disk fails its integrity
+// check
+var ErrCorruptPage = errors.New("corrupt page")
+
+// ErrClosed is returned by calls made after Close
+var ErrClosed = errors.New("closed")
+
+// ErrFormatMismatch is returned when a db file is opened with options it
+// wasn't written with
+var ErrFormatMismatch = errors.New("format mismatch")